@@ -0,0 +1,405 @@
+package redis
+
+import (
+    "bufio"
+    "container/list"
+    "net"
+    "os"
+    "reflect"
+    "strconv"
+    "sync"
+    "time"
+)
+
+// The channel redis publishes invalidations on, to the connection that
+// tracking is redirected to.
+const invalidateChannel = "__redis__:invalidate"
+
+// How long a Cache reads straight from the client after failing to
+// connect, before it tries again.
+const cacheRetryDelay = 1e9
+
+// Returned by Cache reads once Close has been called.
+var ErrCacheClosed = RedisError("cache closed")
+
+// A local cache of reads, kept consistent with redis by client side
+// caching: redis tracks the keys read through the cache and sends an
+// invalidation whenever they change, which evicts them.
+//
+// The cache reads on a connection of its own, with tracking redirected to
+// a second connection subscribed to the invalidations. If either one
+// fails, invalidations may have been missed, so the whole cache is
+// flushed. Until it reconnects, reads go to the client uncached.
+//
+// Values returned by the cache are shared with it and mustn't be
+// modified. Misses are read one at a time.
+type Cache struct {
+    client     *client
+    interval   int64
+    maxEntries int
+    maxTTL     int64
+
+    // serializes reads on the tracked connection
+    readLock sync.Mutex
+
+    // guards the fields below
+    lock    sync.Mutex
+    session *cacheSession
+    retryAt int64
+    entries map[string]*list.Element
+    lru     *list.List
+    // the key being read, and whether it was invalidated meanwhile, in
+    // which case the value read may be stale and isn't cached
+    reading string
+    stale   bool
+    closed  bool
+}
+
+type cacheEntry struct {
+    key     string
+    cmd     string
+    value   interface{}
+    expires int64
+}
+
+// the connections of a Cache, replaced together when either fails
+type cacheSession struct {
+    conn  net.Conn
+    inval net.Conn
+    done  chan bool
+    once  sync.Once
+}
+
+func (s *cacheSession) close() {
+    s.once.Do(func() {
+        close(s.done)
+        s.conn.Close()
+        s.inval.Close()
+    })
+}
+
+// Creates a cache holding at most maxEntries values, each for at most
+// maxTTL nanoseconds in case an invalidation is lost. 0 means no limit.
+func NewCache(c *client, maxEntries int, maxTTL int64) *Cache {
+    cache := new(Cache)
+    cache.client = c
+    cache.interval = pubsubKeepalive
+    cache.maxEntries = maxEntries
+    cache.maxTTL = maxTTL
+    cache.entries = make(map[string]*list.Element)
+    cache.lru = list.New()
+    return cache
+}
+
+// Like client.Get, answering from the cache when it can.
+func (self *Cache) Get(key string) ([]byte, os.Error) {
+    res, err := self.read("GET", key)
+    if err != nil {
+        return nil, err
+    }
+
+    return bulkReply("GET", res)
+}
+
+// Like client.Hgetall, answering from the cache when it can.
+func (self *Cache) Hgetall(key string, val interface{}) os.Error {
+    res, err := self.read("HGETALL", key)
+    if err != nil {
+        return err
+    }
+
+    data, err := multiBulkReply("HGETALL", res)
+    if err != nil {
+        return err
+    }
+    if len(data) == 0 {
+        return ErrNil
+    }
+    return writeToContainer(data, reflect.ValueOf(val))
+}
+
+// Returns the number of values cached.
+func (self *Cache) Len() int {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+
+    return self.lru.Len()
+}
+
+// Evicts every value.
+func (self *Cache) Flush() {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+
+    self.flush()
+}
+
+// Flushes the cache and closes its connections. Reads fail with
+// ErrCacheClosed afterwards.
+func (self *Cache) Close() os.Error {
+    self.lock.Lock()
+    s := self.session
+    self.session = nil
+    self.closed = true
+    self.flush()
+    self.lock.Unlock()
+
+    if s != nil {
+        s.close()
+    }
+    return nil
+}
+
+// with the lock held
+func (self *Cache) flush() {
+    self.entries = make(map[string]*list.Element)
+    self.lru.Init()
+    self.stale = true
+}
+
+func (self *Cache) read(cmd string, key string) (interface{}, os.Error) {
+    if res, ok := self.lookup(cmd, key); ok {
+        return res, nil
+    }
+
+    self.readLock.Lock()
+    defer self.readLock.Unlock()
+
+    s, err := self.start(key)
+    if err == ErrCacheClosed {
+        return nil, err
+    }
+    if err != nil {
+        // without tracking nothing can be cached
+        return self.client.sendCommand(cmd, key)
+    }
+
+    res, err := self.client.rawSend(s.conn, commandBytes(cmd, key), readResponse)
+    if err != nil {
+        if _, ok := err.(RedisError); !ok {
+            self.drop(s)
+        }
+        return nil, err
+    }
+    self.store(cmd, key, res)
+    return res, nil
+}
+
+func (self *Cache) lookup(cmd string, key string) (interface{}, bool) {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+
+    e, ok := self.entries[key]
+    if !ok {
+        return nil, false
+    }
+    entry := e.Value.(*cacheEntry)
+    if entry.cmd != cmd || entry.expires != 0 && time.Nanoseconds() >= entry.expires {
+        return nil, false
+    }
+    self.lru.MoveToFront(e)
+    return entry.value, true
+}
+
+// returns the session to read key on, connecting if there's none, with
+// readLock held
+func (self *Cache) start(key string) (*cacheSession, os.Error) {
+    self.lock.Lock()
+    s, closed, retryAt := self.session, self.closed, self.retryAt
+    self.lock.Unlock()
+
+    if closed {
+        return nil, ErrCacheClosed
+    }
+    if s == nil {
+        if time.Nanoseconds() < retryAt {
+            return nil, RedisError("cache disconnected")
+        }
+        var reader *bufio.Reader
+        var err os.Error
+        s, reader, err = self.connect()
+
+        self.lock.Lock()
+        if err == nil && self.closed {
+            err = ErrCacheClosed
+        }
+        if err != nil {
+            self.retryAt = time.Nanoseconds() + cacheRetryDelay
+            self.lock.Unlock()
+            if s != nil {
+                s.close()
+            }
+            return nil, err
+        }
+        self.session = s
+        self.lock.Unlock()
+
+        go self.run(s, reader)
+        go self.keepalive(s)
+    }
+
+    self.lock.Lock()
+    self.reading = key
+    self.stale = false
+    self.lock.Unlock()
+    return s, nil
+}
+
+// opens the invalidation connection, then the connection tracked by it
+func (self *Cache) connect() (*cacheSession, *bufio.Reader, os.Error) {
+    inval, err := self.client.openConnection()
+    if err != nil {
+        return nil, nil, err
+    }
+    id, err := Int(self.client.rawSend(inval, commandBytes("CLIENT", "ID"), readResponse))
+    if err != nil {
+        inval.Close()
+        return nil, nil, err
+    }
+    reader := bufio.NewReader(inval)
+    err = writeRequest(inval, "SUBSCRIBE", invalidateChannel)
+    if err == nil {
+        _, err = readResponse(reader)
+    }
+    if err != nil {
+        inval.Close()
+        return nil, nil, err
+    }
+
+    conn, err := self.client.openConnection()
+    if err != nil {
+        inval.Close()
+        return nil, nil, err
+    }
+    s := &cacheSession{conn: conn, inval: inval, done: make(chan bool)}
+    _, err = self.client.rawSend(conn, commandBytes("CLIENT", "TRACKING", "ON", "REDIRECT", strconv.Itoa64(id)), readResponse)
+    if err != nil {
+        s.close()
+        return nil, nil, err
+    }
+    return s, reader, nil
+}
+
+func (self *Cache) store(cmd string, key string, value interface{}) {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+
+    if self.stale || self.closed {
+        return
+    }
+    if e, ok := self.entries[key]; ok {
+        self.lru.Remove(e)
+    }
+    entry := &cacheEntry{key, cmd, value, 0}
+    if self.maxTTL > 0 {
+        entry.expires = time.Nanoseconds() + self.maxTTL
+    }
+    self.entries[key] = self.lru.PushFront(entry)
+
+    for self.maxEntries > 0 && self.lru.Len() > self.maxEntries {
+        self.evict(self.lru.Back())
+    }
+}
+
+// with the lock held
+func (self *Cache) evict(e *list.Element) {
+    self.lru.Remove(e)
+    self.entries[e.Value.(*cacheEntry).key] = nil, false
+}
+
+// with the lock held
+func (self *Cache) invalidate(key string) {
+    if e, ok := self.entries[key]; ok {
+        self.evict(e)
+    }
+    if key == self.reading {
+        self.stale = true
+    }
+}
+
+// flushes the cache and closes the session, if it's still the current one
+func (self *Cache) drop(s *cacheSession) {
+    self.lock.Lock()
+    if self.session == s {
+        self.session = nil
+        self.flush()
+    }
+    self.lock.Unlock()
+
+    s.close()
+}
+
+// reads invalidations until the session fails
+func (self *Cache) run(s *cacheSession, reader *bufio.Reader) {
+    for {
+        s.inval.SetReadTimeout(2 * self.interval)
+        res, err := readResponse(reader)
+        if err != nil {
+            self.drop(s)
+            return
+        }
+
+        // [message, channel, keys], where keys is nil when the database
+        // was flushed
+        switch data := res.(type) {
+        case []interface{}:
+            if len(data) != 3 {
+                continue
+            }
+            keys, ok := data[2].([][]byte)
+            if !ok {
+                continue
+            }
+            self.lock.Lock()
+            for _, key := range keys {
+                self.invalidate(string(key))
+            }
+            self.lock.Unlock()
+        case [][]byte:
+            if len(data) == 3 && string(data[0]) == "message" && data[2] == nil {
+                self.Flush()
+            }
+        }
+    }
+}
+
+// pings the invalidation connection, so that run notices when it dies
+// silently, and the tracked connection, which redis stops tracking keys
+// for once it's lost, even while every read is a hit
+func (self *Cache) keepalive(s *cacheSession) {
+    ticker := time.NewTicker(self.interval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-s.done:
+            return
+        case <-ticker.C:
+        }
+
+        // a failed write shows up as a failed read as well
+        writeRequest(s.inval, "PING")
+
+        if err := self.ping(s); err != nil {
+            self.drop(s)
+            return
+        }
+    }
+}
+
+// pings the tracked connection between reads, unless the session has
+// been closed meanwhile
+func (self *Cache) ping(s *cacheSession) os.Error {
+    self.readLock.Lock()
+    defer self.readLock.Unlock()
+
+    select {
+    case <-s.done:
+        return nil
+    default:
+    }
+    s.conn.SetReadTimeout(2 * self.interval)
+    defer s.conn.SetReadTimeout(0)
+    _, err := self.client.rawSend(s.conn, commandBytes("PING"), readResponse)
+    return err
+}
@@ -0,0 +1,488 @@
+package redis
+
+import (
+    "bufio"
+    "net"
+    "os"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// The number of hash slots keys are divided into.
+const clusterSlots = 16384
+
+// How many MOVED and ASK redirects a command follows before failing.
+const clusterMaxRedirects = 5
+
+// How long to wait before retrying a command that got TRYAGAIN, while the
+// slot's keys are split between nodes during resharding.
+const clusterTryAgainDelay = 10e6
+
+// Returns the cluster hash slot of key. If the key holds a non-empty hash
+// tag, like {user1000} in {user1000}.following, only the tag is hashed,
+// so that related keys can share a slot.
+func KeySlot(key string) int {
+    if i := strings.Index(key, "{"); i >= 0 {
+        if j := strings.Index(key[i+1:], "}"); j > 0 {
+            key = key[i+1 : i+1+j]
+        }
+    }
+    return int(crc16([]byte(key)) % clusterSlots)
+}
+
+// CRC16-CCITT (XMODEM), as redis cluster uses
+func crc16(data []byte) uint16 {
+    var crc uint16
+    for _, b := range data {
+        crc ^= uint16(b) << 8
+        for i := 0; i < 8; i++ {
+            if crc&0x8000 != 0 {
+                crc = crc<<1 ^ 0x1021
+            } else {
+                crc <<= 1
+            }
+        }
+    }
+    return crc
+}
+
+// A client for redis cluster, sending each command to the master that
+// serves the slot of its keys, through a pool of connections per node.
+//
+// The slot map is loaded from the nodes, and updated when a node answers
+// with a MOVED redirect. ASK redirects, sent while a slot migrates, are
+// followed without changing the map. Multi-key commands are split into
+// one command per slot, so they aren't atomic across slots.
+type ClusterClient struct {
+    password string
+
+    // guards the fields below
+    lock       sync.Mutex
+    seeds      []string
+    slots      []string
+    nodes      map[string]*client
+    refreshing bool
+}
+
+// Loads the slot map from the first of the addresses that answers.
+func NewClusterClient(addrs []string, password string) (*ClusterClient, os.Error) {
+    c := new(ClusterClient)
+    c.password = password
+    c.seeds = append([]string(nil), addrs...)
+    c.slots = make([]string, clusterSlots)
+    c.nodes = make(map[string]*client)
+
+    err := c.Refresh()
+    if err != nil {
+        return nil, err
+    }
+    return c, nil
+}
+
+// Reloads the slot map, asking the known nodes in turn.
+func (self *ClusterClient) Refresh() os.Error {
+    self.lock.Lock()
+    addrs := append([]string(nil), self.seeds...)
+    for addr := range self.nodes {
+        addrs = append(addrs, addr)
+    }
+    self.lock.Unlock()
+
+    var err os.Error = RedisError("no cluster nodes")
+    for _, addr := range addrs {
+        var slots []string
+        slots, err = self.loadSlots(addr)
+        if err != nil {
+            continue
+        }
+        self.lock.Lock()
+        self.slots = slots
+        self.lock.Unlock()
+        return nil
+    }
+    return err
+}
+
+// Returns the client for the node at addr.
+func (self *ClusterClient) Node(addr string) *client {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+
+    node, ok := self.nodes[addr]
+    if !ok {
+        node = NewClient(addr, 0, self.password)
+        self.nodes[addr] = node
+    }
+    return node
+}
+
+// Returns the address of the master serving slot, or "" if the slot map
+// doesn't have it.
+func (self *ClusterClient) SlotAddr(slot int) string {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+
+    return self.slots[slot]
+}
+
+// Sends a command to the master serving the slot of the first argument,
+// which must be a key, and returns the raw reply, like client.Do.
+func (self *ClusterClient) Do(cmd string, args ...interface{}) (interface{}, os.Error) {
+    sargs, err := interfaceArgs(nil, args)
+    if err != nil {
+        return nil, err
+    }
+    if len(sargs) == 0 {
+        return nil, RedisError(cmd + " needs a key to be routed")
+    }
+    return self.send(KeySlot(sargs[0]), cmd, sargs...)
+}
+
+func (self *ClusterClient) Get(key string) ([]byte, os.Error) {
+    res, err := self.send(KeySlot(key), "GET", key)
+    if err != nil {
+        return nil, err
+    }
+
+    return bulkReply("GET", res)
+}
+
+func (self *ClusterClient) Set(key string, val []byte) os.Error {
+    _, err := self.send(KeySlot(key), "SET", key, string(val))
+    return err
+}
+
+// Like client.Mget, sending an MGET for each slot.
+func (self *ClusterClient) Mget(keys ...string) ([][]byte, os.Error) {
+    vals := make([][]byte, len(keys))
+    for slot, indexes := range slotGroups(keys) {
+        args := make([]string, len(indexes))
+        for i, j := range indexes {
+            args[i] = keys[j]
+        }
+        res, err := self.send(slot, "MGET", args...)
+        if err != nil {
+            return nil, err
+        }
+        data, err := multiBulkReply("MGET", res)
+        if err != nil {
+            return nil, err
+        }
+        if len(data) != len(indexes) {
+            return nil, &UnexpectedReplyError{"MGET", res}
+        }
+        for i, j := range indexes {
+            vals[j] = data[i]
+        }
+    }
+    return vals, nil
+}
+
+// Like client.Mset, sending an MSET for each slot.
+func (self *ClusterClient) Mset(mapping map[string][]byte) os.Error {
+    groups := make(map[int][]string)
+    for k, v := range mapping {
+        slot := KeySlot(k)
+        groups[slot] = append(groups[slot], k, string(v))
+    }
+    for slot, args := range groups {
+        _, err := self.send(slot, "MSET", args...)
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// Like client.Del, sending a DEL for each slot.
+func (self *ClusterClient) Del(keys ...string) (int, os.Error) {
+    return self.count("DEL", keys)
+}
+
+// Like client.Exists, sending an EXISTS for each slot.
+func (self *ClusterClient) Exists(keys ...string) (int, os.Error) {
+    return self.count("EXISTS", keys)
+}
+
+// sends cmd for the keys of each slot, adding up the replies
+func (self *ClusterClient) count(cmd string, keys []string) (int, os.Error) {
+    total := 0
+    for slot, indexes := range slotGroups(keys) {
+        args := make([]string, len(indexes))
+        for i, j := range indexes {
+            args[i] = keys[j]
+        }
+        res, err := self.send(slot, cmd, args...)
+        if err != nil {
+            return -1, err
+        }
+        n, err := intReply(cmd, res)
+        if err != nil {
+            return -1, err
+        }
+        total += int(n)
+    }
+    return total, nil
+}
+
+// returns the indexes of the keys in each slot
+func slotGroups(keys []string) map[int][]int {
+    groups := make(map[int][]int)
+    for i, key := range keys {
+        slot := KeySlot(key)
+        groups[slot] = append(groups[slot], i)
+    }
+    return groups
+}
+
+// sends a command to the master serving slot, following redirects
+func (self *ClusterClient) send(slot int, cmd string, args ...string) (interface{}, os.Error) {
+    addr := self.SlotAddr(slot)
+    asking := false
+    var err os.Error
+    for i := 0; i <= clusterMaxRedirects; i++ {
+        if addr == "" {
+            if err = self.Refresh(); err != nil {
+                return nil, err
+            }
+            if addr = self.SlotAddr(slot); addr == "" {
+                return nil, RedisError("no node serves slot " + strconv.Itoa(slot))
+            }
+        }
+
+        var res interface{}
+        var written bool
+        res, written, err = self.Node(addr).sendRouted(asking, cmd, args...)
+        asking = false
+        if err == nil {
+            return res, nil
+        }
+
+        rerr, ok := err.(RedisError)
+        if !ok {
+            // a command that was written may have been applied, so only
+            // one that wasn't is safe to send again
+            if written {
+                return nil, err
+            }
+            // the node may have failed over
+            self.Refresh()
+            addr = self.SlotAddr(slot)
+            continue
+        }
+        if strings.HasPrefix(string(rerr), "TRYAGAIN") {
+            time.Sleep(clusterTryAgainDelay)
+            continue
+        }
+        // MOVED <slot> <addr> or ASK <slot> <addr>
+        fields := strings.Fields(string(rerr))
+        if len(fields) != 3 {
+            return nil, err
+        }
+        switch fields[0] {
+        case "MOVED":
+            addr = fields[2]
+            self.moved(slot, addr)
+        case "ASK":
+            addr = fields[2]
+            asking = true
+        default:
+            return nil, err
+        }
+    }
+    return nil, err
+}
+
+// records that slot moved to addr, and reloads the rest of the slot map
+// in the background, since more slots usually moved along with it
+func (self *ClusterClient) moved(slot int, addr string) {
+    self.lock.Lock()
+    self.slots[slot] = addr
+    refresh := !self.refreshing
+    self.refreshing = true
+    self.lock.Unlock()
+
+    if refresh {
+        go func() {
+            self.Refresh()
+            self.lock.Lock()
+            self.refreshing = false
+            self.lock.Unlock()
+        }()
+    }
+}
+
+// sends a command, after ASKING on the same connection if asking is set,
+// as a slot being imported is only served after ASKING. written reports
+// whether the command was written, since a command that was may have been
+// applied even though reading the reply failed.
+func (self *client) sendRouted(asking bool, cmd string, args ...string) (data interface{}, written bool, err os.Error) {
+    c, err := self.popCon()
+    if err != nil {
+        return nil, false, err
+    }
+
+    if asking {
+        _, err = self.rawSend(c, commandBytes("ASKING"), readResponse)
+    }
+    if err == nil {
+        _, err = c.Write(commandBytes(cmd, args...))
+        written = err == nil
+    }
+    if err == nil {
+        data, err = readResponse(bufio.NewReader(c))
+    }
+
+    if _, ok := err.(RedisError); err != nil && !ok {
+        // the connection is broken, or out of step with its replies
+        c.Close()
+    } else {
+        self.pushCon(c)
+    }
+    return data, written, err
+}
+
+// loads the slot map from a node, with CLUSTER SHARDS or, before redis
+// 7.0, CLUSTER SLOTS
+func (self *ClusterClient) loadSlots(addr string) ([]string, os.Error) {
+    node := self.Node(addr)
+    res, err := node.sendCommand("CLUSTER", "SHARDS")
+    if _, ok := err.(RedisError); ok {
+        res, err = node.sendCommand("CLUSTER", "SLOTS")
+        if err != nil {
+            return nil, err
+        }
+        return parseClusterSlots(res)
+    }
+    if err != nil {
+        return nil, err
+    }
+    return parseClusterShards(res)
+}
+
+// fills slots from start to end with addr
+func assignSlots(slots []string, start int64, end int64, addr string) os.Error {
+    if start < 0 || end >= clusterSlots || start > end {
+        return RedisError("invalid slot range " + strconv.Itoa64(start) + "-" + strconv.Itoa64(end))
+    }
+    for i := start; i <= end; i++ {
+        slots[i] = addr
+    }
+    return nil
+}
+
+// parses CLUSTER SLOTS, [[start, end, [ip, port, id, ...], replicas...], ...]
+func parseClusterSlots(reply interface{}) ([]string, os.Error) {
+    ranges, err := valuesReply("CLUSTER SLOTS", reply)
+    if err != nil {
+        return nil, err
+    }
+    slots := make([]string, clusterSlots)
+    for _, r := range ranges {
+        fields, err := valuesReply("CLUSTER SLOTS", r)
+        if err != nil {
+            return nil, err
+        }
+        if len(fields) < 3 {
+            return nil, &UnexpectedReplyError{"CLUSTER SLOTS", reply}
+        }
+        start, err := intValue("CLUSTER SLOTS", fields[0])
+        if err != nil {
+            return nil, err
+        }
+        end, err := intValue("CLUSTER SLOTS", fields[1])
+        if err != nil {
+            return nil, err
+        }
+        master, err := valuesReply("CLUSTER SLOTS", fields[2])
+        if err != nil {
+            return nil, err
+        }
+        if len(master) < 2 {
+            return nil, &UnexpectedReplyError{"CLUSTER SLOTS", reply}
+        }
+        ip, err := bulkReply("CLUSTER SLOTS", master[0])
+        if err != nil {
+            return nil, err
+        }
+        port, err := intValue("CLUSTER SLOTS", master[1])
+        if err != nil {
+            return nil, err
+        }
+        err = assignSlots(slots, start, end, net.JoinHostPort(string(ip), strconv.Itoa64(port)))
+        if err != nil {
+            return nil, err
+        }
+    }
+    return slots, nil
+}
+
+// parses CLUSTER SHARDS, a list of shards that each hold the fields
+// slots, [start, end, ...], and nodes, a list of nodes that each hold
+// fields like ip, port and role
+func parseClusterShards(reply interface{}) ([]string, os.Error) {
+    shards, err := valuesReply("CLUSTER SHARDS", reply)
+    if err != nil {
+        return nil, err
+    }
+    slots := make([]string, clusterSlots)
+    for _, s := range shards {
+        shard, err := valuesReply("CLUSTER SHARDS", s)
+        if err != nil {
+            return nil, err
+        }
+        var ranges, nodes []interface{}
+        for i := 0; i+1 < len(shard); i += 2 {
+            name, _ := shard[i].([]byte)
+            switch string(name) {
+            case "slots":
+                ranges, err = valuesReply("CLUSTER SHARDS", shard[i+1])
+            case "nodes":
+                nodes, err = valuesReply("CLUSTER SHARDS", shard[i+1])
+            }
+            if err != nil {
+                return nil, err
+            }
+        }
+
+        addr := ""
+        for _, n := range nodes {
+            fields, err := multiBulkReply("CLUSTER SHARDS", n)
+            if err != nil {
+                return nil, err
+            }
+            node := make(map[string]string)
+            for i := 0; i+1 < len(fields); i += 2 {
+                node[string(fields[i])] = string(fields[i+1])
+            }
+            if node["role"] != "master" {
+                continue
+            }
+            host := node["endpoint"]
+            if host == "" || host == "?" {
+                host = node["ip"]
+            }
+            addr = net.JoinHostPort(host, node["port"])
+        }
+        if addr == "" {
+            continue
+        }
+
+        for i := 0; i+1 < len(ranges); i += 2 {
+            start, err := intValue("CLUSTER SHARDS", ranges[i])
+            if err != nil {
+                return nil, err
+            }
+            end, err := intValue("CLUSTER SHARDS", ranges[i+1])
+            if err != nil {
+                return nil, err
+            }
+            if err = assignSlots(slots, start, end, addr); err != nil {
+                return nil, err
+            }
+        }
+    }
+    return slots, nil
+}
@@ -0,0 +1,302 @@
+package redis
+
+import (
+    "net"
+    "os"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Handles an entry read by a StreamConsumer. Returning nil acknowledges
+// the entry; otherwise it stays pending and is handled again once it's
+// reclaimed.
+type StreamHandler func(entry *StreamEntry) os.Error
+
+// Reads a stream as a member of a consumer group, passing the entries to
+// a handler and acknowledging those it handles. Entries left pending for
+// longer than MinIdleMs, because a handler failed or a consumer died, are
+// claimed and handled again, so handlers must tolerate repeats.
+//
+// Set the options before calling Start.
+type StreamConsumer struct {
+    Stream   string
+    Group    string
+    Consumer string
+    Handler  StreamHandler
+
+    // The number of entries handled at once. Defaults to 1.
+    Concurrency int
+
+    // How long each read waits for new entries, in milliseconds. Stop may
+    // wait this long. Defaults to 1000.
+    BlockMs int64
+
+    // How long entries stay pending before they're reclaimed, in
+    // milliseconds. This should be longer than the handler takes. 0
+    // disables reclaiming.
+    MinIdleMs int64
+
+    // Called with handler errors and errors from reads and acks, which
+    // are retried. May be nil.
+    OnError func(os.Error)
+
+    client *client
+    conn   net.Conn
+    slots  chan bool
+    stop   chan bool
+    done   chan bool
+
+    // guards stop and closed, so Stop is safe before Start and twice
+    lock   sync.Mutex
+    closed bool
+}
+
+func NewStreamConsumer(c *client, stream string, group string, consumer string, handler StreamHandler) *StreamConsumer {
+    s := new(StreamConsumer)
+    s.Stream = stream
+    s.Group = group
+    s.Consumer = consumer
+    s.Handler = handler
+    s.Concurrency = 1
+    s.BlockMs = 1000
+    s.client = c
+    return s
+}
+
+// Creates the group and the stream if they don't exist, then consumes
+// the stream in the background, on a connection of its own. A group
+// created here only reads entries added after it.
+func (self *StreamConsumer) Start() os.Error {
+    err := self.client.XgroupCreate(self.Stream, self.Group, "$", true)
+    if rerr, ok := err.(RedisError); ok && strings.HasPrefix(string(rerr), "BUSYGROUP") {
+        err = nil
+    }
+    if err != nil {
+        return err
+    }
+
+    self.conn, err = self.client.openConnection()
+    if err != nil {
+        return err
+    }
+
+    if self.Concurrency < 1 {
+        self.Concurrency = 1
+    }
+    if self.BlockMs <= 0 {
+        self.BlockMs = 1000
+    }
+    self.slots = make(chan bool, self.Concurrency)
+    for i := 0; i < self.Concurrency; i++ {
+        self.slots <- true
+    }
+    self.lock.Lock()
+    self.stop = make(chan bool)
+    self.done = make(chan bool)
+    self.closed = false
+    self.lock.Unlock()
+
+    go self.run()
+    return nil
+}
+
+// Stops reading and waits for the entries already read to be handled.
+// Does nothing if the consumer isn't running.
+func (self *StreamConsumer) Stop() {
+    self.lock.Lock()
+    if self.stop == nil || self.closed {
+        self.lock.Unlock()
+        return
+    }
+    self.closed = true
+    close(self.stop)
+    self.lock.Unlock()
+
+    <-self.done
+}
+
+func (self *StreamConsumer) stopped() bool {
+    select {
+    case <-self.stop:
+        return true
+    default:
+    }
+    return false
+}
+
+func (self *StreamConsumer) report(err os.Error) {
+    if self.OnError != nil {
+        self.OnError(err)
+    }
+}
+
+func (self *StreamConsumer) run() {
+    // entries delivered to this consumer before it was restarted come
+    // first, then new ones
+    id := "0"
+    lastReclaim := time.Nanoseconds()
+
+    for !self.stopped() {
+        if self.MinIdleMs > 0 && time.Nanoseconds()-lastReclaim >= self.MinIdleMs*1e6 {
+            self.reclaim()
+            lastReclaim = time.Nanoseconds()
+        }
+
+        entries, err := self.read(id)
+        if err != nil {
+            self.report(err)
+            self.reconnect(err)
+            continue
+        }
+        if id != ">" {
+            if len(entries) == 0 {
+                id = ">"
+            } else {
+                id = entries[len(entries)-1].ID
+            }
+        }
+        for i := range entries {
+            self.dispatch(&entries[i])
+        }
+    }
+
+    // wait for the running handlers
+    for i := 0; i < cap(self.slots); i++ {
+        <-self.slots
+    }
+    self.conn.Close()
+    close(self.done)
+}
+
+func (self *StreamConsumer) read(id string) ([]StreamEntry, os.Error) {
+    blockMs := int64(-1)
+    if id == ">" {
+        blockMs = self.BlockMs
+    }
+    args := xreadgroupArgs(self.Group, self.Consumer, map[string]string{self.Stream: id}, cap(self.slots), blockMs, false)
+    res, err := self.client.rawSend(self.conn, commandBytes("XREADGROUP", args...), readResponse)
+    if err != nil {
+        return nil, err
+    }
+
+    streams, err := streamsReply("XREADGROUP", res)
+    return streams[self.Stream], err
+}
+
+// waits a moment after an error, then replaces the connection unless
+// redis itself returned the error
+func (self *StreamConsumer) reconnect(err os.Error) {
+    select {
+    case <-self.stop:
+        return
+    case <-time.After(1e9):
+    }
+
+    if _, ok := err.(RedisError); ok {
+        return
+    }
+    conn, err := self.client.openConnection()
+    if err != nil {
+        self.report(err)
+        return
+    }
+    self.conn.Close()
+    self.conn = conn
+}
+
+// runs the handler once a slot is free
+func (self *StreamConsumer) dispatch(entry *StreamEntry) {
+    if entry.Fields == nil {
+        // deleted from the stream, there's nothing to handle
+        self.ack(entry.ID)
+        return
+    }
+
+    <-self.slots
+    go func() {
+        defer func() { self.slots <- true }()
+
+        err := self.Handler(entry)
+        if err != nil {
+            self.report(err)
+            return
+        }
+        self.ack(entry.ID)
+    }()
+}
+
+func (self *StreamConsumer) ack(id string) {
+    _, err := self.client.Xack(self.Stream, self.Group, id)
+    if err != nil {
+        self.report(err)
+    }
+}
+
+// claims and handles the group's stale pending entries
+func (self *StreamConsumer) reclaim() {
+    start := "0-0"
+    for !self.stopped() {
+        next, entries, _, err := self.client.Xautoclaim(self.Stream, self.Group, self.Consumer, self.MinIdleMs, start, cap(self.slots))
+        if rerr, ok := err.(RedisError); ok && strings.HasPrefix(string(rerr), "unknown command") {
+            // redis before 6.2
+            self.reclaimPending()
+            return
+        }
+        if err != nil {
+            self.report(err)
+            return
+        }
+        for i := range entries {
+            self.dispatch(&entries[i])
+        }
+        if next == "0-0" {
+            return
+        }
+        start = next
+    }
+}
+
+// like reclaim, using XPENDING and XCLAIM
+func (self *StreamConsumer) reclaimPending() {
+    start := "-"
+    for !self.stopped() {
+        pending, err := self.client.Xpending(self.Stream, self.Group, 0, start, "+", cap(self.slots), "")
+        if err != nil {
+            self.report(err)
+            return
+        }
+        var ids []string
+        for _, p := range pending {
+            if p.IdleMs >= self.MinIdleMs {
+                ids = append(ids, p.ID)
+            }
+        }
+        if len(ids) > 0 {
+            entries, err := self.client.Xclaim(self.Stream, self.Group, self.Consumer, self.MinIdleMs, ids...)
+            if err != nil {
+                self.report(err)
+                return
+            }
+            for i := range entries {
+                self.dispatch(&entries[i])
+            }
+        }
+        if len(pending) < cap(self.slots) {
+            return
+        }
+        start = nextStreamID(pending[len(pending)-1].ID)
+    }
+}
+
+// returns the smallest ID after id, since older servers don't support
+// exclusive ranges
+func nextStreamID(id string) string {
+    i := strings.Index(id, "-")
+    seq, err := strconv.Atoui64(id[i+1:])
+    if i < 0 || err != nil {
+        return id
+    }
+    return id[:i+1] + strconv.Uitoa64(seq+1)
+}
@@ -0,0 +1,447 @@
+package redis
+
+import (
+    "bufio"
+    "bytes"
+    "gob"
+    "json"
+    "net"
+    "os"
+    "reflect"
+    "sync"
+    "time"
+)
+
+// How often PubSub pings the server. A connection that stays silent for
+// twice as long is considered lost.
+var pubsubKeepalive int64 = 30e9
+
+// How many messages PubSub buffers for the reader of Messages.
+const pubsubBuffer = 64
+
+// Returned by PubSub methods once Close has been called.
+var ErrClosed = RedisError("pubsub closed")
+
+// A connection subscribed to channels and patterns, delivering their
+// messages on the channel returned by Messages. Read it promptly, since
+// confirmations of Subscribe and the other methods queue up behind the
+// messages.
+//
+// If the connection is lost, PubSub reconnects and subscribes again to
+// every channel and pattern it was subscribed to. Messages published
+// meanwhile are lost, and calls waiting for confirmation fail.
+type PubSub struct {
+    client   *client
+    interval int64
+    messages chan Message
+    closing  chan bool
+
+    // guards the fields below, and writes to conn
+    lock     sync.Mutex
+    conn     net.Conn
+    channels map[string]bool
+    patterns map[string]bool
+    shards   map[string]bool
+    pending  []*pubsubRequest
+    closed   bool
+}
+
+// a command waiting for one confirmation per channel or pattern
+type pubsubRequest struct {
+    kind  string
+    count int
+    // nil for resubscriptions, which nobody waits for
+    done chan os.Error
+}
+
+// Opens a connection for subscriptions.
+func NewPubSub(c *client) (*PubSub, os.Error) {
+    conn, err := c.openConnection()
+    if err != nil {
+        return nil, err
+    }
+
+    p := new(PubSub)
+    p.client = c
+    p.interval = pubsubKeepalive
+    p.messages = make(chan Message, pubsubBuffer)
+    p.closing = make(chan bool)
+    p.conn = conn
+    p.channels = make(map[string]bool)
+    p.patterns = make(map[string]bool)
+    p.shards = make(map[string]bool)
+
+    go p.run()
+    go p.keepalive()
+    return p, nil
+}
+
+// Returns the channel messages are delivered on. It's closed by Close.
+func (p *PubSub) Messages() <-chan Message {
+    return p.messages
+}
+
+// Subscribes to the channels, returning once redis confirms.
+func (p *PubSub) Subscribe(channels ...string) os.Error {
+    return p.request("SUBSCRIBE", "subscribe", channels)
+}
+
+// Unsubscribes from the channels, returning once redis confirms.
+func (p *PubSub) Unsubscribe(channels ...string) os.Error {
+    return p.request("UNSUBSCRIBE", "unsubscribe", channels)
+}
+
+// Subscribes to the channels matching the glob patterns, returning once
+// redis confirms.
+func (p *PubSub) PSubscribe(patterns ...string) os.Error {
+    return p.request("PSUBSCRIBE", "psubscribe", patterns)
+}
+
+// Unsubscribes from the patterns, returning once redis confirms.
+func (p *PubSub) PUnsubscribe(patterns ...string) os.Error {
+    return p.request("PUNSUBSCRIBE", "punsubscribe", patterns)
+}
+
+// Subscribes to the shard channels, returning once redis confirms. Their
+// messages are delivered along with the others.
+func (p *PubSub) SSubscribe(channels ...string) os.Error {
+    return p.request("SSUBSCRIBE", "ssubscribe", channels)
+}
+
+// Unsubscribes from the shard channels, returning once redis confirms.
+func (p *PubSub) SUnsubscribe(channels ...string) os.Error {
+    return p.request("SUNSUBSCRIBE", "sunsubscribe", channels)
+}
+
+// Closes the connection and the Messages channel. Calls waiting for
+// confirmation fail.
+func (p *PubSub) Close() os.Error {
+    p.lock.Lock()
+    defer p.lock.Unlock()
+
+    if p.closed {
+        return nil
+    }
+    p.closed = true
+    close(p.closing)
+    return p.conn.Close()
+}
+
+func (p *PubSub) request(cmd string, kind string, names []string) os.Error {
+    if len(names) == 0 {
+        return RedisError(cmd + " needs at least one channel")
+    }
+    done := make(chan os.Error, 1)
+
+    p.lock.Lock()
+    if p.closed {
+        p.lock.Unlock()
+        return ErrClosed
+    }
+    // redis confirms in order, so queue the request as it's sent
+    err := writeRequest(p.conn, cmd, names...)
+    if err == nil {
+        p.pending = append(p.pending, &pubsubRequest{kind, len(names), done})
+    }
+    p.lock.Unlock()
+
+    if err != nil {
+        return err
+    }
+    return <-done
+}
+
+// reads from the connection until Close, reconnecting when it fails
+func (p *PubSub) run() {
+    defer close(p.messages)
+
+    // only run replaces conn, so it can read it without the lock
+    reader := bufio.NewReader(p.conn)
+    for {
+        p.conn.SetReadTimeout(2 * p.interval)
+        res, err := readResponse(reader)
+        if rerr, ok := err.(RedisError); ok {
+            // the connection is fine, redis refused a command
+            p.refuse(rerr)
+            continue
+        }
+        if err != nil {
+            if !p.reconnect(err) {
+                return
+            }
+            reader = bufio.NewReader(p.conn)
+            continue
+        }
+
+        // subscribed connections reply with multi-bulks, e.g.
+        // [message, channel, data] or [subscribe, channel, count]
+        data, ok := res.([][]byte)
+        if !ok || len(data) < 2 {
+            continue
+        }
+        var msg Message
+        switch kind := string(data[0]); kind {
+        case "message", "smessage":
+            if len(data) != 3 {
+                continue
+            }
+            msg = Message{string(data[1]), string(data[1]), data[2]}
+        case "pmessage":
+            if len(data) != 4 {
+                continue
+            }
+            msg = Message{string(data[1]), string(data[2]), data[3]}
+        case "subscribe", "unsubscribe", "psubscribe", "punsubscribe", "ssubscribe", "sunsubscribe":
+            p.confirm(kind, string(data[1]))
+            continue
+        default:
+            // pong
+            continue
+        }
+
+        select {
+        case p.messages <- msg:
+        case <-p.closing:
+        }
+    }
+}
+
+func (p *PubSub) confirm(kind string, name string) {
+    p.lock.Lock()
+    defer p.lock.Unlock()
+
+    switch kind {
+    case "subscribe":
+        p.channels[name] = true
+    case "unsubscribe":
+        p.channels[name] = false, false
+    case "psubscribe":
+        p.patterns[name] = true
+    case "punsubscribe":
+        p.patterns[name] = false, false
+    case "ssubscribe":
+        p.shards[name] = true
+    case "sunsubscribe":
+        p.shards[name] = false, false
+    }
+
+    if len(p.pending) == 0 || p.pending[0].kind != kind {
+        return
+    }
+    req := p.pending[0]
+    req.count--
+    if req.count == 0 {
+        p.pending = p.pending[1:]
+        if req.done != nil {
+            req.done <- nil
+        }
+    }
+}
+
+// fails the oldest request waiting for confirmation, which redis
+// answered with an error instead
+func (p *PubSub) refuse(err RedisError) {
+    p.lock.Lock()
+    defer p.lock.Unlock()
+
+    if len(p.pending) == 0 {
+        return
+    }
+    req := p.pending[0]
+    p.pending = p.pending[1:]
+    if req.done != nil {
+        req.done <- err
+    }
+}
+
+// replaces a failed connection, retrying with growing delays. Returns
+// false once closed.
+func (p *PubSub) reconnect(err os.Error) bool {
+    p.lock.Lock()
+    for _, req := range p.pending {
+        if req.done != nil {
+            req.done <- err
+        }
+    }
+    p.pending = nil
+    p.conn.Close()
+    closed := p.closed
+    p.lock.Unlock()
+
+    for delay := int64(1e8); !closed; {
+        select {
+        case <-p.closing:
+            return false
+        case <-time.After(delay):
+        }
+        if delay < 10e9 {
+            delay *= 2
+        }
+
+        conn, err := p.client.openConnection()
+        if err != nil {
+            continue
+        }
+        p.lock.Lock()
+        closed = p.closed
+        if !closed {
+            p.conn = conn
+            err = p.resubscribe()
+        }
+        p.lock.Unlock()
+        if closed || err != nil {
+            conn.Close()
+            continue
+        }
+        return true
+    }
+    return false
+}
+
+// sends the subscriptions again, with the lock held
+func (p *PubSub) resubscribe() os.Error {
+    err := p.resend("SUBSCRIBE", "subscribe", p.channels)
+    if err == nil {
+        err = p.resend("PSUBSCRIBE", "psubscribe", p.patterns)
+    }
+    if err == nil {
+        err = p.resend("SSUBSCRIBE", "ssubscribe", p.shards)
+    }
+    return err
+}
+
+func (p *PubSub) resend(cmd string, kind string, subscribed map[string]bool) os.Error {
+    if len(subscribed) == 0 {
+        return nil
+    }
+    var names []string
+    for name := range subscribed {
+        names = append(names, name)
+    }
+    err := writeRequest(p.conn, cmd, names...)
+    if err != nil {
+        return err
+    }
+    p.pending = append(p.pending, &pubsubRequest{kind, len(names), nil})
+    return nil
+}
+
+// pings the server, so that run notices connections that die silently
+func (p *PubSub) keepalive() {
+    ticker := time.NewTicker(p.interval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-p.closing:
+            return
+        case <-ticker.C:
+        }
+
+        // a failed write shows up as a failed read as well
+        p.lock.Lock()
+        writeRequest(p.conn, "PING")
+        p.lock.Unlock()
+    }
+}
+
+// Encodes and decodes message payloads, for PublishValue and
+// ReceiveValues. A nil Codec means JSONCodec.
+type Codec interface {
+    Encode(v interface{}) ([]byte, os.Error)
+    Decode(data []byte, v interface{}) os.Error
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Encode(v interface{}) ([]byte, os.Error) {
+    return json.Marshal(v)
+}
+
+func (jsonCodec) Decode(data []byte, v interface{}) os.Error {
+    return json.Unmarshal(data, v)
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Encode(v interface{}) ([]byte, os.Error) {
+    var buf bytes.Buffer
+    err := gob.NewEncoder(&buf).Encode(v)
+    return buf.Bytes(), err
+}
+
+func (gobCodec) Decode(data []byte, v interface{}) os.Error {
+    return gob.NewDecoder(bytes.NewBuffer(data)).Decode(v)
+}
+
+var (
+    JSONCodec Codec = jsonCodec{}
+    // Each message carries its own type information, so gob payloads are
+    // larger than a stream of them would be.
+    GobCodec Codec = gobCodec{}
+)
+
+// returned when there's no example value to decode into the type of
+var errNilExample = RedisError("decoding values needs a non-nil example")
+
+func codecOrDefault(codec Codec) Codec {
+    if codec == nil {
+        return JSONCodec
+    }
+    return codec
+}
+
+// Publishes v encoded with codec, returning the number of subscribers
+// that received it.
+func (self *client) PublishValue(codec Codec, channel string, v interface{}) (int, os.Error) {
+    data, err := codecOrDefault(codec).Encode(v)
+    if err != nil {
+        return -1, err
+    }
+    return self.Publish(channel, data)
+}
+
+// Reads messages until the Messages channel is closed, decoding each
+// payload with codec into a new value of the same type as example. handler
+// is called with the channel and a pointer to the value, e.g. a *Event for
+// an example Event{}. Payloads that fail to decode are passed to onError
+// instead, along with the error, or skipped if onError is nil. Fails at
+// once if example is nil.
+func (p *PubSub) ReceiveValues(codec Codec, example interface{}, handler func(channel string, v interface{}), onError func(msg Message, err os.Error)) os.Error {
+    if example == nil {
+        return errNilExample
+    }
+    codec = codecOrDefault(codec)
+    typ := reflect.TypeOf(example)
+    for msg := range p.messages {
+        v := reflect.New(typ).Interface()
+        err := codec.Decode(msg.Message, v)
+        if err != nil {
+            if onError != nil {
+                onError(msg, err)
+            }
+            continue
+        }
+        handler(msg.Channel, v)
+    }
+    return nil
+}
+
+// Subscribes to the channels and calls ReceiveValues in the background.
+// Close the returned PubSub to stop.
+func (self *client) SubscribeValues(codec Codec, example interface{}, handler func(channel string, v interface{}), onError func(msg Message, err os.Error), channels ...string) (*PubSub, os.Error) {
+    if example == nil {
+        return nil, errNilExample
+    }
+    p, err := NewPubSub(self)
+    if err != nil {
+        return nil, err
+    }
+    err = p.Subscribe(channels...)
+    if err != nil {
+        p.Close()
+        return nil, err
+    }
+    go p.ReceiveValues(codec, example, handler, onError)
+    return p, nil
+}
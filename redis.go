@@ -4,14 +4,18 @@ import (
     "bufio"
     "bytes"
     "container/vector"
+    "crypto/sha1"
+    "encoding/hex"
     "fmt"
     "io"
-    "io/ioutil"
+    "math"
     "net"
     "os"
     "reflect"
     "strconv"
     "strings"
+    "sync"
+    "time"
 )
 
 var defaultAddr = "127.0.0.1:7379"
@@ -24,14 +28,53 @@ type client struct {
     addr     string
     db       int
     password string
+    name     string
     pool     chan net.Conn
+
+    // guards addr, which a Sentinel changes on failover, name and
+    // lastSend
+    lock sync.Mutex
+    // set by Sentinel, so that connections to a demoted master aren't
+    // returned to the pool
+    checkAddr bool
+    // when the last command was sent, for ReplicaClient's pinning
+    lastSend int64
+    // set for ReplicaClient's reads to the master, which follow parent's
+    // address and name and share its pool, but keep their own lastSend
+    parent *client
+}
+
+// a connection, tagged with the address it was dialed to, which may be a
+// host name that RemoteAddr doesn't show
+type dialedConn struct {
+    net.Conn
+    addr string
 }
 
 type RedisError string
 
 func (err RedisError) String() string { return "Redis Error: " + string(err) }
 
-var doesNotExist = RedisError("Key does not exist ")
+// Returned by commands when redis replies with nil, e.g. by Get for a
+// key that doesn't exist or by Lpop for an empty list. Inside multi-value
+// results a nil element marks a missing value instead; empty values are
+// always non-nil.
+var ErrNil = RedisError("nil reply")
+
+// Returned when a reply doesn't have the type expected for the command
+// that was sent. Command is empty for replies converted with Int, String
+// and friends, as they don't know which command was sent.
+type UnexpectedReplyError struct {
+    Command string
+    Reply   interface{}
+}
+
+func (err *UnexpectedReplyError) String() string {
+    if err.Command == "" {
+        return fmt.Sprintf("Redis Error: unexpected %T reply %v", err.Reply, err.Reply)
+    }
+    return fmt.Sprintf("Redis Error: unexpected %T reply to %s: %v", err.Reply, err.Command, err.Reply)
+}
 
 func NewClient(addr string, db int, password string) *client {
     c := new(client)
@@ -42,7 +85,8 @@ func NewClient(addr string, db int, password string) *client {
     return c
 }
 
-// reads a bulk reply (i.e $5\r\nhello)
+// reads a bulk reply (i.e $5\r\nhello). A nil bulk ($-1) is returned
+// as a nil slice, while an empty bulk is returned as a non-nil one.
 func readBulk(reader *bufio.Reader, head string) ([]byte, os.Error) {
     var err os.Error
     var data []byte
@@ -62,11 +106,11 @@ func readBulk(reader *bufio.Reader, head string) ([]byte, os.Error) {
         if err != nil {
             return nil, err
         }
-        if size == -1 {
-            return nil, doesNotExist
+        if size < 0 {
+            return nil, nil
         }
-        lr := io.LimitReader(reader, int64(size))
-        data, err = ioutil.ReadAll(lr)
+        data = make([]byte, size)
+        _, err = io.ReadFull(reader, data)
         if err == nil {
             // read end of line
             _, err = reader.ReadString('\n')
@@ -92,7 +136,21 @@ func commandBytes(cmd string, args ...string) []byte {
     return cmdbuf.Bytes()
 }
 
-func readResponse(reader *bufio.Reader) (interface{}, os.Error) {
+// builds the argument list for commands of the form CMD key value [value ...]
+func valueArgs(key string, vals [][]byte) []string {
+    args := make([]string, len(vals)+1)
+    args[0] = key
+    for i, v := range vals {
+        args[i+1] = string(v)
+    }
+    return args
+}
+
+// reads a reply of any shape, including the arbitrarily nested tables
+// that scripts return. Multi-bulks come back as []interface{} whose
+// elements are int64, string (status), []byte, RedisError, nil or nested
+// []interface{}. An error reply at the top level is returned as the error.
+func readReply(reader *bufio.Reader) (interface{}, os.Error) {
 
     var line string
     var err os.Error
@@ -109,48 +167,107 @@ func readResponse(reader *bufio.Reader) (interface{}, os.Error) {
         }
     }
 
-    if line[0] == '+' {
-        return strings.TrimSpace(line[1:]), nil
+    reply, err := parseReply(reader, line)
+    if rerr, ok := reply.(RedisError); ok {
+        return nil, rerr
     }
+    return reply, err
+}
 
-    if strings.HasPrefix(line, "-ERR ") {
-        errmesg := strings.TrimSpace(line[5:])
-        return nil, RedisError(errmesg)
+// parses the reply whose first line has already been read
+func parseReply(reader *bufio.Reader, line string) (interface{}, os.Error) {
+    line = strings.TrimSpace(line)
+    if len(line) == 0 {
+        return nil, RedisError("Empty reply line")
     }
 
-    if line[0] == ':' {
+    switch line[0] {
+    case '+':
+        return strings.TrimSpace(line[1:]), nil
+
+    case '-':
+        if strings.HasPrefix(line, "-ERR ") {
+            return RedisError(strings.TrimSpace(line[5:])), nil
+        }
+        return RedisError(strings.TrimSpace(line[1:])), nil
+
+    case ':':
         n, err := strconv.Atoi64(strings.TrimSpace(line[1:]))
         if err != nil {
             return nil, RedisError("Int reply is not a number")
         }
         return n, nil
-    }
 
-    if line[0] == '*' {
+    case '*':
         size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
         if err != nil {
             return nil, RedisError("MultiBulk reply expected a number")
         }
-        if size <= 0 {
-            return make([][]byte, 0), nil
+        if size < 0 {
+            // nil multi-bulk
+            return nil, nil
         }
-        res := make([][]byte, size)
-        for i := 0; i < size; i++ {
-            res[i], err = readBulk(reader, "")
-            if err == doesNotExist {
-                continue
+        res := make([]interface{}, size)
+        for i := range res {
+            head, err := reader.ReadString('\n')
+            if err != nil {
+                return nil, err
             }
+            res[i], err = parseReply(reader, head)
             if err != nil {
                 return nil, err
             }
-            // dont read end of line as might not have been bulk
         }
         return res, nil
     }
-    return readBulk(reader, line)
+
+    data, err := readBulk(reader, line)
+    if err != nil || data == nil {
+        // don't wrap a nil bulk in a non-nil interface
+        return nil, err
+    }
+    return data, nil
+}
+
+// reads a reply in the shape the command methods expect. This is the
+// same as readReply, except that multi-bulks holding only bulk, integer
+// and nil elements come back as [][]byte, with integers in decimal.
+func readResponse(reader *bufio.Reader) (interface{}, os.Error) {
+    reply, err := readReply(reader)
+    if err != nil {
+        return nil, err
+    }
+    if elems, ok := reply.([]interface{}); ok {
+        return flattenMultiBulk(elems), nil
+    }
+    return reply, nil
+}
+
+func flattenMultiBulk(elems []interface{}) interface{} {
+    flat := make([][]byte, len(elems))
+    nested := false
+    for i, elem := range elems {
+        switch e := elem.(type) {
+        case []byte:
+            flat[i] = e
+        case int64:
+            flat[i] = []byte(strconv.Itoa64(e))
+        case nil:
+            // stays nil
+        case []interface{}:
+            elems[i] = flattenMultiBulk(e)
+            nested = true
+        default:
+            nested = true
+        }
+    }
+    if nested {
+        return elems
+    }
+    return flat
 }
 
-func (self *client) rawSend(c net.Conn, cmd []byte) (interface{}, os.Error) {
+func (self *client) rawSend(c net.Conn, cmd []byte, read func(*bufio.Reader) (interface{}, os.Error)) (interface{}, os.Error) {
     _, err := c.Write(cmd)
     if err != nil {
         return nil, err
@@ -158,7 +275,7 @@ func (self *client) rawSend(c net.Conn, cmd []byte) (interface{}, os.Error) {
 
     reader := bufio.NewReader(c)
 
-    data, err := readResponse(reader)
+    data, err := read(reader)
     if err != nil {
         return nil, err
     }
@@ -166,21 +283,90 @@ func (self *client) rawSend(c net.Conn, cmd []byte) (interface{}, os.Error) {
     return data, nil
 }
 
-func (self *client) openConnection() (c net.Conn, err os.Error) {
+// returns the client whose address, name and pool this one uses
+func (self *client) owner() *client {
+    if self.parent != nil {
+        return self.parent
+    }
+    return self
+}
+
+func (self *client) address() string {
+    o := self.owner()
+    o.lock.Lock()
+    defer o.lock.Unlock()
 
-    var addr = defaultAddr
-    if self.addr != "" {
-        addr = self.addr
+    if o.addr != "" {
+        return o.addr
     }
-    
-    c, err = net.Dial("tcp", addr)
+    return defaultAddr
+}
+
+// returns the name set with ClientSetname
+func (self *client) clientName() string {
+    o := self.owner()
+    o.lock.Lock()
+    defer o.lock.Unlock()
+
+    return o.name
+}
+
+// points the client at addr, closing the pooled connections to the old
+// address
+func (self *client) setAddr(addr string) {
+    self.lock.Lock()
+    changed := self.addr != addr
+    self.addr = addr
+    self.lock.Unlock()
+
+    if changed {
+        self.drainPool()
+    }
+}
+
+// records that a command was sent
+func (self *client) sent() {
+    self.lock.Lock()
+    self.lastSend = time.Nanoseconds()
+    self.lock.Unlock()
+}
+
+// returns when the last command was sent, in unix nanoseconds
+func (self *client) lastSent() int64 {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+
+    return self.lastSend
+}
+
+func (self *client) drainPool() {
+    for len(self.pool) > 0 {
+        select {
+        case c := <-self.pool:
+            c.Close()
+        default:
+        }
+    }
+}
+
+func (self *client) openConnection() (c net.Conn, err os.Error) {
+
+    addr := self.address()
+    conn, err := net.Dial("tcp", addr)
     if err != nil {
         return
     }
+    c = &dialedConn{conn, addr}
 
     if self.db != 0 {
         cmd := fmt.Sprintf("SELECT %d\r\n", self.db)
-        _, err = self.rawSend(c, []byte(cmd))
+        _, err = self.rawSend(c, []byte(cmd), readResponse)
+        if err != nil {
+            return
+        }
+    }
+    if name := self.clientName(); name != "" {
+        _, err = self.rawSend(c, commandBytes("CLIENT", "SETNAME", name), readResponse)
         if err != nil {
             return
         }
@@ -192,6 +378,11 @@ func (self *client) openConnection() (c net.Conn, err os.Error) {
 
 
 func (self *client) sendCommand(cmd string, args ...string) (data interface{}, err os.Error) {
+    return self.send(readResponse, cmd, args...)
+}
+
+// sends a command, parsing the reply with read
+func (self *client) send(read func(*bufio.Reader) (interface{}, os.Error), cmd string, args ...string) (data interface{}, err os.Error) {
     // grab a connection from the pool
     c, err := self.popCon()
 
@@ -200,15 +391,17 @@ func (self *client) sendCommand(cmd string, args ...string) (data interface{}, e
     }
 
     b := commandBytes(cmd, args...)
-    data, err = self.rawSend(c, b)
+    data, err = self.rawSend(c, b, read)
     if err == os.EOF || err == os.EPIPE {
         c, err = self.openConnection()
         if err != nil {
             goto End
         }
 
-        data, err = self.rawSend(c, b)
+        data, err = self.rawSend(c, b, read)
     }
+    // only now, since pinning must last from when the command finished
+    self.sent()
 
 End:
 
@@ -250,17 +443,21 @@ func (self *client) sendCommands(cmdArgs <-chan []string, data chan<- interface{
         }
     }
 
-    errs := make(chan os.Error)
+    // The writer stops when cmdArgs is closed or a write fails, the
+    // reader when a read fails. Each reports once, so errs never blocks.
+    errs := make(chan os.Error, 2)
+    quit := make(chan bool)
+    readerDone := make(chan bool)
 
     go func() {
         for cmdArg := range cmdArgs {
-            err = writeRequest(c, cmdArg[0], cmdArg[1:]...)
+            err := writeRequest(c, cmdArg[0], cmdArg[1:]...)
             if err != nil {
                 errs <- err
-                break
+                return
             }
         }
-        close(errs)
+        errs <- nil
     }()
 
     go func() {
@@ -270,15 +467,22 @@ func (self *client) sendCommands(cmdArgs <-chan []string, data chan<- interface{
                 errs <- err
                 break
             }
-            data <- response
+            // data may no longer be read once we're stopping
+            select {
+            case data <- response:
+            case <-quit:
+            }
         }
-        close(errs)
+        close(readerDone)
     }()
 
-    // Block until errs channel closes
-    for e := range errs {
-        err = e
-    }
+    // Block until either stops, then close the connection and quit to
+    // stop the reader, whether it's reading or sending, so nothing is
+    // sent on data once we return
+    err = <-errs
+    close(quit)
+    c.Close()
+    <-readerDone
 
 End:
 
@@ -300,6 +504,22 @@ func (self *client) popCon() (net.Conn, os.Error) {
 }
 
 func (self *client) pushCon(conn net.Conn) {
+    if conn == nil {
+        return
+    }
+    o := self.owner()
+    o.lock.Lock()
+    stale := false
+    if o.checkAddr {
+        dc, ok := conn.(*dialedConn)
+        stale = !ok || dc.addr != o.addr
+    }
+    o.lock.Unlock()
+    if stale {
+        conn.Close()
+        return
+    }
+
     select {
         case self.pool <- conn:
             break
@@ -308,6 +528,256 @@ func (self *client) pushCon(conn net.Conn) {
     }
 }
 
+// Sends an arbitrary command and returns the raw reply, for commands
+// this package doesn't wrap. Arguments are formatted the same way Hmset
+// formats hash values, so ints, floats, strings and []byte may be mixed.
+// Use the reply conversion functions (Int, String, ...) on the result.
+func (self *client) Do(cmd string, args ...interface{}) (interface{}, os.Error) {
+    sargs, err := interfaceArgs(nil, args)
+    if err != nil {
+        return nil, err
+    }
+    return self.sendCommand(cmd, sargs...)
+}
+
+// formats args with valueToString and appends them to dst
+func interfaceArgs(dst []string, args []interface{}) ([]string, os.Error) {
+    for _, arg := range args {
+        s, err := valueToString(reflect.ValueOf(arg))
+        if err != nil {
+            return nil, err
+        }
+        dst = append(dst, s)
+    }
+    return dst, nil
+}
+
+// Reply conversion. Each function takes a reply and error, as returned
+// by Do, so calls can be chained: redis.Int(client.Do("INCR", "a")). A
+// nil reply is converted to ErrNil.
+
+func Int(reply interface{}, err os.Error) (int64, os.Error) {
+    if err != nil {
+        return 0, err
+    }
+    if reply == nil {
+        return 0, ErrNil
+    }
+    switch r := reply.(type) {
+    case int64:
+        return r, nil
+    case []byte:
+        return strconv.Atoi64(string(r))
+    case string:
+        return strconv.Atoi64(r)
+    }
+    return 0, &UnexpectedReplyError{"", reply}
+}
+
+func Float(reply interface{}, err os.Error) (float64, os.Error) {
+    if err != nil {
+        return 0, err
+    }
+    if reply == nil {
+        return 0, ErrNil
+    }
+    switch r := reply.(type) {
+    case int64:
+        return float64(r), nil
+    case []byte:
+        return strconv.Atof64(string(r))
+    case string:
+        return strconv.Atof64(r)
+    }
+    return 0, &UnexpectedReplyError{"", reply}
+}
+
+func String(reply interface{}, err os.Error) (string, os.Error) {
+    if err != nil {
+        return "", err
+    }
+    if reply == nil {
+        return "", ErrNil
+    }
+    switch r := reply.(type) {
+    case []byte:
+        return string(r), nil
+    case string:
+        return r, nil
+    case int64:
+        return strconv.Itoa64(r), nil
+    }
+    return "", &UnexpectedReplyError{"", reply}
+}
+
+func Bytes(reply interface{}, err os.Error) ([]byte, os.Error) {
+    if err != nil {
+        return nil, err
+    }
+    if reply == nil {
+        return nil, ErrNil
+    }
+    switch r := reply.(type) {
+    case []byte:
+        return r, nil
+    case string:
+        return []byte(r), nil
+    case int64:
+        return []byte(strconv.Itoa64(r)), nil
+    }
+    return nil, &UnexpectedReplyError{"", reply}
+}
+
+// Converts integer replies (non-zero is true), the OK status and bulk
+// "1"/"0" replies to a bool.
+func Bool(reply interface{}, err os.Error) (bool, os.Error) {
+    if err != nil {
+        return false, err
+    }
+    if reply == nil {
+        return false, ErrNil
+    }
+    switch r := reply.(type) {
+    case int64:
+        return r != 0, nil
+    case string:
+        return r == "OK", nil
+    case []byte:
+        return strconv.Atob(string(r))
+    }
+    return false, &UnexpectedReplyError{"", reply}
+}
+
+// Converts a multi-bulk reply to a slice of []byte and nested replies.
+// Nil elements are nil.
+func Values(reply interface{}, err os.Error) ([]interface{}, os.Error) {
+    if err != nil {
+        return nil, err
+    }
+    if reply == nil {
+        return nil, ErrNil
+    }
+    switch r := reply.(type) {
+    case []interface{}:
+        return r, nil
+    case [][]byte:
+        ret := make([]interface{}, len(r))
+        for i, v := range r {
+            if v != nil {
+                ret[i] = v
+            }
+        }
+        return ret, nil
+    }
+    return nil, &UnexpectedReplyError{"", reply}
+}
+
+func Strings(reply interface{}, err os.Error) ([]string, os.Error) {
+    values, err := Values(reply, err)
+    if err != nil {
+        return nil, err
+    }
+    ret := make([]string, len(values))
+    for i, v := range values {
+        if ret[i], err = String(v, nil); err != nil {
+            return nil, err
+        }
+    }
+    return ret, nil
+}
+
+// Converts a multi-bulk reply of alternating keys and values, such as
+// the reply to HGETALL or CONFIG GET, to a map.
+func StringMap(reply interface{}, err os.Error) (map[string]string, os.Error) {
+    values, err := Strings(reply, err)
+    if err != nil {
+        return nil, err
+    }
+    if len(values)%2 != 0 {
+        return nil, RedisError("StringMap expects an even number of values")
+    }
+    ret := make(map[string]string, len(values)/2)
+    for i := 0; i < len(values); i += 2 {
+        ret[values[i]] = values[i+1]
+    }
+    return ret, nil
+}
+
+// Typed views of a command's reply, used by the command methods. They
+// return an UnexpectedReplyError instead of panicking on a reply of
+// another type, and ErrNil for a nil reply. A nil multi-bulk reply is
+// treated as an empty one.
+
+func intReply(cmd string, reply interface{}) (int64, os.Error) {
+    if n, ok := reply.(int64); ok {
+        return n, nil
+    }
+    if reply == nil {
+        return -1, ErrNil
+    }
+    return -1, &UnexpectedReplyError{cmd, reply}
+}
+
+func boolReply(cmd string, reply interface{}) (bool, os.Error) {
+    n, err := intReply(cmd, reply)
+    return n == 1, err
+}
+
+func statusReply(cmd string, reply interface{}) (string, os.Error) {
+    if s, ok := reply.(string); ok {
+        return s, nil
+    }
+    if reply == nil {
+        return "", ErrNil
+    }
+    return "", &UnexpectedReplyError{cmd, reply}
+}
+
+func bulkReply(cmd string, reply interface{}) ([]byte, os.Error) {
+    data, ok := reply.([]byte)
+    if !ok && reply != nil {
+        return nil, &UnexpectedReplyError{cmd, reply}
+    }
+    if data == nil {
+        return nil, ErrNil
+    }
+    return data, nil
+}
+
+func floatReply(cmd string, reply interface{}) (float64, os.Error) {
+    data, err := bulkReply(cmd, reply)
+    if err != nil {
+        return 0, err
+    }
+    f, err := strconv.Atof64(string(data))
+    if err != nil {
+        return 0, &UnexpectedReplyError{cmd, reply}
+    }
+    return f, nil
+}
+
+// like Values, but a nil reply is treated as an empty multi-bulk
+func valuesReply(cmd string, reply interface{}) ([]interface{}, os.Error) {
+    if reply == nil {
+        return nil, nil
+    }
+    values, err := Values(reply, nil)
+    if err != nil {
+        return nil, &UnexpectedReplyError{cmd, reply}
+    }
+    return values, nil
+}
+
+func multiBulkReply(cmd string, reply interface{}) ([][]byte, os.Error) {
+    if data, ok := reply.([][]byte); ok {
+        return data, nil
+    }
+    if reply == nil {
+        return nil, nil
+    }
+    return nil, &UnexpectedReplyError{cmd, reply}
+}
+
 // General Commands
 
 func (self *client) Auth(password string) os.Error {
@@ -319,22 +789,27 @@ func (self *client) Auth(password string) os.Error {
     return nil
 }
 
-func (self *client) Exists(key string) (bool, os.Error) {
-    res, err := self.sendCommand("EXISTS", key)
+// Returns how many of the given keys exist. A key given more than once
+// is counted more than once.
+func (self *client) Exists(keys ...string) (int, os.Error) {
+    res, err := self.sendCommand("EXISTS", keys...)
     if err != nil {
-        return false, err
+        return -1, err
     }
-    return res.(int64) == 1, nil
+    n, err := intReply("EXISTS", res)
+    return int(n), err
 }
 
-func (self *client) Del(key string) (bool, os.Error) {
-    res, err := self.sendCommand("DEL", key)
+// Deletes the given keys, returning the number that were removed.
+func (self *client) Del(keys ...string) (int, os.Error) {
+    res, err := self.sendCommand("DEL", keys...)
 
     if err != nil {
-        return false, err
+        return -1, err
     }
 
-    return res.(int64) == 1, nil
+    n, err := intReply("DEL", res)
+    return int(n), err
 }
 
 func (self *client) Type(key string) (string, os.Error) {
@@ -344,7 +819,7 @@ func (self *client) Type(key string) (string, os.Error) {
         return "", err
     }
 
-    return res.(string), nil
+    return statusReply("TYPE", res)
 }
 
 func (self *client) Keys(pattern string) ([]string, os.Error) {
@@ -354,13 +829,16 @@ func (self *client) Keys(pattern string) ([]string, os.Error) {
         return nil, err
     }
 
-    var ok bool
     var keydata [][]byte
 
-    if keydata, ok = res.([][]byte); ok {
+    switch data := res.(type) {
+    case [][]byte:
         // key data is already a double byte array
-    } else {
-        keydata = bytes.Fields(res.([]byte))
+        keydata = data
+    case []byte:
+        keydata = bytes.Fields(data)
+    default:
+        return nil, &UnexpectedReplyError{"KEYS", res}
     }
     ret := make([]string, len(keydata))
     for i, k := range keydata {
@@ -374,7 +852,11 @@ func (self *client) Randomkey() (string, os.Error) {
     if err != nil {
         return "", err
     }
-    return res.(string), nil
+    data, err := bulkReply("RANDOMKEY", res)
+    if err != nil {
+        return "", err
+    }
+    return string(data), nil
 }
 
 
@@ -391,7 +873,7 @@ func (self *client) Renamenx(src string, dst string) (bool, os.Error) {
     if err != nil {
         return false, err
     }
-    return res.(int64) == 1, nil
+    return boolReply("RENAMENX", res)
 }
 
 func (self *client) Dbsize() (int, os.Error) {
@@ -400,7 +882,8 @@ func (self *client) Dbsize() (int, os.Error) {
         return -1, err
     }
 
-    return int(res.(int64)), nil
+    n, err := intReply("DBSIZE", res)
+    return int(n), err
 }
 
 func (self *client) Expire(key string, time int64) (bool, os.Error) {
@@ -410,7 +893,7 @@ func (self *client) Expire(key string, time int64) (bool, os.Error) {
         return false, err
     }
 
-    return res.(int64) == 1, nil
+    return boolReply("EXPIRE", res)
 }
 
 func (self *client) Ttl(key string) (int64, os.Error) {
@@ -419,7 +902,7 @@ func (self *client) Ttl(key string) (int64, os.Error) {
         return -1, err
     }
 
-    return res.(int64), nil
+    return intReply("TTL", res)
 }
 
 func (self *client) Move(key string, dbnum int) (bool, os.Error) {
@@ -429,7 +912,7 @@ func (self *client) Move(key string, dbnum int) (bool, os.Error) {
         return false, err
     }
 
-    return res.(int64) == 1, nil
+    return boolReply("MOVE", res)
 }
 
 func (self *client) Flush(all bool) os.Error {
@@ -446,72 +929,298 @@ func (self *client) Flush(all bool) os.Error {
     return nil
 }
 
-// String-related commands
+// Expiration commands. Timeouts are Durations and expiration times are
+// *time.Time. Redis keeps them to the millisecond.
 
-func (self *client) Set(key string, val []byte) os.Error {
-    _, err := self.sendCommand("SET", key, string(val))
+// A span of time in nanoseconds, like the differences of
+// time.Nanoseconds().
+type Duration int64
+
+const (
+    Millisecond Duration = 1e6
+    Second      Duration = 1e9
+)
+
+// returns d in milliseconds, rounding positive durations of less than a
+// millisecond up, since redis takes 0 to mean the key expires at once
+func (d Duration) ms() int64 {
+    ms := int64(d / Millisecond)
+    if ms == 0 && d > 0 {
+        ms = 1
+    }
+    return ms
+}
 
+// converts a unix time reply in seconds, or in milliseconds if ms is set,
+// returning nil for the -1 of a key without an expiration and ErrNil for
+// the -2 of a missing key
+func unixTimeReply(cmd string, reply interface{}, ms bool) (*time.Time, os.Error) {
+    n, err := intReply(cmd, reply)
+    switch {
+    case err != nil:
+        return nil, err
+    case n == -2:
+        return nil, ErrNil
+    case n < 0:
+        return nil, nil
+    case ms:
+        return time.NanosecondsToUTC(n * 1e6), nil
+    }
+    return time.SecondsToUTC(n), nil
+}
+
+// When an expiration should be set, relative to the current one. A key
+// without an expiration counts as having an infinite one for ExpireGT and
+// ExpireLT.
+type ExpireCond string
+
+const (
+    ExpireAlways ExpireCond = ""
+    ExpireNX     ExpireCond = "NX" // only if there is none
+    ExpireXX     ExpireCond = "XX" // only if there is one
+    ExpireGT     ExpireCond = "GT" // only if later than the current one
+    ExpireLT     ExpireCond = "LT" // only if earlier than the current one
+)
+
+func (self *client) expire(cmd string, key string, t int64, cond ExpireCond) (bool, os.Error) {
+    args := []string{key, strconv.Itoa64(t)}
+    if cond != ExpireAlways {
+        args = append(args, string(cond))
+    }
+    res, err := self.sendCommand(cmd, args...)
     if err != nil {
-        return err
+        return false, err
     }
 
-    return nil
+    return boolReply(cmd, res)
 }
 
-func (self *client) Get(key string) ([]byte, os.Error) {
-    res, _ := self.sendCommand("GET", key)
-    if res == nil {
-        return nil, RedisError("Key `" + key + "` does not exist")
+// Sets the key to expire after timeout. Returns false if the key doesn't
+// exist or cond prevented the change.
+func (self *client) Pexpire(key string, timeout Duration, cond ExpireCond) (bool, os.Error) {
+    return self.expire("PEXPIRE", key, timeout.ms(), cond)
+}
+
+// Like Pexpire, but sets the key to expire at t, to the second. Fails if
+// t is nil.
+func (self *client) Expireat(key string, t *time.Time, cond ExpireCond) (bool, os.Error) {
+    if t == nil {
+        return false, RedisError("EXPIREAT needs a time")
     }
+    return self.expire("EXPIREAT", key, t.Seconds(), cond)
+}
 
-    data := res.([]byte)
-    return data, nil
+// Like Expireat, to the millisecond.
+func (self *client) Pexpireat(key string, t *time.Time, cond ExpireCond) (bool, os.Error) {
+    if t == nil {
+        return false, RedisError("PEXPIREAT needs a time")
+    }
+    return self.expire("PEXPIREAT", key, t.Nanoseconds()/1e6, cond)
 }
 
-func (self *client) Getset(key string, val []byte) ([]byte, os.Error) {
-    res, err := self.sendCommand("GETSET", key, string(val))
+// Returns the time left before the key expires, -1 if it has no
+// expiration or -2 if it doesn't exist.
+func (self *client) Pttl(key string) (Duration, os.Error) {
+    res, err := self.sendCommand("PTTL", key)
+    if err != nil {
+        return -1, err
+    }
+
+    n, err := intReply("PTTL", res)
+    if err != nil || n < 0 {
+        return Duration(n), err
+    }
+    return Duration(n) * Millisecond, nil
+}
 
+// Returns the time the key expires at, to the second. Returns nil if it
+// has no expiration, or ErrNil if it doesn't exist.
+func (self *client) Expiretime(key string) (*time.Time, os.Error) {
+    res, err := self.sendCommand("EXPIRETIME", key)
     if err != nil {
         return nil, err
     }
 
-    data := res.([]byte)
-    return data, nil
+    return unixTimeReply("EXPIRETIME", res, false)
 }
 
-func (self *client) Mget(keys ...string) ([][]byte, os.Error) {
-    res, err := self.sendCommand("MGET", keys...)
+// Like Expiretime, to the millisecond.
+func (self *client) Pexpiretime(key string) (*time.Time, os.Error) {
+    res, err := self.sendCommand("PEXPIRETIME", key)
     if err != nil {
         return nil, err
     }
 
-    data := res.([][]byte)
-    return data, nil
+    return unixTimeReply("PEXPIRETIME", res, true)
 }
 
-func (self *client) Setnx(key string, val []byte) (bool, os.Error) {
-    res, err := self.sendCommand("SETNX", key, string(val))
-
+// Removes the key's expiration, returning false if it had none.
+func (self *client) Persist(key string) (bool, os.Error) {
+    res, err := self.sendCommand("PERSIST", key)
     if err != nil {
         return false, err
     }
-    if data, ok := res.(int64); ok {
-        return data == 1, nil
-    }
-    return false, RedisError("Unexpected reply to SETNX")
+
+    return boolReply("PERSIST", res)
 }
 
-func (self *client) Setex(key string, time int64, val []byte) os.Error {
-    _, err := self.sendCommand("SETEX", key, strconv.Itoa64(time), string(val))
+// Updates the keys' last access times, returning the number that exist.
+func (self *client) Touch(keys ...string) (int, os.Error) {
+    res, err := self.sendCommand("TOUCH", keys...)
+    if err != nil {
+        return -1, err
+    }
+
+    n, err := intReply("TOUCH", res)
+    return int(n), err
+}
 
+// Like Del, but frees the values' memory in the background.
+func (self *client) Unlink(keys ...string) (int, os.Error) {
+    res, err := self.sendCommand("UNLINK", keys...)
     if err != nil {
-        return err
+        return -1, err
     }
 
-    return nil
+    n, err := intReply("UNLINK", res)
+    return int(n), err
 }
 
-func (self *client) Mset(mapping map[string][]byte) os.Error {
+// Copies src to dst in database db, or in the current database if db is
+// negative. Returns false if dst exists, unless replace is set.
+func (self *client) Copy(src string, dst string, db int, replace bool) (bool, os.Error) {
+    args := []string{src, dst}
+    if db >= 0 {
+        args = append(args, "DB", strconv.Itoa(db))
+    }
+    if replace {
+        args = append(args, "REPLACE")
+    }
+    res, err := self.sendCommand("COPY", args...)
+    if err != nil {
+        return false, err
+    }
+
+    return boolReply("COPY", res)
+}
+
+// Returns the key's value serialized in redis' format, for Restore.
+func (self *client) Dump(key string) ([]byte, os.Error) {
+    res, err := self.sendCommand("DUMP", key)
+    if err != nil {
+        return nil, err
+    }
+
+    return bulkReply("DUMP", res)
+}
+
+// Creates the key from a value returned by Dump, expiring after ttl
+// unless ttl is 0. Fails if the key exists, unless replace is set.
+func (self *client) Restore(key string, ttl Duration, data []byte, replace bool) os.Error {
+    args := []string{key, strconv.Itoa64(ttl.ms()), string(data)}
+    if replace {
+        args = append(args, "REPLACE")
+    }
+    _, err := self.sendCommand("RESTORE", args...)
+    return err
+}
+
+// Returns the internal encoding of the key's value, e.g. "listpack".
+func (self *client) ObjectEncoding(key string) (string, os.Error) {
+    res, err := self.sendCommand("OBJECT", "ENCODING", key)
+    if err != nil {
+        return "", err
+    }
+
+    data, err := bulkReply("OBJECT", res)
+    return string(data), err
+}
+
+// Returns the time since the key was last accessed, to the second.
+func (self *client) ObjectIdletime(key string) (Duration, os.Error) {
+    res, err := self.sendCommand("OBJECT", "IDLETIME", key)
+    if err != nil {
+        return -1, err
+    }
+
+    n, err := intReply("OBJECT", res)
+    return Duration(n) * Second, err
+}
+
+// Returns the key's access frequency counter, when redis evicts keys
+// with an LFU policy.
+func (self *client) ObjectFreq(key string) (int, os.Error) {
+    res, err := self.sendCommand("OBJECT", "FREQ", key)
+    if err != nil {
+        return -1, err
+    }
+
+    n, err := intReply("OBJECT", res)
+    return int(n), err
+}
+
+// String-related commands
+
+func (self *client) Set(key string, val []byte) os.Error {
+    _, err := self.sendCommand("SET", key, string(val))
+
+    if err != nil {
+        return err
+    }
+
+    return nil
+}
+
+func (self *client) Get(key string) ([]byte, os.Error) {
+    res, err := self.sendCommand("GET", key)
+    if err != nil {
+        return nil, err
+    }
+
+    return bulkReply("GET", res)
+}
+
+func (self *client) Getset(key string, val []byte) ([]byte, os.Error) {
+    res, err := self.sendCommand("GETSET", key, string(val))
+
+    if err != nil {
+        return nil, err
+    }
+
+    return bulkReply("GETSET", res)
+}
+
+// Returns the values of the keys in order, with nil for keys that don't
+// exist.
+func (self *client) Mget(keys ...string) ([][]byte, os.Error) {
+    res, err := self.sendCommand("MGET", keys...)
+    if err != nil {
+        return nil, err
+    }
+
+    return multiBulkReply("MGET", res)
+}
+
+func (self *client) Setnx(key string, val []byte) (bool, os.Error) {
+    res, err := self.sendCommand("SETNX", key, string(val))
+
+    if err != nil {
+        return false, err
+    }
+    return boolReply("SETNX", res)
+}
+
+func (self *client) Setex(key string, time int64, val []byte) os.Error {
+    _, err := self.sendCommand("SETEX", key, strconv.Itoa64(time), string(val))
+
+    if err != nil {
+        return err
+    }
+
+    return nil
+}
+
+func (self *client) Mset(mapping map[string][]byte) os.Error {
     args := make([]string, len(mapping)*2)
     i := 0
     for k, v := range mapping {
@@ -538,10 +1247,8 @@ func (self *client) Msetnx(mapping map[string][]byte) (bool, os.Error) {
     if err != nil {
         return false, err
     }
-    if data, ok := res.(int64); ok {
-        return data == 0, nil
-    }
-    return false, RedisError("Unexpected reply to MSETNX")
+    n, err := intReply("MSETNX", res)
+    return n == 0, err
 }
 
 func (self *client) Incr(key string) (int64, os.Error) {
@@ -550,7 +1257,7 @@ func (self *client) Incr(key string) (int64, os.Error) {
         return -1, err
     }
 
-    return res.(int64), nil
+    return intReply("INCR", res)
 }
 
 func (self *client) Incrby(key string, val int64) (int64, os.Error) {
@@ -559,7 +1266,7 @@ func (self *client) Incrby(key string, val int64) (int64, os.Error) {
         return -1, err
     }
 
-    return res.(int64), nil
+    return intReply("INCRBY", res)
 }
 
 func (self *client) Decr(key string) (int64, os.Error) {
@@ -568,7 +1275,7 @@ func (self *client) Decr(key string) (int64, os.Error) {
         return -1, err
     }
 
-    return res.(int64), nil
+    return intReply("DECR", res)
 }
 
 func (self *client) Decrby(key string, val int64) (int64, os.Error) {
@@ -577,7 +1284,7 @@ func (self *client) Decrby(key string, val int64) (int64, os.Error) {
         return -1, err
     }
 
-    return res.(int64), nil
+    return intReply("DECRBY", res)
 }
 
 func (self *client) Append(key string, val []byte) os.Error {
@@ -591,558 +1298,1683 @@ func (self *client) Append(key string, val []byte) os.Error {
 }
 
 func (self *client) Substr(key string, start int, end int) ([]byte, os.Error) {
-    res, _ := self.sendCommand("SUBSTR", key, strconv.Itoa(start), strconv.Itoa(end))
-
-    if res == nil {
-        return nil, RedisError("Key `" + key + "` does not exist")
+    res, err := self.sendCommand("SUBSTR", key, strconv.Itoa(start), strconv.Itoa(end))
+    if err != nil {
+        return nil, err
     }
 
-    data := res.([]byte)
-    return data, nil
+    return bulkReply("SUBSTR", res)
 }
 
-// List commands
-
-func (self *client) Rpush(key string, val []byte) os.Error {
-    _, err := self.sendCommand("RPUSH", key, string(val))
-
-    if err != nil {
-        return err
+// appends EX or PX for a timeout, or EXAT or PXAT for a time, using
+// seconds when there's no remainder
+func expiryArgs(args []string, timeout Duration, at *time.Time) []string {
+    switch {
+    case timeout > 0 && timeout%Second == 0:
+        args = append(args, "EX", strconv.Itoa64(int64(timeout/Second)))
+    case timeout > 0:
+        args = append(args, "PX", strconv.Itoa64(timeout.ms()))
+    case at != nil && at.Nanosecond == 0:
+        args = append(args, "EXAT", strconv.Itoa64(at.Seconds()))
+    case at != nil:
+        args = append(args, "PXAT", strconv.Itoa64(at.Nanoseconds()/1e6))
     }
+    return args
+}
 
-    return nil
+// Options for SetWith and SetGet. Expire is a timeout and ExpireAt a
+// time; at most one of them, or KeepTTL to keep the key's current
+// expiration, may be set. NX only sets keys that don't exist and XX only
+// keys that do.
+type SetOptions struct {
+    Expire   Duration
+    ExpireAt *time.Time
+    KeepTTL  bool
+    NX       bool
+    XX       bool
 }
 
-func (self *client) Lpush(key string, val []byte) os.Error {
-    _, err := self.sendCommand("LPUSH", key, string(val))
+func (opts *SetOptions) args(args []string) []string {
+    args = expiryArgs(args, opts.Expire, opts.ExpireAt)
+    if opts.KeepTTL {
+        args = append(args, "KEEPTTL")
+    }
+    if opts.NX {
+        args = append(args, "NX")
+    }
+    if opts.XX {
+        args = append(args, "XX")
+    }
+    return args
+}
 
+// Sets the key with options, returning false if NX or XX prevented it.
+// opts may be nil.
+func (self *client) SetWith(key string, val []byte, opts *SetOptions) (bool, os.Error) {
+    args := []string{key, string(val)}
+    if opts != nil {
+        args = opts.args(args)
+    }
+    res, err := self.sendCommand("SET", args...)
     if err != nil {
-        return err
+        return false, err
+    }
+    if res == nil {
+        return false, nil
     }
 
-    return nil
+    _, err = statusReply("SET", res)
+    return err == nil, err
 }
 
-func (self *client) Llen(key string) (int, os.Error) {
-    res, err := self.sendCommand("LLEN", key)
+// Like SetWith, but returns the old value, or ErrNil if there was none.
+// With NX or XX, the value is only set if the key's existence before the
+// call matches.
+func (self *client) SetGet(key string, val []byte, opts *SetOptions) ([]byte, os.Error) {
+    args := []string{key, string(val)}
+    if opts != nil {
+        args = opts.args(args)
+    }
+    res, err := self.sendCommand("SET", append(args, "GET")...)
     if err != nil {
-        return -1, err
+        return nil, err
     }
 
-    return int(res.(int64)), nil
+    return bulkReply("SET", res)
 }
 
-func (self *client) Lrange(key string, start int, end int) ([][]byte, os.Error) {
-    res, err := self.sendCommand("LRANGE", key, strconv.Itoa(start), strconv.Itoa(end))
+// Options for Getex: a timeout or time, as for SetOptions, or Persist to
+// remove the key's expiration.
+type GetexOptions struct {
+    Expire   Duration
+    ExpireAt *time.Time
+    Persist  bool
+}
+
+// Returns the key's value, updating its expiration. With nil opts the
+// expiration is left alone.
+func (self *client) Getex(key string, opts *GetexOptions) ([]byte, os.Error) {
+    args := []string{key}
+    if opts != nil {
+        args = expiryArgs(args, opts.Expire, opts.ExpireAt)
+        if opts.Persist {
+            args = append(args, "PERSIST")
+        }
+    }
+    res, err := self.sendCommand("GETEX", args...)
     if err != nil {
         return nil, err
     }
 
-    return res.([][]byte), nil
+    return bulkReply("GETEX", res)
 }
 
-func (self *client) Ltrim(key string, start int, end int) os.Error {
-    _, err := self.sendCommand("LTRIM", key, strconv.Itoa(start), strconv.Itoa(end))
+// Returns the key's value and deletes it.
+func (self *client) Getdel(key string) ([]byte, os.Error) {
+    res, err := self.sendCommand("GETDEL", key)
     if err != nil {
-        return err
+        return nil, err
     }
 
-    return nil
+    return bulkReply("GETDEL", res)
 }
 
-func (self *client) Lindex(key string, index int) ([]byte, os.Error) {
-    res, err := self.sendCommand("LINDEX", key, strconv.Itoa(index))
+// Bitmap commands
+
+// Sets or clears the bit at offset, returning its previous value.
+func (self *client) Setbit(key string, offset int64, value bool) (bool, os.Error) {
+    bit := "0"
+    if value {
+        bit = "1"
+    }
+    res, err := self.sendCommand("SETBIT", key, strconv.Itoa64(offset), bit)
     if err != nil {
-        return nil, err
+        return false, err
     }
 
-    return res.([]byte), nil
+    return boolReply("SETBIT", res)
 }
 
-func (self *client) Lset(key string, index int, value []byte) os.Error {
-    _, err := self.sendCommand("LSET", key, strconv.Itoa(index), string(value))
+func (self *client) Getbit(key string, offset int64) (bool, os.Error) {
+    res, err := self.sendCommand("GETBIT", key, strconv.Itoa64(offset))
     if err != nil {
-        return err
+        return false, err
     }
 
-    return nil
+    return boolReply("GETBIT", res)
 }
 
-func (self *client) Lrem(key string, index int) (int, os.Error) {
-    res, err := self.sendCommand("LREM", key, strconv.Itoa(index))
+// Returns the number of set bits in the string.
+func (self *client) Bitcount(key string) (int64, os.Error) {
+    res, err := self.sendCommand("BITCOUNT", key)
     if err != nil {
         return -1, err
     }
 
-    return int(res.(int64)), nil
+    return intReply("BITCOUNT", res)
 }
 
-func (self *client) Lpop(key string) ([]byte, os.Error) {
-    res, err := self.sendCommand("LPOP", key)
+// appends a start and end offset, in bits if bits is set and in bytes
+// otherwise
+func bitRangeArgs(args []string, start int64, end int64, bits bool) []string {
+    args = append(args, strconv.Itoa64(start), strconv.Itoa64(end))
+    // leave out BYTE, which redis before 7.0 doesn't know
+    if bits {
+        args = append(args, "BIT")
+    }
+    return args
+}
+
+// Like Bitcount, but only counts between the start and end offsets,
+// inclusive. Offsets are in bytes unless bits is set, and negative
+// offsets count from the end of the string.
+func (self *client) BitcountRange(key string, start int64, end int64, bits bool) (int64, os.Error) {
+    res, err := self.sendCommand("BITCOUNT", bitRangeArgs([]string{key}, start, end, bits)...)
     if err != nil {
-        return nil, err
+        return -1, err
     }
 
-    return res.([]byte), nil
+    return intReply("BITCOUNT", res)
 }
 
-func (self *client) Rpop(key string) ([]byte, os.Error) {
-    res, err := self.sendCommand("RPOP", key)
+// An operation for Bitop.
+type BitOp string
+
+const (
+    BitAnd BitOp = "AND"
+    BitOr  BitOp = "OR"
+    BitXor BitOp = "XOR"
+    BitNot BitOp = "NOT"
+)
+
+// Combines the strings at keys bit by bit, storing the result in dst.
+// BitNot takes a single key. Returns the length of the result.
+func (self *client) Bitop(op BitOp, dst string, keys ...string) (int, os.Error) {
+    args := make([]string, len(keys)+2)
+    args[0] = string(op)
+    args[1] = dst
+    copy(args[2:], keys)
+    res, err := self.sendCommand("BITOP", args...)
     if err != nil {
-        return nil, err
+        return -1, err
     }
 
-    return res.([]byte), nil
+    n, err := intReply("BITOP", res)
+    return int(n), err
 }
 
-func (self *client) Blpop(keys []string, timeoutSecs uint) (*string, []byte, os.Error) {
-    return self.bpop("BLPOP", keys, timeoutSecs)
-}
-func (self *client) Brpop(keys []string, timeoutSecs uint) (*string, []byte, os.Error) {
-    return self.bpop("BRPOP", keys, timeoutSecs)
+// Returns the position of the first bit set to bit, or -1 if there is
+// none. Looking for a clear bit in a string with every bit set returns
+// the position just past its end.
+func (self *client) Bitpos(key string, bit bool) (int64, os.Error) {
+    return self.bitpos(key, bit)
 }
 
-func (self *client) bpop(cmd string, keys []string, timeoutSecs uint) (*string, []byte, os.Error) {
-    args := append(keys, strconv.Uitoa(timeoutSecs))
-    res, err := self.sendCommand(cmd, args...)
-    if err != nil {
-        return nil, nil, err
-    }
-    kv := res.([][]byte)
-    // Check for timeout
-    if len(kv) != 2 {
-        return nil, nil, nil
-    }
-    k := string(kv[0])
-    v := kv[1]
-    return &k, v, nil
+// Like Bitpos, but only looks between the start and end offsets,
+// which are treated as they are by BitcountRange.
+func (self *client) BitposRange(key string, bit bool, start int64, end int64, bits bool) (int64, os.Error) {
+    return self.bitpos(key, bit, bitRangeArgs(nil, start, end, bits)...)
 }
 
-func (self *client) Rpoplpush(src string, dst string) ([]byte, os.Error) {
-    res, err := self.sendCommand("RPOPLPUSH", src, dst)
+func (self *client) bitpos(key string, bit bool, rangeArgs ...string) (int64, os.Error) {
+    args := []string{key, "0"}
+    if bit {
+        args[1] = "1"
+    }
+    res, err := self.sendCommand("BITPOS", append(args, rangeArgs...)...)
     if err != nil {
-        return nil, err
+        return -1, err
     }
 
-    return res.([]byte), nil
+    return intReply("BITPOS", res)
 }
 
-// Set commands
+// How Bitfield handles increments that overflow.
+type BitfieldOverflow string
 
-func (self *client) Sadd(key string, value []byte) (bool, os.Error) {
-    res, err := self.sendCommand("SADD", key, string(value))
+const (
+    // wrap around, the default
+    OverflowWrap BitfieldOverflow = "WRAP"
+    // saturate at the minimum or maximum value
+    OverflowSat BitfieldOverflow = "SAT"
+    // skip the operation, returning nil for it
+    OverflowFail BitfieldOverflow = "FAIL"
+)
 
-    if err != nil {
-        return false, err
-    }
+// A list of BITFIELD operations on one key, built by chaining calls and
+// run by Bitfield or BitfieldRo. Types are "i" for signed or "u" for
+// unsigned integers followed by the width in bits, e.g. "u8" or "i16".
+// Offsets are in bits.
+type Bitfield struct {
+    key  string
+    args []string
+}
 
-    return res.(int64) == 1, nil
+func NewBitfield(key string) *Bitfield {
+    return &Bitfield{key, []string{key}}
 }
 
-func (self *client) Srem(key string, value []byte) (bool, os.Error) {
-    res, err := self.sendCommand("SREM", key, string(value))
+// Reads the integer at offset.
+func (b *Bitfield) Get(typ string, offset int64) *Bitfield {
+    b.args = append(b.args, "GET", typ, strconv.Itoa64(offset))
+    return b
+}
 
-    if err != nil {
-        return false, err
-    }
+// Writes the integer at offset, returning the old value.
+func (b *Bitfield) Set(typ string, offset int64, value int64) *Bitfield {
+    b.args = append(b.args, "SET", typ, strconv.Itoa64(offset), strconv.Itoa64(value))
+    return b
+}
 
-    return res.(int64) == 1, nil
+// Increments the integer at offset, returning the new value.
+func (b *Bitfield) Incrby(typ string, offset int64, incr int64) *Bitfield {
+    b.args = append(b.args, "INCRBY", typ, strconv.Itoa64(offset), strconv.Itoa64(incr))
+    return b
 }
 
-func (self *client) Spop(key string) ([]byte, os.Error) {
-    res, err := self.sendCommand("SPOP", key)
+// Sets the overflow behaviour of the operations after it.
+func (b *Bitfield) Overflow(overflow BitfieldOverflow) *Bitfield {
+    b.args = append(b.args, "OVERFLOW", string(overflow))
+    return b
+}
+
+// Runs the operations, returning a result for each Get, Set and Incrby.
+// Results are nil for increments skipped by OverflowFail.
+func (self *client) Bitfield(b *Bitfield) ([]*int64, os.Error) {
+    res, err := self.sendCommand("BITFIELD", b.args...)
     if err != nil {
         return nil, err
     }
 
-    if res == nil {
-        return nil, RedisError("Spop failed")
+    data, err := multiBulkReply("BITFIELD", res)
+    if err != nil {
+        return nil, err
     }
-
-    data := res.([]byte)
-    return data, nil
+    results := make([]*int64, len(data))
+    for i, d := range data {
+        if d == nil {
+            continue
+        }
+        n, err := strconv.Atoi64(string(d))
+        if err != nil {
+            return nil, &UnexpectedReplyError{"BITFIELD", res}
+        }
+        results[i] = &n
+    }
+    return results, nil
 }
 
-func (self *client) Smove(src string, dst string, val []byte) (bool, os.Error) {
-    res, err := self.sendCommand("SMOVE", src, dst, string(val))
+// Runs a Bitfield made up only of Gets, which redis allows on replicas.
+func (self *client) BitfieldRo(b *Bitfield) ([]int64, os.Error) {
+    res, err := self.sendCommand("BITFIELD_RO", b.args...)
     if err != nil {
-        return false, err
+        return nil, err
     }
 
-    return res.(int64) == 1, nil
-}
-
-func (self *client) Scard(key string) (int, os.Error) {
-    res, err := self.sendCommand("SCARD", key)
+    data, err := multiBulkReply("BITFIELD_RO", res)
     if err != nil {
-        return -1, err
+        return nil, err
     }
-
-    return int(res.(int64)), nil
+    results := make([]int64, len(data))
+    for i, d := range data {
+        results[i], err = strconv.Atoi64(string(d))
+        if err != nil {
+            return nil, &UnexpectedReplyError{"BITFIELD_RO", res}
+        }
+    }
+    return results, nil
 }
 
-func (self *client) Sismember(key string, value []byte) (bool, os.Error) {
-    res, err := self.sendCommand("SISMEMBER", key, string(value))
+// HyperLogLog commands
 
+// Adds the elements to the HyperLogLog, returning whether its estimated
+// cardinality changed.
+func (self *client) Pfadd(key string, elements ...[]byte) (bool, os.Error) {
+    res, err := self.sendCommand("PFADD", valueArgs(key, elements)...)
     if err != nil {
         return false, err
     }
 
-    return res.(int64) == 1, nil
+    return boolReply("PFADD", res)
 }
 
-func (self *client) Sinter(keys ...string) ([][]byte, os.Error) {
-    res, err := self.sendCommand("SINTER", keys...)
+// Returns the estimated number of unique elements added to the keys,
+// counting elements added to more than one key once.
+func (self *client) Pfcount(keys ...string) (int64, os.Error) {
+    res, err := self.sendCommand("PFCOUNT", keys...)
     if err != nil {
-        return nil, err
+        return -1, err
     }
 
-    return res.([][]byte), nil
+    return intReply("PFCOUNT", res)
 }
 
-func (self *client) Sinterstore(dst string, keys ...string) (int, os.Error) {
+// Merges the keys into dst, which is included in the result if it exists.
+func (self *client) Pfmerge(dst string, keys ...string) os.Error {
     args := make([]string, len(keys)+1)
     args[0] = dst
     copy(args[1:], keys)
-    res, err := self.sendCommand("SINTERSTORE", args...)
-    if err != nil {
-        return 0, err
-    }
+    _, err := self.sendCommand("PFMERGE", args...)
+    return err
+}
 
-    return int(res.(int64)), nil
+// Counts unique elements over time windows, keeping a HyperLogLog for
+// each interval, e.g. unique visitors per hour. The key for an interval is
+// the prefix followed by the unix time it starts at. Intervals expire
+// after Keep seconds, unless Keep is 0.
+type HllWindow struct {
+    Prefix   string
+    Interval int64
+    Keep     int64
+    client   *client
 }
 
-func (self *client) Sunion(keys ...string) ([][]byte, os.Error) {
-    res, err := self.sendCommand("SUNION", keys...)
-    if err != nil {
-        return nil, err
+// Fails if interval isn't positive.
+func NewHllWindow(c *client, prefix string, interval int64, keep int64) (*HllWindow, os.Error) {
+    if interval <= 0 {
+        return nil, RedisError("HllWindow interval must be positive")
     }
+    return &HllWindow{prefix, interval, keep, c}, nil
+}
 
-    return res.([][]byte), nil
+// Returns the key for the interval containing the unix time t.
+func (w *HllWindow) Key(t int64) string {
+    return w.Prefix + strconv.Itoa64(t-t%w.Interval)
 }
 
-func (self *client) Sunionstore(dst string, keys ...string) (int, os.Error) {
-    args := make([]string, len(keys)+1)
-    args[0] = dst
-    copy(args[1:], keys)
-    res, err := self.sendCommand("SUNIONSTORE", args...)
-    if err != nil {
-        return 0, err
+// returns the keys for the intervals overlapping from up to to
+func (w *HllWindow) keys(from int64, to int64) []string {
+    var keys []string
+    for t := from - from%w.Interval; t < to; t += w.Interval {
+        keys = append(keys, w.Prefix+strconv.Itoa64(t))
     }
-
-    return int(res.(int64)), nil
+    return keys
 }
 
-func (self *client) Sdiff(key1 string, keys []string) ([][]byte, os.Error) {
-    args := make([]string, len(keys)+1)
-    args[0] = key1
-    copy(args[1:], keys)
-    res, err := self.sendCommand("SDIFF", args...)
-    if err != nil {
-        return nil, err
+// Adds the elements at the unix time t, usually time.Seconds(). Elements
+// for an interval that has already expired are ignored.
+func (w *HllWindow) Add(t int64, elements ...[]byte) os.Error {
+    // expire relative to the end of the interval, so the whole interval
+    // is kept for as long
+    ttl := t - t%w.Interval + w.Interval + w.Keep - time.Seconds()
+    if w.Keep != 0 && ttl <= 0 {
+        return nil
     }
 
-    return res.([][]byte), nil
+    key := w.Key(t)
+    _, err := w.client.Pfadd(key, elements...)
+    if err != nil || w.Keep == 0 {
+        return err
+    }
+    _, err = w.client.Expire(key, ttl)
+    return err
 }
 
-func (self *client) Sdiffstore(dst string, key1 string, keys []string) (int, os.Error) {
-    args := make([]string, len(keys)+2)
-    args[0] = dst
-    args[1] = key1
-    copy(args[2:], keys)
-    res, err := self.sendCommand("SDIFFSTORE", args...)
-    if err != nil {
-        return 0, err
+// Returns the estimated number of unique elements added to the intervals
+// overlapping the unix times from up to, but not including, to.
+func (w *HllWindow) Count(from int64, to int64) (int64, os.Error) {
+    keys := w.keys(from, to)
+    if len(keys) == 0 {
+        return 0, nil
     }
+    return w.client.Pfcount(keys...)
+}
 
-    return int(res.(int64)), nil
+// Like Count, but merges the intervals into dst, e.g. to roll hours up
+// into a day. dst expires after ttl seconds, unless ttl is 0.
+func (w *HllWindow) Merge(dst string, from int64, to int64, ttl int64) os.Error {
+    err := w.client.Pfmerge(dst, w.keys(from, to)...)
+    if err != nil || ttl == 0 {
+        return err
+    }
+    _, err = w.client.Expire(dst, ttl)
+    return err
 }
 
-func (self *client) Smembers(key string) ([][]byte, os.Error) {
-    res, err := self.sendCommand("SMEMBERS", key)
+// List commands
+
+// Appends the values to the list, returning its new length.
+func (self *client) Rpush(key string, vals ...[]byte) (int, os.Error) {
+    res, err := self.sendCommand("RPUSH", valueArgs(key, vals)...)
 
     if err != nil {
-        return nil, err
+        return -1, err
     }
 
-    return res.([][]byte), nil
+    n, err := intReply("RPUSH", res)
+    return int(n), err
 }
 
-func (self *client) Srandmember(key string) ([]byte, os.Error) {
-    res, err := self.sendCommand("SRANDMEMBER", key)
+// Prepends the values to the list one after another, so the last value
+// ends up at the head. Returns the list's new length.
+func (self *client) Lpush(key string, vals ...[]byte) (int, os.Error) {
+    res, err := self.sendCommand("LPUSH", valueArgs(key, vals)...)
+
     if err != nil {
-        return nil, err
+        return -1, err
     }
 
-    return res.([]byte), nil
+    n, err := intReply("LPUSH", res)
+    return int(n), err
 }
 
-// sorted set commands
+// Like Rpush, but only if the list already exists.
+func (self *client) Rpushx(key string, vals ...[]byte) (int, os.Error) {
+    res, err := self.sendCommand("RPUSHX", valueArgs(key, vals)...)
 
-func (self *client) Zadd(key string, value []byte, score float64) (bool, os.Error) {
-    res, err := self.sendCommand("ZADD", key, strconv.Ftoa64(score, 'f', -1), string(value))
     if err != nil {
-        return false, err
+        return -1, err
     }
 
-    return res.(int64) == 1, nil
+    n, err := intReply("RPUSHX", res)
+    return int(n), err
 }
 
-func (self *client) Zrem(key string, value []byte) (bool, os.Error) {
-    res, err := self.sendCommand("ZREM", key, string(value))
+// Like Lpush, but only if the list already exists.
+func (self *client) Lpushx(key string, vals ...[]byte) (int, os.Error) {
+    res, err := self.sendCommand("LPUSHX", valueArgs(key, vals)...)
+
     if err != nil {
-        return false, err
+        return -1, err
     }
 
-    return res.(int64) == 1, nil
+    n, err := intReply("LPUSHX", res)
+    return int(n), err
 }
 
-func (self *client) Zincrby(key string, value []byte, score float64) (float64, os.Error) {
-    res, err := self.sendCommand("ZINCRBY", key, strconv.Ftoa64(score, 'f', -1), string(value))
+func (self *client) Llen(key string) (int, os.Error) {
+    res, err := self.sendCommand("LLEN", key)
     if err != nil {
-        return 0, err
+        return -1, err
     }
 
-    data := string(res.([]byte))
-    f, _ := strconv.Atof64(data)
-    return f, nil
+    n, err := intReply("LLEN", res)
+    return int(n), err
 }
 
-func (self *client) Zrank(key string, value []byte) (int, os.Error) {
-    res, err := self.sendCommand("ZRANK", key, string(value))
+func (self *client) Lrange(key string, start int, end int) ([][]byte, os.Error) {
+    res, err := self.sendCommand("LRANGE", key, strconv.Itoa(start), strconv.Itoa(end))
     if err != nil {
-        return 0, err
+        return nil, err
     }
 
-    return int(res.(int64)), nil
+    return multiBulkReply("LRANGE", res)
 }
 
-func (self *client) Zrevrank(key string, value []byte) (int, os.Error) {
-    res, err := self.sendCommand("ZREVRANK", key, string(value))
+func (self *client) Ltrim(key string, start int, end int) os.Error {
+    _, err := self.sendCommand("LTRIM", key, strconv.Itoa(start), strconv.Itoa(end))
     if err != nil {
-        return 0, err
+        return err
     }
 
-    return int(res.(int64)), nil
+    return nil
 }
 
-func (self *client) Zrange(key string, start int, end int) ([][]byte, os.Error) {
-    res, err := self.sendCommand("ZRANGE", key, strconv.Itoa(start), strconv.Itoa(end))
+func (self *client) Lindex(key string, index int) ([]byte, os.Error) {
+    res, err := self.sendCommand("LINDEX", key, strconv.Itoa(index))
     if err != nil {
         return nil, err
     }
 
-    return res.([][]byte), nil
+    return bulkReply("LINDEX", res)
 }
 
-func (self *client) Zrevrange(key string, start int, end int) ([][]byte, os.Error) {
-    res, err := self.sendCommand("ZREVRANGE", key, strconv.Itoa(start), strconv.Itoa(end))
+func (self *client) Lset(key string, index int, value []byte) os.Error {
+    _, err := self.sendCommand("LSET", key, strconv.Itoa(index), string(value))
     if err != nil {
-        return nil, err
+        return err
     }
 
-    return res.([][]byte), nil
+    return nil
 }
 
-func (self *client) Zrangebyscore(key string, start float64, end float64) ([][]byte, os.Error) {
-    res, err := self.sendCommand("ZRANGEBYSCORE", key, strconv.Ftoa64(start, 'f', -1), strconv.Ftoa64(end, 'f', -1))
+// Removes up to count occurrences of value from the list, starting from
+// the head if count is positive or the tail if it is negative. A count
+// of 0 removes every occurrence. Returns the number removed.
+func (self *client) Lrem(key string, count int, value []byte) (int, os.Error) {
+    res, err := self.sendCommand("LREM", key, strconv.Itoa(count), string(value))
     if err != nil {
-        return nil, err
+        return -1, err
     }
 
-    return res.([][]byte), nil
+    n, err := intReply("LREM", res)
+    return int(n), err
 }
 
-func (self *client) Zcard(key string) (int, os.Error) {
-    res, err := self.sendCommand("ZCARD", key)
+// Inserts value before or after the first occurrence of pivot. Returns
+// the new length of the list, or -1 if pivot wasn't found.
+func (self *client) Linsert(key string, before bool, pivot []byte, value []byte) (int, os.Error) {
+    where := "AFTER"
+    if before {
+        where = "BEFORE"
+    }
+    res, err := self.sendCommand("LINSERT", key, where, string(pivot), string(value))
     if err != nil {
         return -1, err
     }
 
-    return int(res.(int64)), nil
+    n, err := intReply("LINSERT", res)
+    return int(n), err
 }
 
-func (self *client) Zscore(key string, member []byte) (float64, os.Error) {
-    res, err := self.sendCommand("ZSCORE", key, string(member))
-    if err != nil {
-        return 0, err
+func lposArgs(key string, value []byte, rank int, maxlen int) []string {
+    args := []string{key, string(value)}
+    if rank != 0 {
+        args = append(args, "RANK", strconv.Itoa(rank))
     }
-
-    data := string(res.([]byte))
-    f, _ := strconv.Atof64(data)
-    return f, nil
+    if maxlen > 0 {
+        args = append(args, "MAXLEN", strconv.Itoa(maxlen))
+    }
+    return args
 }
 
-func (self *client) Zremrangebyrank(key string, start int, end int) (int, os.Error) {
-    res, err := self.sendCommand("ZREMRANGEBYRANK", key, strconv.Itoa(start), strconv.Itoa(end))
+// Returns the index of value in the list, or -1 if it isn't there. rank
+// selects which match to return (negative ranks search from the tail)
+// and maxlen limits how many elements are scanned. Pass 0 for either to
+// use the default.
+func (self *client) Lpos(key string, value []byte, rank int, maxlen int) (int, os.Error) {
+    res, err := self.sendCommand("LPOS", lposArgs(key, value, rank, maxlen)...)
     if err != nil {
         return -1, err
     }
+    if res == nil {
+        return -1, nil
+    }
 
-    return int(res.(int64)), nil
+    n, err := intReply("LPOS", res)
+    return int(n), err
 }
 
-func (self *client) Zremrangebyscore(key string, start float64, end float64) (int, os.Error) {
-    res, err := self.sendCommand("ZREMRANGEBYSCORE", key, strconv.Ftoa64(start, 'f', -1), strconv.Ftoa64(end, 'f', -1))
+// Like Lpos, but returns the indexes of up to count matches. A count of 0
+// returns every match.
+func (self *client) Lposcount(key string, value []byte, rank int, count int, maxlen int) ([]int, os.Error) {
+    args := append(lposArgs(key, value, rank, maxlen), "COUNT", strconv.Itoa(count))
+    res, err := self.sendCommand("LPOS", args...)
     if err != nil {
-        return -1, err
+        return nil, err
     }
 
-    return int(res.(int64)), nil
+    data, err := multiBulkReply("LPOS", res)
+    if err != nil {
+        return nil, err
+    }
+    ret := make([]int, len(data))
+    for i, d := range data {
+        ret[i], err = strconv.Atoi(string(d))
+        if err != nil {
+            return nil, err
+        }
+    }
+    return ret, nil
 }
 
-// hash commands
-
-func (self *client) Hset(key string, field string, val []byte) (bool, os.Error) {
-    res, err := self.sendCommand("HSET", key, field, string(val))
+func (self *client) Lpop(key string) ([]byte, os.Error) {
+    res, err := self.sendCommand("LPOP", key)
     if err != nil {
-        return false, err
+        return nil, err
     }
 
-    return res.(int64) == 1, nil
+    return bulkReply("LPOP", res)
 }
 
-func (self *client) Hget(key string, field string) ([]byte, os.Error) {
-    res, _ := self.sendCommand("HGET", key, field)
-
-    if res == nil {
-        return nil, RedisError("Hget failed")
+func (self *client) Rpop(key string) ([]byte, os.Error) {
+    res, err := self.sendCommand("RPOP", key)
+    if err != nil {
+        return nil, err
     }
 
-    data := res.([]byte)
-    return data, nil
+    return bulkReply("RPOP", res)
 }
 
-//pretty much copy the json code from here.
+func (self *client) Blpop(keys []string, timeoutSecs uint) (*string, []byte, os.Error) {
+    return self.bpop("BLPOP", keys, timeoutSecs)
+}
+func (self *client) Brpop(keys []string, timeoutSecs uint) (*string, []byte, os.Error) {
+    return self.bpop("BRPOP", keys, timeoutSecs)
+}
 
-func valueToString(v reflect.Value) (string, os.Error) {
-    if !v.IsValid() {
-        return "null", nil
+func (self *client) bpop(cmd string, keys []string, timeoutSecs uint) (*string, []byte, os.Error) {
+    args := append(keys, strconv.Uitoa(timeoutSecs))
+    res, err := self.sendCommand(cmd, args...)
+    if err != nil {
+        return nil, nil, err
+    }
+    kv, err := multiBulkReply(cmd, res)
+    if err != nil {
+        return nil, nil, err
+    }
+    // Check for timeout
+    if len(kv) != 2 {
+        return nil, nil, nil
     }
+    k := string(kv[0])
+    v := kv[1]
+    return &k, v, nil
+}
 
-    switch v.Kind() {
-    case reflect.Ptr:
-        return valueToString(reflect.Indirect(v))
-    case reflect.Interface:
-        return valueToString(v.Elem())
-    case reflect.Bool:
-        x := v.Bool()
-        if x {
-            return "true", nil
-        } else {
-            return "false", nil
-        }
+func (self *client) Rpoplpush(src string, dst string) ([]byte, os.Error) {
+    res, err := self.sendCommand("RPOPLPUSH", src, dst)
+    if err != nil {
+        return nil, err
+    }
 
-    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-        return strconv.Itoa64(v.Int()), nil
-    case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
-        return strconv.Uitoa64(v.Uint()), nil
-    case reflect.UnsafePointer:
-        return strconv.Uitoa64(uint64(v.Pointer())), nil
+    return bulkReply("RPOPLPUSH", res)
+}
 
-    case reflect.Float32, reflect.Float64:
-        return strconv.Ftoa64(v.Float(), 'g', -1), nil
+// One end of a list, for Lmove and Lmpop.
+type ListSide string
 
-    case reflect.String:
-        return v.String(), nil
+const (
+    Left  ListSide = "LEFT"
+    Right ListSide = "RIGHT"
+)
 
-    //This is kind of a rough hack to replace the old []byte
-    //detection with reflect.Uint8Type, it doesn't catch
-    //zero-length byte slices
-    case reflect.Slice:
-        typ := v.Type()
-        if typ.Elem().Kind() == reflect.Uint || typ.Elem().Kind() == reflect.Uint8 || typ.Elem().Kind() == reflect.Uint16 || typ.Elem().Kind() == reflect.Uint32 || typ.Elem().Kind() == reflect.Uint64 || typ.Elem().Kind() == reflect.Uintptr {
-            if v.Len() > 0 {
-                if v.Index(1).OverflowUint(257) {
-                    return string(v.Interface().([]byte)), nil
-                }
-            }
-        }
+// Pops an element from the from side of src and pushes it onto the to
+// side of dst, returning the element.
+func (self *client) Lmove(src string, dst string, from ListSide, to ListSide) ([]byte, os.Error) {
+    res, err := self.sendCommand("LMOVE", src, dst, string(from), string(to))
+    if err != nil {
+        return nil, err
     }
-    return "", os.NewError("Unsupported type")
+
+    return bulkReply("LMOVE", res)
 }
 
-func containerToString(val reflect.Value, args *vector.StringVector) os.Error {
-    switch v := val; v.Kind() {
-    case reflect.Ptr:
-        return containerToString(reflect.Indirect(v), args)
-    case reflect.Interface:
-        return containerToString(v.Elem(), args)
-    case reflect.Map:
-        if v.Type().Key().Kind() != reflect.String {
-            return os.NewError("Unsupported type - map key must be a string")
-        }
-        for _, k := range v.MapKeys() {
-            args.Push(k.String())
-            s, err := valueToString(v.MapIndex(k))
-            if err != nil {
-                return err
-            }
-            args.Push(s)
-        }
-    case reflect.Struct:
-        st := v.Type()
-        for i := 0; i < st.NumField(); i++ {
-            ft := st.FieldByIndex([]int{i})
-            args.Push(ft.Name)
-            s, err := valueToString(v.FieldByIndex([]int{i}))
-            if err != nil {
-                return err
-            }
-            args.Push(s)
-        }
+// Blocking version of Lmove. Returns nil if the timeout expires first.
+func (self *client) Blmove(src string, dst string, from ListSide, to ListSide, timeoutSecs uint) ([]byte, os.Error) {
+    res, err := self.sendCommand("BLMOVE", src, dst, string(from), string(to), strconv.Uitoa(timeoutSecs))
+    if err != nil {
+        return nil, err
     }
-    return nil
+
+    // a timeout is reported as a nil multi-bulk
+    if res == nil {
+        return nil, nil
+    }
+    return bulkReply("BLMOVE", res)
 }
 
-func (self *client) Hmset(key string, mapping interface{}) os.Error {
-    args := new(vector.StringVector)
-    args.Push(key)
-    err := containerToString(reflect.ValueOf(mapping), args)
+// Pops up to count elements from the first non-empty list among keys.
+// Returns the key popped from and the elements, or a nil key if every
+// list is empty.
+func (self *client) Lmpop(keys []string, from ListSide, count int) (*string, [][]byte, os.Error) {
+    return self.lmpop("LMPOP", "", keys, from, count)
+}
+
+// Blocking version of Lmpop. Returns a nil key if the timeout expires.
+func (self *client) Blmpop(keys []string, from ListSide, count int, timeoutSecs uint) (*string, [][]byte, os.Error) {
+    return self.lmpop("BLMPOP", strconv.Uitoa(timeoutSecs), keys, from, count)
+}
+
+func (self *client) lmpop(cmd string, timeout string, keys []string, from ListSide, count int) (*string, [][]byte, os.Error) {
+    var args []string
+    if timeout != "" {
+        args = append(args, timeout)
+    }
+    args = append(args, strconv.Itoa(len(keys)))
+    args = append(args, keys...)
+    args = append(args, string(from), "COUNT", strconv.Itoa(count))
+
+    res, err := self.sendCommand(cmd, args...)
     if err != nil {
-        return err
+        return nil, nil, err
     }
-    _, err = self.sendCommand("HMSET", *args...)
+
+    // reply is [key, [elem ...]], or a nil multi-bulk if nothing was popped
+    if res == nil {
+        return nil, nil, nil
+    }
+    kv, ok := res.([]interface{})
+    if !ok || len(kv) != 2 {
+        return nil, nil, &UnexpectedReplyError{cmd, res}
+    }
+    key, err := bulkReply(cmd, kv[0])
     if err != nil {
-        return err
+        return nil, nil, err
     }
-    return nil
+    vals, err := multiBulkReply(cmd, kv[1])
+    if err != nil {
+        return nil, nil, err
+    }
+    k := string(key)
+    return &k, vals, nil
 }
 
-func (self *client) Hincrby(key string, field string, val int64) (int64, os.Error) {
-    res, err := self.sendCommand("HINCRBY", key, field, strconv.Itoa64(val))
+// Set commands
+
+// Adds the values to the set, returning the number that were not
+// already members.
+func (self *client) Sadd(key string, values ...[]byte) (int, os.Error) {
+    res, err := self.sendCommand("SADD", valueArgs(key, values)...)
+
     if err != nil {
         return -1, err
     }
 
-    return res.(int64), nil
+    n, err := intReply("SADD", res)
+    return int(n), err
 }
 
-func (self *client) Hexists(key string, field string) (bool, os.Error) {
-    res, err := self.sendCommand("HEXISTS", key, field)
+// Removes the values from the set, returning the number that were
+// members.
+func (self *client) Srem(key string, values ...[]byte) (int, os.Error) {
+    res, err := self.sendCommand("SREM", valueArgs(key, values)...)
+
     if err != nil {
-        return false, err
+        return -1, err
     }
-    return res.(int64) == 1, nil
+
+    n, err := intReply("SREM", res)
+    return int(n), err
 }
 
-func (self *client) Hdel(key string, field string) (bool, os.Error) {
-    res, err := self.sendCommand("HDEL", key, field)
+func (self *client) Spop(key string) ([]byte, os.Error) {
+    res, err := self.sendCommand("SPOP", key)
+    if err != nil {
+        return nil, err
+    }
+
+    return bulkReply("SPOP", res)
+}
 
+func (self *client) Smove(src string, dst string, val []byte) (bool, os.Error) {
+    res, err := self.sendCommand("SMOVE", src, dst, string(val))
     if err != nil {
         return false, err
     }
 
-    return res.(int64) == 1, nil
+    return boolReply("SMOVE", res)
 }
 
-func (self *client) Hlen(key string) (int, os.Error) {
-    res, err := self.sendCommand("HLEN", key)
+func (self *client) Scard(key string) (int, os.Error) {
+    res, err := self.sendCommand("SCARD", key)
     if err != nil {
         return -1, err
     }
 
-    return int(res.(int64)), nil
+    n, err := intReply("SCARD", res)
+    return int(n), err
+}
+
+func (self *client) Sismember(key string, value []byte) (bool, os.Error) {
+    res, err := self.sendCommand("SISMEMBER", key, string(value))
+
+    if err != nil {
+        return false, err
+    }
+
+    return boolReply("SISMEMBER", res)
+}
+
+func (self *client) Sinter(keys ...string) ([][]byte, os.Error) {
+    res, err := self.sendCommand("SINTER", keys...)
+    if err != nil {
+        return nil, err
+    }
+
+    return multiBulkReply("SINTER", res)
+}
+
+func (self *client) Sinterstore(dst string, keys ...string) (int, os.Error) {
+    args := make([]string, len(keys)+1)
+    args[0] = dst
+    copy(args[1:], keys)
+    res, err := self.sendCommand("SINTERSTORE", args...)
+    if err != nil {
+        return 0, err
+    }
+
+    n, err := intReply("SINTERSTORE", res)
+    return int(n), err
+}
+
+func (self *client) Sunion(keys ...string) ([][]byte, os.Error) {
+    res, err := self.sendCommand("SUNION", keys...)
+    if err != nil {
+        return nil, err
+    }
+
+    return multiBulkReply("SUNION", res)
+}
+
+func (self *client) Sunionstore(dst string, keys ...string) (int, os.Error) {
+    args := make([]string, len(keys)+1)
+    args[0] = dst
+    copy(args[1:], keys)
+    res, err := self.sendCommand("SUNIONSTORE", args...)
+    if err != nil {
+        return 0, err
+    }
+
+    n, err := intReply("SUNIONSTORE", res)
+    return int(n), err
+}
+
+func (self *client) Sdiff(key1 string, keys []string) ([][]byte, os.Error) {
+    args := make([]string, len(keys)+1)
+    args[0] = key1
+    copy(args[1:], keys)
+    res, err := self.sendCommand("SDIFF", args...)
+    if err != nil {
+        return nil, err
+    }
+
+    return multiBulkReply("SDIFF", res)
+}
+
+func (self *client) Sdiffstore(dst string, key1 string, keys []string) (int, os.Error) {
+    args := make([]string, len(keys)+2)
+    args[0] = dst
+    args[1] = key1
+    copy(args[2:], keys)
+    res, err := self.sendCommand("SDIFFSTORE", args...)
+    if err != nil {
+        return 0, err
+    }
+
+    n, err := intReply("SDIFFSTORE", res)
+    return int(n), err
+}
+
+func (self *client) Smembers(key string) ([][]byte, os.Error) {
+    res, err := self.sendCommand("SMEMBERS", key)
+
+    if err != nil {
+        return nil, err
+    }
+
+    return multiBulkReply("SMEMBERS", res)
+}
+
+func (self *client) Srandmember(key string) ([]byte, os.Error) {
+    res, err := self.sendCommand("SRANDMEMBER", key)
+    if err != nil {
+        return nil, err
+    }
+
+    return bulkReply("SRANDMEMBER", res)
+}
+
+// sorted set commands
+
+// A sorted set member along with its score, as returned by the
+// WITHSCORES variants of the range commands.
+type ScoredMember struct {
+    Member []byte
+    Score  float64
+}
+
+// An endpoint of a score range. Bounds are inclusive unless Exclusive
+// is set, and may be infinite (see MinScore and MaxScore).
+type ScoreBound struct {
+    Score     float64
+    Exclusive bool
+}
+
+var (
+    MinScore = ScoreBound{math.Inf(-1), false}
+    MaxScore = ScoreBound{math.Inf(1), false}
+)
+
+func Inclusive(score float64) ScoreBound { return ScoreBound{score, false} }
+
+func Exclusive(score float64) ScoreBound { return ScoreBound{score, true} }
+
+func (b ScoreBound) String() string {
+    switch {
+    case math.IsInf(b.Score, -1):
+        return "-inf"
+    case math.IsInf(b.Score, 1):
+        return "+inf"
+    }
+    s := strconv.Ftoa64(b.Score, 'f', -1)
+    if b.Exclusive {
+        return "(" + s
+    }
+    return s
+}
+
+// An endpoint of a lexicographical range, i.e. "[a", "(a", "-" or "+".
+type LexBound string
+
+const (
+    MinLex LexBound = "-"
+    MaxLex LexBound = "+"
+)
+
+func InclusiveLex(member []byte) LexBound { return LexBound("[" + string(member)) }
+
+func ExclusiveLex(member []byte) LexBound { return LexBound("(" + string(member)) }
+
+// converts a flat member/score reply into ScoredMembers
+func scoredMembers(data [][]byte) ([]ScoredMember, os.Error) {
+    ret := make([]ScoredMember, len(data)/2)
+    for i := range ret {
+        score, err := strconv.Atof64(string(data[i*2+1]))
+        if err != nil {
+            return nil, err
+        }
+        ret[i] = ScoredMember{data[i*2], score}
+    }
+    return ret, nil
+}
+
+// appends the optional LIMIT clause. An offset of 0 with a negative
+// count means no limit.
+func limitArgs(args []string, offset int, count int) []string {
+    if offset == 0 && count < 0 {
+        return args
+    }
+    return append(args, "LIMIT", strconv.Itoa(offset), strconv.Itoa(count))
+}
+
+// Flags modifying the behaviour of Zadd and Zaddincr. They may be or'ed
+// together, e.g. ZaddXX | ZaddGT | ZaddCH.
+type ZaddFlags int
+
+const (
+    ZaddNX ZaddFlags = 1 << iota // only add new members
+    ZaddXX                       // only update existing members
+    ZaddGT                       // only update scores that increase
+    ZaddLT                       // only update scores that decrease
+    ZaddCH                       // count changed members as well as added ones
+)
+
+func zaddArgs(key string, flags ZaddFlags) []string {
+    args := []string{key}
+    if flags&ZaddNX != 0 {
+        args = append(args, "NX")
+    }
+    if flags&ZaddXX != 0 {
+        args = append(args, "XX")
+    }
+    if flags&ZaddGT != 0 {
+        args = append(args, "GT")
+    }
+    if flags&ZaddLT != 0 {
+        args = append(args, "LT")
+    }
+    if flags&ZaddCH != 0 {
+        args = append(args, "CH")
+    }
+    return args
+}
+
+// Adds or updates the given members. Returns the number of members
+// added, or with ZaddCH the number of members added or changed.
+func (self *client) Zadd(key string, flags ZaddFlags, members ...ScoredMember) (int, os.Error) {
+    args := zaddArgs(key, flags)
+    for _, m := range members {
+        args = append(args, strconv.Ftoa64(m.Score, 'f', -1), string(m.Member))
+    }
+    res, err := self.sendCommand("ZADD", args...)
+    if err != nil {
+        return -1, err
+    }
+
+    n, err := intReply("ZADD", res)
+    return int(n), err
+}
+
+// ZADD in INCR mode. Returns the member's new score, or false if the
+// flags prevented the update.
+func (self *client) Zaddincr(key string, flags ZaddFlags, member []byte, incr float64) (float64, bool, os.Error) {
+    args := append(zaddArgs(key, flags), "INCR", strconv.Ftoa64(incr, 'f', -1), string(member))
+    res, err := self.sendCommand("ZADD", args...)
+    if err != nil {
+        return 0, false, err
+    }
+    if res == nil {
+        return 0, false, nil
+    }
+
+    f, err := floatReply("ZADD", res)
+    if err != nil {
+        return 0, false, err
+    }
+    return f, true, nil
+}
+
+func (self *client) Zrem(key string, value []byte) (bool, os.Error) {
+    res, err := self.sendCommand("ZREM", key, string(value))
+    if err != nil {
+        return false, err
+    }
+
+    return boolReply("ZREM", res)
+}
+
+func (self *client) Zincrby(key string, value []byte, score float64) (float64, os.Error) {
+    res, err := self.sendCommand("ZINCRBY", key, strconv.Ftoa64(score, 'f', -1), string(value))
+    if err != nil {
+        return 0, err
+    }
+
+    return floatReply("ZINCRBY", res)
+}
+
+func (self *client) Zrank(key string, value []byte) (int, os.Error) {
+    res, err := self.sendCommand("ZRANK", key, string(value))
+    if err != nil {
+        return 0, err
+    }
+
+    n, err := intReply("ZRANK", res)
+    return int(n), err
+}
+
+func (self *client) Zrevrank(key string, value []byte) (int, os.Error) {
+    res, err := self.sendCommand("ZREVRANK", key, string(value))
+    if err != nil {
+        return 0, err
+    }
+
+    n, err := intReply("ZREVRANK", res)
+    return int(n), err
+}
+
+func (self *client) Zrange(key string, start int, end int) ([][]byte, os.Error) {
+    res, err := self.sendCommand("ZRANGE", key, strconv.Itoa(start), strconv.Itoa(end))
+    if err != nil {
+        return nil, err
+    }
+
+    return multiBulkReply("ZRANGE", res)
+}
+
+func (self *client) Zrevrange(key string, start int, end int) ([][]byte, os.Error) {
+    res, err := self.sendCommand("ZREVRANGE", key, strconv.Itoa(start), strconv.Itoa(end))
+    if err != nil {
+        return nil, err
+    }
+
+    return multiBulkReply("ZREVRANGE", res)
+}
+
+func (self *client) ZrangeWithScores(key string, start int, end int) ([]ScoredMember, os.Error) {
+    res, err := self.sendCommand("ZRANGE", key, strconv.Itoa(start), strconv.Itoa(end), "WITHSCORES")
+    if err != nil {
+        return nil, err
+    }
+
+    data, err := multiBulkReply("ZRANGE", res)
+    if err != nil {
+        return nil, err
+    }
+    return scoredMembers(data)
+}
+
+func (self *client) ZrevrangeWithScores(key string, start int, end int) ([]ScoredMember, os.Error) {
+    res, err := self.sendCommand("ZREVRANGE", key, strconv.Itoa(start), strconv.Itoa(end), "WITHSCORES")
+    if err != nil {
+        return nil, err
+    }
+
+    data, err := multiBulkReply("ZREVRANGE", res)
+    if err != nil {
+        return nil, err
+    }
+    return scoredMembers(data)
+}
+
+// Returns the members with scores between min and max. Pass an offset of
+// 0 and a negative count to return every match.
+func (self *client) Zrangebyscore(key string, min ScoreBound, max ScoreBound, offset int, count int) ([][]byte, os.Error) {
+    args := limitArgs([]string{key, min.String(), max.String()}, offset, count)
+    res, err := self.sendCommand("ZRANGEBYSCORE", args...)
+    if err != nil {
+        return nil, err
+    }
+
+    return multiBulkReply("ZRANGEBYSCORE", res)
+}
+
+func (self *client) ZrangebyscoreWithScores(key string, min ScoreBound, max ScoreBound, offset int, count int) ([]ScoredMember, os.Error) {
+    args := limitArgs([]string{key, min.String(), max.String(), "WITHSCORES"}, offset, count)
+    res, err := self.sendCommand("ZRANGEBYSCORE", args...)
+    if err != nil {
+        return nil, err
+    }
+
+    data, err := multiBulkReply("ZRANGEBYSCORE", res)
+    if err != nil {
+        return nil, err
+    }
+    return scoredMembers(data)
+}
+
+// Like Zrangebyscore, but in descending order. Note that max comes
+// before min, as it does in redis.
+func (self *client) Zrevrangebyscore(key string, max ScoreBound, min ScoreBound, offset int, count int) ([][]byte, os.Error) {
+    args := limitArgs([]string{key, max.String(), min.String()}, offset, count)
+    res, err := self.sendCommand("ZREVRANGEBYSCORE", args...)
+    if err != nil {
+        return nil, err
+    }
+
+    return multiBulkReply("ZREVRANGEBYSCORE", res)
+}
+
+func (self *client) ZrevrangebyscoreWithScores(key string, max ScoreBound, min ScoreBound, offset int, count int) ([]ScoredMember, os.Error) {
+    args := limitArgs([]string{key, max.String(), min.String(), "WITHSCORES"}, offset, count)
+    res, err := self.sendCommand("ZREVRANGEBYSCORE", args...)
+    if err != nil {
+        return nil, err
+    }
+
+    data, err := multiBulkReply("ZREVRANGEBYSCORE", res)
+    if err != nil {
+        return nil, err
+    }
+    return scoredMembers(data)
+}
+
+func (self *client) Zcount(key string, min ScoreBound, max ScoreBound) (int, os.Error) {
+    res, err := self.sendCommand("ZCOUNT", key, min.String(), max.String())
+    if err != nil {
+        return -1, err
+    }
+
+    n, err := intReply("ZCOUNT", res)
+    return int(n), err
+}
+
+func (self *client) Zrangebylex(key string, min LexBound, max LexBound, offset int, count int) ([][]byte, os.Error) {
+    args := limitArgs([]string{key, string(min), string(max)}, offset, count)
+    res, err := self.sendCommand("ZRANGEBYLEX", args...)
+    if err != nil {
+        return nil, err
+    }
+
+    return multiBulkReply("ZRANGEBYLEX", res)
+}
+
+func (self *client) Zlexcount(key string, min LexBound, max LexBound) (int, os.Error) {
+    res, err := self.sendCommand("ZLEXCOUNT", key, string(min), string(max))
+    if err != nil {
+        return -1, err
+    }
+
+    n, err := intReply("ZLEXCOUNT", res)
+    return int(n), err
+}
+
+func (self *client) Zcard(key string) (int, os.Error) {
+    res, err := self.sendCommand("ZCARD", key)
+    if err != nil {
+        return -1, err
+    }
+
+    n, err := intReply("ZCARD", res)
+    return int(n), err
+}
+
+func (self *client) Zscore(key string, member []byte) (float64, os.Error) {
+    res, err := self.sendCommand("ZSCORE", key, string(member))
+    if err != nil {
+        return 0, err
+    }
+
+    return floatReply("ZSCORE", res)
+}
+
+// Returns the scores of the given members, with nil for members that
+// are not in the set.
+func (self *client) Zmscore(key string, members ...[]byte) ([]*float64, os.Error) {
+    res, err := self.sendCommand("ZMSCORE", valueArgs(key, members)...)
+    if err != nil {
+        return nil, err
+    }
+
+    data, err := multiBulkReply("ZMSCORE", res)
+    if err != nil {
+        return nil, err
+    }
+    ret := make([]*float64, len(data))
+    for i, d := range data {
+        if d == nil {
+            continue
+        }
+        f, err := floatReply("ZMSCORE", d)
+        if err != nil {
+            return nil, err
+        }
+        ret[i] = &f
+    }
+    return ret, nil
+}
+
+func (self *client) Zpopmin(key string, count int) ([]ScoredMember, os.Error) {
+    return self.zpop("ZPOPMIN", key, count)
+}
+
+func (self *client) Zpopmax(key string, count int) ([]ScoredMember, os.Error) {
+    return self.zpop("ZPOPMAX", key, count)
+}
+
+func (self *client) zpop(cmd string, key string, count int) ([]ScoredMember, os.Error) {
+    res, err := self.sendCommand(cmd, key, strconv.Itoa(count))
+    if err != nil {
+        return nil, err
+    }
+
+    data, err := multiBulkReply(cmd, res)
+    if err != nil {
+        return nil, err
+    }
+    return scoredMembers(data)
+}
+
+func (self *client) Bzpopmin(keys []string, timeoutSecs uint) (*string, *ScoredMember, os.Error) {
+    return self.bzpop("BZPOPMIN", keys, timeoutSecs)
+}
+
+func (self *client) Bzpopmax(keys []string, timeoutSecs uint) (*string, *ScoredMember, os.Error) {
+    return self.bzpop("BZPOPMAX", keys, timeoutSecs)
+}
+
+func (self *client) bzpop(cmd string, keys []string, timeoutSecs uint) (*string, *ScoredMember, os.Error) {
+    args := append(keys, strconv.Uitoa(timeoutSecs))
+    res, err := self.sendCommand(cmd, args...)
+    if err != nil {
+        return nil, nil, err
+    }
+    data, err := multiBulkReply(cmd, res)
+    if err != nil {
+        return nil, nil, err
+    }
+    // Check for timeout
+    if len(data) != 3 {
+        return nil, nil, nil
+    }
+    members, err := scoredMembers(data[1:])
+    if err != nil {
+        return nil, nil, err
+    }
+    k := string(data[0])
+    return &k, &members[0], nil
+}
+
+func (self *client) Zremrangebyrank(key string, start int, end int) (int, os.Error) {
+    res, err := self.sendCommand("ZREMRANGEBYRANK", key, strconv.Itoa(start), strconv.Itoa(end))
+    if err != nil {
+        return -1, err
+    }
+
+    n, err := intReply("ZREMRANGEBYRANK", res)
+    return int(n), err
+}
+
+func (self *client) Zremrangebyscore(key string, start float64, end float64) (int, os.Error) {
+    res, err := self.sendCommand("ZREMRANGEBYSCORE", key, strconv.Ftoa64(start, 'f', -1), strconv.Ftoa64(end, 'f', -1))
+    if err != nil {
+        return -1, err
+    }
+
+    n, err := intReply("ZREMRANGEBYSCORE", res)
+    return int(n), err
+}
+
+// geo commands
+
+// A distance unit for the geo commands.
+type GeoUnit string
+
+const (
+    Meters     GeoUnit = "m"
+    Kilometers GeoUnit = "km"
+    Miles      GeoUnit = "mi"
+    Feet       GeoUnit = "ft"
+)
+
+type GeoPos struct {
+    Longitude float64
+    Latitude  float64
+}
+
+// A member of a geo set along with its position, for Geoadd.
+type GeoMember struct {
+    Member []byte
+    Pos    GeoPos
+}
+
+// A member found by Geosearch. Dist is the distance from the center of
+// the search, in the search's unit, and Hash is the member's score in the
+// underlying sorted set.
+type GeoLocation struct {
+    Member []byte
+    Dist   float64
+    Hash   int64
+    Pos    GeoPos
+}
+
+// Adds or updates the given members. flags may include ZaddNX, ZaddXX and
+// ZaddCH, which work as they do for Zadd. Returns the number of members
+// added.
+func (self *client) Geoadd(key string, flags ZaddFlags, members ...GeoMember) (int, os.Error) {
+    args := zaddArgs(key, flags)
+    for _, m := range members {
+        args = append(args, strconv.Ftoa64(m.Pos.Longitude, 'f', -1), strconv.Ftoa64(m.Pos.Latitude, 'f', -1), string(m.Member))
+    }
+    res, err := self.sendCommand("GEOADD", args...)
+    if err != nil {
+        return -1, err
+    }
+
+    n, err := intReply("GEOADD", res)
+    return int(n), err
+}
+
+// Returns the distance between two members, or ErrNil if either is
+// missing.
+func (self *client) Geodist(key string, member1 []byte, member2 []byte, unit GeoUnit) (float64, os.Error) {
+    res, err := self.sendCommand("GEODIST", key, string(member1), string(member2), string(unit))
+    if err != nil {
+        return 0, err
+    }
+
+    return floatReply("GEODIST", res)
+}
+
+func geoPos(cmd string, reply interface{}) (GeoPos, os.Error) {
+    coords, err := multiBulkReply(cmd, reply)
+    if err != nil {
+        return GeoPos{}, err
+    }
+    if len(coords) != 2 {
+        return GeoPos{}, &UnexpectedReplyError{cmd, reply}
+    }
+    lon, err1 := strconv.Atof64(string(coords[0]))
+    lat, err2 := strconv.Atof64(string(coords[1]))
+    if err1 != nil || err2 != nil {
+        return GeoPos{}, &UnexpectedReplyError{cmd, reply}
+    }
+    return GeoPos{lon, lat}, nil
+}
+
+// Returns the positions of the members in order, with nil for members
+// that don't exist.
+func (self *client) Geopos(key string, members ...[]byte) ([]*GeoPos, os.Error) {
+    res, err := self.sendCommand("GEOPOS", valueArgs(key, members)...)
+    if err != nil {
+        return nil, err
+    }
+
+    items, err := valuesReply("GEOPOS", res)
+    if err != nil {
+        return nil, err
+    }
+    positions := make([]*GeoPos, len(items))
+    for i, item := range items {
+        if item == nil {
+            continue
+        }
+        pos, err := geoPos("GEOPOS", item)
+        if err != nil {
+            return nil, err
+        }
+        positions[i] = &pos
+    }
+    return positions, nil
+}
+
+// A query for Geosearch and Geosearchstore. The search is centered on
+// Member if it's set, or on Pos otherwise, and covers a circle of Radius
+// if it's positive, or a Width by Height box otherwise. Results are in
+// no particular order unless Sort is "ASC" or "DESC", by distance. If
+// Count is positive, only that many results are returned; with Any,
+// redis returns as soon as it finds enough, rather than the closest.
+type GeoQuery struct {
+    Member []byte
+    Pos    GeoPos
+    Radius float64
+    Width  float64
+    Height float64
+    Unit   GeoUnit
+    Sort   string
+    Count  int
+    Any    bool
+}
+
+func (q *GeoQuery) args(args []string) []string {
+    if q.Member != nil {
+        args = append(args, "FROMMEMBER", string(q.Member))
+    } else {
+        args = append(args, "FROMLONLAT", strconv.Ftoa64(q.Pos.Longitude, 'f', -1), strconv.Ftoa64(q.Pos.Latitude, 'f', -1))
+    }
+    if q.Radius > 0 {
+        args = append(args, "BYRADIUS", strconv.Ftoa64(q.Radius, 'f', -1), string(q.Unit))
+    } else {
+        args = append(args, "BYBOX", strconv.Ftoa64(q.Width, 'f', -1), strconv.Ftoa64(q.Height, 'f', -1), string(q.Unit))
+    }
+    if q.Sort != "" {
+        args = append(args, q.Sort)
+    }
+    if q.Count > 0 {
+        args = append(args, "COUNT", strconv.Itoa(q.Count))
+        if q.Any {
+            args = append(args, "ANY")
+        }
+    }
+    return args
+}
+
+// Returns the members within the area searched, along with their
+// distances, hashes and positions.
+func (self *client) Geosearch(key string, q *GeoQuery) ([]GeoLocation, os.Error) {
+    args := q.args([]string{key})
+    res, err := self.sendCommand("GEOSEARCH", append(args, "WITHDIST", "WITHHASH", "WITHCOORD")...)
+    if err != nil {
+        return nil, err
+    }
+
+    items, err := valuesReply("GEOSEARCH", res)
+    if err != nil {
+        return nil, err
+    }
+    locations := make([]GeoLocation, len(items))
+    for i, item := range items {
+        // [member, dist, hash, [lon, lat]]
+        fields, ok := item.([]interface{})
+        if !ok || len(fields) != 4 {
+            return nil, &UnexpectedReplyError{"GEOSEARCH", res}
+        }
+        loc := &locations[i]
+        if loc.Member, err = bulkReply("GEOSEARCH", fields[0]); err != nil {
+            return nil, err
+        }
+        if loc.Dist, err = floatReply("GEOSEARCH", fields[1]); err != nil {
+            return nil, err
+        }
+        if loc.Hash, err = intReply("GEOSEARCH", fields[2]); err != nil {
+            return nil, err
+        }
+        if loc.Pos, err = geoPos("GEOSEARCH", fields[3]); err != nil {
+            return nil, err
+        }
+    }
+    return locations, nil
+}
+
+// Like Geosearch, but stores the members found in dst, another geo set.
+// With storeDist, dst is a plain sorted set with the distances as scores
+// instead. Returns the number of members stored.
+func (self *client) Geosearchstore(dst string, src string, q *GeoQuery, storeDist bool) (int, os.Error) {
+    args := q.args([]string{dst, src})
+    if storeDist {
+        args = append(args, "STOREDIST")
+    }
+    res, err := self.sendCommand("GEOSEARCHSTORE", args...)
+    if err != nil {
+        return -1, err
+    }
+
+    n, err := intReply("GEOSEARCHSTORE", res)
+    return int(n), err
+}
+
+// hash commands
+
+func (self *client) Hset(key string, field string, val []byte) (bool, os.Error) {
+    res, err := self.sendCommand("HSET", key, field, string(val))
+    if err != nil {
+        return false, err
+    }
+
+    return boolReply("HSET", res)
+}
+
+func (self *client) Hget(key string, field string) ([]byte, os.Error) {
+    res, err := self.sendCommand("HGET", key, field)
+    if err != nil {
+        return nil, err
+    }
+
+    return bulkReply("HGET", res)
+}
+
+// Returns the values of the given fields, in the same order. Fields that
+// do not exist in the hash have a nil value.
+func (self *client) Hmget(key string, fields ...string) ([][]byte, os.Error) {
+    args := make([]string, len(fields)+1)
+    args[0] = key
+    copy(args[1:], fields)
+    res, err := self.sendCommand("HMGET", args...)
+    if err != nil {
+        return nil, err
+    }
+
+    return multiBulkReply("HMGET", res)
+}
+
+//pretty much copy the json code from here.
+
+func valueToString(v reflect.Value) (string, os.Error) {
+    if !v.IsValid() {
+        return "null", nil
+    }
+
+    switch v.Kind() {
+    case reflect.Ptr:
+        return valueToString(reflect.Indirect(v))
+    case reflect.Interface:
+        return valueToString(v.Elem())
+    case reflect.Bool:
+        x := v.Bool()
+        if x {
+            return "true", nil
+        } else {
+            return "false", nil
+        }
+
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+        return strconv.Itoa64(v.Int()), nil
+    case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+        return strconv.Uitoa64(v.Uint()), nil
+    case reflect.UnsafePointer:
+        return strconv.Uitoa64(uint64(v.Pointer())), nil
+
+    case reflect.Float32, reflect.Float64:
+        return strconv.Ftoa64(v.Float(), 'g', -1), nil
+
+    case reflect.String:
+        return v.String(), nil
+
+    case reflect.Slice:
+        if v.Type().Elem().Kind() == reflect.Uint8 {
+            return string(v.Bytes()), nil
+        }
+    }
+    return "", os.NewError("Unsupported type")
+}
+
+func containerToString(val reflect.Value, args *vector.StringVector) os.Error {
+    switch v := val; v.Kind() {
+    case reflect.Ptr:
+        return containerToString(reflect.Indirect(v), args)
+    case reflect.Interface:
+        return containerToString(v.Elem(), args)
+    case reflect.Map:
+        if v.Type().Key().Kind() != reflect.String {
+            return os.NewError("Unsupported type - map key must be a string")
+        }
+        for _, k := range v.MapKeys() {
+            args.Push(k.String())
+            s, err := valueToString(v.MapIndex(k))
+            if err != nil {
+                return err
+            }
+            args.Push(s)
+        }
+    case reflect.Struct:
+        st := v.Type()
+        for i := 0; i < st.NumField(); i++ {
+            ft := st.FieldByIndex([]int{i})
+            args.Push(ft.Name)
+            s, err := valueToString(v.FieldByIndex([]int{i}))
+            if err != nil {
+                return err
+            }
+            args.Push(s)
+        }
+    }
+    return nil
+}
+
+func (self *client) Hmset(key string, mapping interface{}) os.Error {
+    args := new(vector.StringVector)
+    args.Push(key)
+    err := containerToString(reflect.ValueOf(mapping), args)
+    if err != nil {
+        return err
+    }
+    _, err = self.sendCommand("HMSET", *args...)
+    if err != nil {
+        return err
+    }
+    return nil
+}
+
+func (self *client) Hincrby(key string, field string, val int64) (int64, os.Error) {
+    res, err := self.sendCommand("HINCRBY", key, field, strconv.Itoa64(val))
+    if err != nil {
+        return -1, err
+    }
+
+    return intReply("HINCRBY", res)
+}
+
+func (self *client) Hexists(key string, field string) (bool, os.Error) {
+    res, err := self.sendCommand("HEXISTS", key, field)
+    if err != nil {
+        return false, err
+    }
+    return boolReply("HEXISTS", res)
+}
+
+// Removes the fields from the hash, returning the number that existed.
+func (self *client) Hdel(key string, fields ...string) (int, os.Error) {
+    args := make([]string, len(fields)+1)
+    args[0] = key
+    copy(args[1:], fields)
+    res, err := self.sendCommand("HDEL", args...)
+
+    if err != nil {
+        return -1, err
+    }
+
+    n, err := intReply("HDEL", res)
+    return int(n), err
+}
+
+func (self *client) Hlen(key string) (int, os.Error) {
+    res, err := self.sendCommand("HLEN", key)
+    if err != nil {
+        return -1, err
+    }
+
+    n, err := intReply("HLEN", res)
+    return int(n), err
 }
 
 func (self *client) Hkeys(key string) ([]string, os.Error) {
@@ -1152,232 +2984,1760 @@ func (self *client) Hkeys(key string) ([]string, os.Error) {
         return nil, err
     }
 
-    data := res.([][]byte)
-    ret := make([]string, len(data))
-    for i, k := range data {
-        ret[i] = string(k)
-    }
-    return ret, nil
+    data, err := multiBulkReply("HKEYS", res)
+    if err != nil {
+        return nil, err
+    }
+    ret := make([]string, len(data))
+    for i, k := range data {
+        ret[i] = string(k)
+    }
+    return ret, nil
+}
+
+func (self *client) Hvals(key string) ([][]byte, os.Error) {
+    res, err := self.sendCommand("HVALS", key)
+
+    if err != nil {
+        return nil, err
+    }
+    return multiBulkReply("HVALS", res)
+}
+
+func writeTo(data []byte, val reflect.Value) os.Error {
+    s := string(data)
+    switch v := val; v.Kind() {
+    // if we're writing to an interace value, just set the byte data
+    // TODO: should we support writing to a pointer?
+    case reflect.Interface:
+        v.Set(reflect.ValueOf(data))
+    case reflect.Bool:
+        b, err := strconv.Atob(s)
+        if err != nil {
+            return err
+        }
+        v.SetBool(b)
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+        i, err := strconv.Atoi64(s)
+        if err != nil {
+            return err
+        }
+        v.SetInt(i)
+    case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+        ui, err := strconv.Atoui64(s)
+        if err != nil {
+            return err
+        }
+        v.SetUint(ui)
+    case reflect.Float32, reflect.Float64:
+        f, err := strconv.Atof64(s)
+        if err != nil {
+            return err
+        }
+        v.SetFloat(f)
+
+    case reflect.String:
+        v.SetString(s)
+    case reflect.Slice:
+        typ := v.Type()
+        if typ.Elem().Kind() == reflect.Uint || typ.Elem().Kind() == reflect.Uint8 || typ.Elem().Kind() == reflect.Uint16 || typ.Elem().Kind() == reflect.Uint32 || typ.Elem().Kind() == reflect.Uint64 || typ.Elem().Kind() == reflect.Uintptr {
+            v.Set(reflect.ValueOf(data))
+        }
+    }
+    return nil
+}
+
+func writeToContainer(data [][]byte, val reflect.Value) os.Error {
+    switch v := val; v.Kind() {
+    case reflect.Ptr:
+        return writeToContainer(data, reflect.Indirect(v))
+    case reflect.Interface:
+        return writeToContainer(data, v.Elem())
+    case reflect.Map:
+        if v.Type().Key().Kind() != reflect.String {
+            return os.NewError("Invalid map type")
+        }
+        elemtype := v.Type().Elem()
+        for i := 0; i < len(data)/2; i++ {
+            mk := reflect.ValueOf(string(data[i*2]))
+            mv := reflect.New(elemtype).Elem()
+            writeTo(data[i*2+1], mv)
+            v.SetMapIndex(mk, mv)
+        }
+    case reflect.Struct:
+        for i := 0; i < len(data)/2; i++ {
+            name := string(data[i*2])
+            field := v.FieldByName(name)
+            if !field.IsValid() || !field.CanSet() {
+                continue
+            }
+            writeTo(data[i*2+1], field)
+        }
+    default:
+        return os.NewError("Invalid container type")
+    }
+    return nil
+}
+
+
+func (self *client) Hgetall(key string, val interface{}) os.Error {
+    res, err := self.sendCommand("HGETALL", key)
+    if err != nil {
+        return err
+    }
+
+    data, err := multiBulkReply("HGETALL", res)
+    if err != nil {
+        return err
+    }
+    if len(data) == 0 {
+        return ErrNil
+    }
+    err = writeToContainer(data, reflect.ValueOf(val))
+    if err != nil {
+        return err
+    }
+
+    return nil
+}
+
+// Stream commands
+
+// An entry in a stream. Fields is nil for entries that were deleted while
+// pending in a consumer group.
+type StreamEntry struct {
+    ID     string
+    Fields map[string][]byte
+}
+
+// Decodes the entry's fields into val, a pointer to a struct or a map,
+// the same way Hgetall does.
+func (e *StreamEntry) Decode(val interface{}) os.Error {
+    data := make([][]byte, 0, len(e.Fields)*2)
+    for k, v := range e.Fields {
+        data = append(data, []byte(k), v)
+    }
+    return writeToContainer(data, reflect.ValueOf(val))
+}
+
+// Trimming for Xadd and Xtrim. Set MaxLen to keep that many entries, or
+// MinID to evict entries with lower IDs. With Approx, redis may keep some
+// extra entries when that's cheaper, evicting at most Limit entries if
+// Limit is positive.
+type StreamTrim struct {
+    MaxLen int64
+    MinID  string
+    Approx bool
+    Limit  int
+}
+
+func (t *StreamTrim) args(args []string) []string {
+    if t.MinID != "" {
+        args = append(args, "MINID")
+    } else {
+        args = append(args, "MAXLEN")
+    }
+    if t.Approx {
+        args = append(args, "~")
+    }
+    if t.MinID != "" {
+        args = append(args, t.MinID)
+    } else {
+        args = append(args, strconv.Itoa64(t.MaxLen))
+    }
+    if t.Approx && t.Limit > 0 {
+        args = append(args, "LIMIT", strconv.Itoa(t.Limit))
+    }
+    return args
+}
+
+// converts a reply of the form [[id, [field, value, ...]], ...]
+func streamEntries(cmd string, reply interface{}) ([]StreamEntry, os.Error) {
+    items, err := valuesReply(cmd, reply)
+    if err != nil {
+        return nil, err
+    }
+    entries := make([]StreamEntry, len(items))
+    for i, item := range items {
+        var id []byte
+        var fields [][]byte
+        switch pair := item.(type) {
+        case []interface{}:
+            if len(pair) != 2 {
+                return nil, &UnexpectedReplyError{cmd, reply}
+            }
+            if id, err = bulkReply(cmd, pair[0]); err != nil {
+                return nil, err
+            }
+            if fields, err = multiBulkReply(cmd, pair[1]); err != nil {
+                return nil, err
+            }
+        case [][]byte:
+            // a pending entry that was deleted from the stream comes back
+            // as [id, nil], which readResponse flattens
+            if len(pair) != 2 || pair[0] == nil || pair[1] != nil {
+                return nil, &UnexpectedReplyError{cmd, reply}
+            }
+            id = pair[0]
+        default:
+            return nil, &UnexpectedReplyError{cmd, reply}
+        }
+        entries[i].ID = string(id)
+        if fields == nil {
+            continue
+        }
+        entries[i].Fields = make(map[string][]byte, len(fields)/2)
+        for j := 0; j+1 < len(fields); j += 2 {
+            entries[i].Fields[string(fields[j])] = fields[j+1]
+        }
+    }
+    return entries, nil
+}
+
+// converts a reply of the form [[key, entries], ...] into a map of
+// stream key to entries
+func streamsReply(cmd string, reply interface{}) (map[string][]StreamEntry, os.Error) {
+    items, err := valuesReply(cmd, reply)
+    if err != nil || items == nil {
+        return nil, err
+    }
+    ret := make(map[string][]StreamEntry, len(items))
+    for _, item := range items {
+        pair, ok := item.([]interface{})
+        if !ok || len(pair) != 2 {
+            return nil, &UnexpectedReplyError{cmd, reply}
+        }
+        key, err := bulkReply(cmd, pair[0])
+        if err != nil {
+            return nil, err
+        }
+        entries, err := streamEntries(cmd, pair[1])
+        if err != nil {
+            return nil, err
+        }
+        ret[string(key)] = entries
+    }
+    return ret, nil
+}
+
+// Appends an entry to a stream, returning its ID. Pass "*" as the id to
+// have redis generate one. The fields are taken from mapping, a map or
+// struct, as they are by Hmset. With nomkstream, the entry is only added
+// if the stream exists and ErrNil is returned otherwise. trim may be nil.
+func (self *client) Xadd(key string, id string, nomkstream bool, trim *StreamTrim, mapping interface{}) (string, os.Error) {
+    args := new(vector.StringVector)
+    args.Push(key)
+    if nomkstream {
+        args.Push("NOMKSTREAM")
+    }
+    if trim != nil {
+        for _, arg := range trim.args(nil) {
+            args.Push(arg)
+        }
+    }
+    args.Push(id)
+    err := containerToString(reflect.ValueOf(mapping), args)
+    if err != nil {
+        return "", err
+    }
+    res, err := self.sendCommand("XADD", *args...)
+    if err != nil {
+        return "", err
+    }
+
+    data, err := bulkReply("XADD", res)
+    return string(data), err
+}
+
+// Returns up to count entries with IDs between start and end, which may
+// be "-" and "+" for the lowest and highest IDs. A count of 0 returns
+// every entry in the range.
+func (self *client) Xrange(key string, start string, end string, count int) ([]StreamEntry, os.Error) {
+    return self.xrange("XRANGE", key, start, end, count)
+}
+
+// Like Xrange, but in reverse order. Note that end comes before start,
+// as it does in redis.
+func (self *client) Xrevrange(key string, end string, start string, count int) ([]StreamEntry, os.Error) {
+    return self.xrange("XREVRANGE", key, end, start, count)
+}
+
+func (self *client) xrange(cmd string, key string, from string, to string, count int) ([]StreamEntry, os.Error) {
+    args := []string{key, from, to}
+    if count > 0 {
+        args = append(args, "COUNT", strconv.Itoa(count))
+    }
+    res, err := self.sendCommand(cmd, args...)
+    if err != nil {
+        return nil, err
+    }
+
+    return streamEntries(cmd, res)
+}
+
+// Reads entries with IDs greater than the given ones from each stream.
+// streams maps stream keys to IDs; use "$" to only read entries added
+// after the call. If none are available, waits up to blockMs
+// milliseconds for some, or forever if blockMs is 0. A negative blockMs
+// doesn't wait. Returns nil if the wait times out.
+func (self *client) Xread(streams map[string]string, count int, blockMs int64) (map[string][]StreamEntry, os.Error) {
+    args := []string{}
+    if count > 0 {
+        args = append(args, "COUNT", strconv.Itoa(count))
+    }
+    if blockMs >= 0 {
+        args = append(args, "BLOCK", strconv.Itoa64(blockMs))
+    }
+    args = append(args, streamsArgs("STREAMS", streams)...)
+    res, err := self.sendCommand("XREAD", args...)
+    if err != nil {
+        return nil, err
+    }
+
+    return streamsReply("XREAD", res)
+}
+
+// builds "STREAMS key ... id ..." from a map of key to id
+func streamsArgs(keyword string, streams map[string]string) []string {
+    args := make([]string, len(streams)*2+1)
+    args[0] = keyword
+    i := 1
+    for key, id := range streams {
+        args[i] = key
+        args[i+len(streams)] = id
+        i++
+    }
+    return args
+}
+
+func (self *client) Xlen(key string) (int, os.Error) {
+    res, err := self.sendCommand("XLEN", key)
+    if err != nil {
+        return -1, err
+    }
+
+    n, err := intReply("XLEN", res)
+    return int(n), err
+}
+
+// Deletes entries from a stream, returning the number deleted.
+func (self *client) Xdel(key string, ids ...string) (int, os.Error) {
+    args := make([]string, len(ids)+1)
+    args[0] = key
+    copy(args[1:], ids)
+    res, err := self.sendCommand("XDEL", args...)
+    if err != nil {
+        return -1, err
+    }
+
+    n, err := intReply("XDEL", res)
+    return int(n), err
+}
+
+// Trims a stream, returning the number of entries evicted.
+func (self *client) Xtrim(key string, trim StreamTrim) (int, os.Error) {
+    res, err := self.sendCommand("XTRIM", trim.args([]string{key})...)
+    if err != nil {
+        return -1, err
+    }
+
+    n, err := intReply("XTRIM", res)
+    return int(n), err
+}
+
+// Creates a consumer group that reads entries after id, which may be "$"
+// for the stream's last entry. With mkstream, the stream is created if it
+// doesn't exist.
+func (self *client) XgroupCreate(key string, group string, id string, mkstream bool) os.Error {
+    args := []string{"CREATE", key, group, id}
+    if mkstream {
+        args = append(args, "MKSTREAM")
+    }
+    _, err := self.sendCommand("XGROUP", args...)
+    return err
+}
+
+func (self *client) XgroupDestroy(key string, group string) (bool, os.Error) {
+    res, err := self.sendCommand("XGROUP", "DESTROY", key, group)
+    if err != nil {
+        return false, err
+    }
+
+    return boolReply("XGROUP", res)
+}
+
+func xreadgroupArgs(group string, consumer string, streams map[string]string, count int, blockMs int64, noack bool) []string {
+    args := []string{"GROUP", group, consumer}
+    if count > 0 {
+        args = append(args, "COUNT", strconv.Itoa(count))
+    }
+    if blockMs >= 0 {
+        args = append(args, "BLOCK", strconv.Itoa64(blockMs))
+    }
+    if noack {
+        args = append(args, "NOACK")
+    }
+    return append(args, streamsArgs("STREAMS", streams)...)
+}
+
+// Like Xread, but reads as consumer in group. Use ">" as the id to read
+// entries never delivered to the group, or another id to read this
+// consumer's pending entries after it. Entries read stay pending until
+// they're acknowledged with Xack, unless noack is set.
+func (self *client) Xreadgroup(group string, consumer string, streams map[string]string, count int, blockMs int64, noack bool) (map[string][]StreamEntry, os.Error) {
+    res, err := self.sendCommand("XREADGROUP", xreadgroupArgs(group, consumer, streams, count, blockMs, noack)...)
+    if err != nil {
+        return nil, err
+    }
+
+    return streamsReply("XREADGROUP", res)
+}
+
+// Acknowledges entries, removing them from the group's pending entries.
+// Returns the number acknowledged.
+func (self *client) Xack(key string, group string, ids ...string) (int, os.Error) {
+    args := make([]string, len(ids)+2)
+    args[0] = key
+    args[1] = group
+    copy(args[2:], ids)
+    res, err := self.sendCommand("XACK", args...)
+    if err != nil {
+        return -1, err
+    }
+
+    n, err := intReply("XACK", res)
+    return int(n), err
+}
+
+// An entry delivered to a consumer but not yet acknowledged.
+type PendingEntry struct {
+    ID         string
+    Consumer   string
+    IdleMs     int64
+    Deliveries int64
+}
+
+// Returns up to count of a group's pending entries with IDs between start
+// and end that have been idle for at least minIdleMs milliseconds. If
+// consumer isn't empty, only its entries are returned.
+func (self *client) Xpending(key string, group string, minIdleMs int64, start string, end string, count int, consumer string) ([]PendingEntry, os.Error) {
+    args := []string{key, group}
+    if minIdleMs > 0 {
+        args = append(args, "IDLE", strconv.Itoa64(minIdleMs))
+    }
+    args = append(args, start, end, strconv.Itoa(count))
+    if consumer != "" {
+        args = append(args, consumer)
+    }
+    res, err := self.sendCommand("XPENDING", args...)
+    if err != nil {
+        return nil, err
+    }
+
+    items, err := valuesReply("XPENDING", res)
+    if err != nil {
+        return nil, err
+    }
+    pending := make([]PendingEntry, len(items))
+    for i, item := range items {
+        fields, ok := item.([][]byte)
+        if !ok || len(fields) != 4 {
+            return nil, &UnexpectedReplyError{"XPENDING", res}
+        }
+        idle, err1 := strconv.Atoi64(string(fields[2]))
+        deliveries, err2 := strconv.Atoi64(string(fields[3]))
+        if err1 != nil || err2 != nil {
+            return nil, &UnexpectedReplyError{"XPENDING", res}
+        }
+        pending[i] = PendingEntry{string(fields[0]), string(fields[1]), idle, deliveries}
+    }
+    return pending, nil
+}
+
+// Transfers pending entries that have been idle for at least minIdleMs
+// milliseconds to consumer, returning them.
+func (self *client) Xclaim(key string, group string, consumer string, minIdleMs int64, ids ...string) ([]StreamEntry, os.Error) {
+    args := make([]string, len(ids)+4)
+    args[0] = key
+    args[1] = group
+    args[2] = consumer
+    args[3] = strconv.Itoa64(minIdleMs)
+    copy(args[4:], ids)
+    res, err := self.sendCommand("XCLAIM", args...)
+    if err != nil {
+        return nil, err
+    }
+
+    return streamEntries("XCLAIM", res)
+}
+
+// Like Xclaim, but scans the pending entries from start, claiming up to
+// count of them. Returns the id to continue the scan from, which is "0-0"
+// once the scan is complete, the claimed entries, and the IDs of entries
+// that were deleted from the stream, which redis removes from the pending
+// entries.
+func (self *client) Xautoclaim(key string, group string, consumer string, minIdleMs int64, start string, count int) (string, []StreamEntry, []string, os.Error) {
+    args := []string{key, group, consumer, strconv.Itoa64(minIdleMs), start}
+    if count > 0 {
+        args = append(args, "COUNT", strconv.Itoa(count))
+    }
+    res, err := self.sendCommand("XAUTOCLAIM", args...)
+    if err != nil {
+        return "", nil, nil, err
+    }
+
+    items, err := valuesReply("XAUTOCLAIM", res)
+    if err != nil {
+        return "", nil, nil, err
+    }
+    if len(items) < 2 {
+        return "", nil, nil, &UnexpectedReplyError{"XAUTOCLAIM", res}
+    }
+    next, err := bulkReply("XAUTOCLAIM", items[0])
+    if err != nil {
+        return "", nil, nil, err
+    }
+    entries, err := streamEntries("XAUTOCLAIM", items[1])
+    if err != nil {
+        return "", nil, nil, err
+    }
+    // redis 7 adds the deleted IDs
+    var deleted []string
+    if len(items) > 2 {
+        ids, err := multiBulkReply("XAUTOCLAIM", items[2])
+        if err != nil {
+            return "", nil, nil, err
+        }
+        for _, id := range ids {
+            deleted = append(deleted, string(id))
+        }
+    }
+    return string(next), entries, deleted, nil
+}
+
+// Scripting commands
+
+// builds the arguments shared by EVAL, EVALSHA and FCALL
+func evalArgs(script string, keys []string, args []interface{}) ([]string, os.Error) {
+    sargs := make([]string, 0, len(keys)+len(args)+2)
+    sargs = append(sargs, script, strconv.Itoa(len(keys)))
+    sargs = append(sargs, keys...)
+    return interfaceArgs(sargs, args)
+}
+
+func (self *client) eval(cmd string, script string, keys []string, args []interface{}) (interface{}, os.Error) {
+    sargs, err := evalArgs(script, keys, args)
+    if err != nil {
+        return nil, err
+    }
+    return self.send(readReply, cmd, sargs...)
+}
+
+// Runs a Lua script. Arguments are formatted as they are for Do. The
+// reply is returned as read by readReply: tables come back as
+// []interface{} holding int64, string (status), []byte, RedisError, nil
+// and nested tables.
+func (self *client) Eval(script string, keys []string, args ...interface{}) (interface{}, os.Error) {
+    return self.eval("EVAL", script, keys, args)
+}
+
+// Runs a script cached on the server by its SHA1 digest, like Eval.
+func (self *client) Evalsha(sha1 string, keys []string, args ...interface{}) (interface{}, os.Error) {
+    return self.eval("EVALSHA", sha1, keys, args)
+}
+
+// Caches a script on the server, returning its SHA1 digest.
+func (self *client) ScriptLoad(script string) (string, os.Error) {
+    res, err := self.sendCommand("SCRIPT", "LOAD", script)
+    if err != nil {
+        return "", err
+    }
+
+    data, err := bulkReply("SCRIPT LOAD", res)
+    return string(data), err
+}
+
+// Reports whether each of the given scripts is cached on the server.
+func (self *client) ScriptExists(sha1s ...string) ([]bool, os.Error) {
+    args := make([]string, len(sha1s)+1)
+    args[0] = "EXISTS"
+    copy(args[1:], sha1s)
+    res, err := self.sendCommand("SCRIPT", args...)
+    if err != nil {
+        return nil, err
+    }
+
+    data, err := multiBulkReply("SCRIPT EXISTS", res)
+    if err != nil {
+        return nil, err
+    }
+    ret := make([]bool, len(data))
+    for i, d := range data {
+        ret[i] = string(d) == "1"
+    }
+    return ret, nil
+}
+
+func (self *client) ScriptFlush() os.Error {
+    _, err := self.sendCommand("SCRIPT", "FLUSH")
+    return err
+}
+
+// Kills the currently running script, provided it hasn't written
+// anything yet.
+func (self *client) ScriptKill() os.Error {
+    _, err := self.sendCommand("SCRIPT", "KILL")
+    return err
+}
+
+// Loads a library of functions, returning the library's name. If replace
+// is false, loading a library that already exists is an error.
+func (self *client) FunctionLoad(code string, replace bool) (string, os.Error) {
+    args := []string{"LOAD"}
+    if replace {
+        args = append(args, "REPLACE")
+    }
+    args = append(args, code)
+    res, err := self.sendCommand("FUNCTION", args...)
+    if err != nil {
+        return "", err
+    }
+
+    data, err := bulkReply("FUNCTION LOAD", res)
+    return string(data), err
+}
+
+func (self *client) FunctionDelete(library string) os.Error {
+    _, err := self.sendCommand("FUNCTION", "DELETE", library)
+    return err
+}
+
+func (self *client) FunctionFlush() os.Error {
+    _, err := self.sendCommand("FUNCTION", "FLUSH")
+    return err
+}
+
+// Calls a function loaded with FunctionLoad. The reply is returned as it
+// is by Eval.
+func (self *client) Fcall(function string, keys []string, args ...interface{}) (interface{}, os.Error) {
+    return self.eval("FCALL", function, keys, args)
+}
+
+// Like Fcall, for functions flagged no-writes. May be sent to replicas.
+func (self *client) FcallRo(function string, keys []string, args ...interface{}) (interface{}, os.Error) {
+    return self.eval("FCALL_RO", function, keys, args)
+}
+
+// A Lua script along with its SHA1 digest. Run sends the digest with
+// EVALSHA, and only sends the full source with EVAL if the server doesn't
+// have the script cached yet.
+type Script struct {
+    src  string
+    hash string
+}
+
+func NewScript(src string) *Script {
+    h := sha1.New()
+    h.Write([]byte(src))
+    return &Script{src, hex.EncodeToString(h.Sum())}
+}
+
+// Returns the hex SHA1 digest of the script's source.
+func (s *Script) Hash() string { return s.hash }
+
+// Caches the script on the server ahead of the first Run.
+func (s *Script) Load(c *client) os.Error {
+    _, err := c.ScriptLoad(s.src)
+    return err
+}
+
+func (s *Script) Run(c *client, keys []string, args ...interface{}) (interface{}, os.Error) {
+    res, err := c.Evalsha(s.hash, keys, args...)
+    if rerr, ok := err.(RedisError); ok && strings.HasPrefix(string(rerr), "NOSCRIPT") {
+        // EVAL caches the script, so later runs will find it
+        return c.Eval(s.src, keys, args...)
+    }
+    return res, err
+}
+
+//Publish/Subscribe
+
+// Container for messages received from publishers on channels that we're subscribed to.
+type Message struct {
+    ChannelMatched string
+    Channel        string
+    Message        []byte
+}
+
+// Subscribe to redis serve channels, this method will block until one of the sub/unsub channels are closed.
+// There are two pairs of channels subscribe/unsubscribe & psubscribe/punsubscribe.
+// The former does an exact match on the channel, the later uses glob patterns on the redis channels.
+// Closing either of these channels will unblock this method call.
+// Messages that are received are sent down the messages channel.
+// See PubSub for subscriptions that survive lost connections.
+func (self *client) Subscribe(subscribe <-chan string, unsubscribe <-chan string, psubscribe <-chan string, punsubscribe <-chan string, messages chan<- Message) os.Error {
+    cmds := make(chan []string, 0)
+    data := make(chan interface{}, 0)
+
+    go func() {
+        for {
+            var channel string
+            var cmd string
+
+            select {
+            case channel = <-subscribe:
+                cmd = "SUBSCRIBE"
+            case channel = <-unsubscribe:
+                cmd = "UNSUBSCRIBE"
+            case channel = <-psubscribe:
+                cmd = "PSUBSCRIBE"
+            case channel = <-punsubscribe:
+                cmd = "PUNSUBSCRIBE"
+
+            }
+            if channel == "" {
+                break
+            } else {
+                cmds <- []string{cmd, channel}
+            }
+        }
+        close(cmds)
+    }()
+
+    go func() {
+        for response := range data {
+            db, ok := response.([][]byte)
+            if !ok || len(db) < 3 {
+                continue
+            }
+            messageType := string(db[0])
+            switch messageType {
+            case "message":
+                channel, message := string(db[1]), db[2]
+                messages <- Message{channel, channel, message}
+            case "subscribe":
+                // Ignore
+            case "unsubscribe":
+                // Ignore
+            case "pmessage":
+                if len(db) < 4 {
+                    continue
+                }
+                channelMatched, channel, message := string(db[1]), string(db[2]), db[3]
+                messages <- Message{channelMatched, channel, message}
+            case "psubscribe":
+                // Ignore
+            case "punsubscribe":
+                // Ignore
+
+            default:
+                // log.Printf("Unknown message '%s'", messageType)
+            }
+        }
+    }()
+
+    err := self.sendCommands(cmds, data)
+    close(data)
+
+    return err
+}
+
+// A keyspace notification: Op was performed on Key in database DB. Ops
+// are command names such as "set" or "del", or events such as "expired"
+// and "evicted".
+type KeyspaceEvent struct {
+    DB  int
+    Key string
+    Op  string
+}
+
+// Returns the pattern for the keyspace channels of keys matching
+// keyPattern in database db, or in every database if db is negative.
+// Their messages are the operations.
+func KeyspacePattern(db int, keyPattern string) string {
+    return keyspaceChannel("__keyspace@", db, keyPattern)
+}
+
+// Returns the pattern for the keyevent channels of operations matching
+// opPattern in database db, or in every database if db is negative. Their
+// messages are the keys.
+func KeyeventPattern(db int, opPattern string) string {
+    return keyspaceChannel("__keyevent@", db, opPattern)
+}
+
+func keyspaceChannel(prefix string, db int, pattern string) string {
+    if db < 0 {
+        return prefix + "*__:" + pattern
+    }
+    return prefix + strconv.Itoa(db) + "__:" + pattern
+}
+
+// Decodes a message from a keyspace or keyevent channel, returning false
+// for other messages.
+func ParseKeyspaceMessage(msg Message) (KeyspaceEvent, bool) {
+    var e KeyspaceEvent
+    var keyspace bool
+    switch {
+    case strings.HasPrefix(msg.Channel, "__keyspace@"):
+        keyspace = true
+    case strings.HasPrefix(msg.Channel, "__keyevent@"):
+    default:
+        return e, false
+    }
+    rest := msg.Channel[len("__keyspace@"):]
+    i := strings.Index(rest, "__:")
+    if i < 0 {
+        return e, false
+    }
+    db, err := strconv.Atoi(rest[:i])
+    if err != nil {
+        return e, false
+    }
+    e.DB = db
+    if keyspace {
+        e.Key, e.Op = rest[i+3:], string(msg.Message)
+    } else {
+        e.Key, e.Op = string(msg.Message), rest[i+3:]
+    }
+    return e, true
+}
+
+// Subscribes to keyspace notifications on the channels matching patterns,
+// built with KeyspacePattern and KeyeventPattern, and sends them on events
+// until stop is closed. Subscribing to both kinds of channel reports each
+// operation twice. Unless flags is empty, notify-keyspace-events is set
+// to it first; "KEA", for instance, enables every notification. Blocks
+// until stop is closed, reconnecting as PubSub does.
+func (self *client) SubscribeKeyspace(flags string, patterns []string, events chan<- KeyspaceEvent, stop <-chan bool) os.Error {
+    if flags != "" {
+        err := self.ConfigSet("notify-keyspace-events", flags)
+        if err != nil {
+            return err
+        }
+    }
+
+    p, err := NewPubSub(self)
+    if err != nil {
+        return err
+    }
+    defer p.Close()
+    err = p.PSubscribe(patterns...)
+    if err != nil {
+        return err
+    }
+
+    for running := true; running; {
+        select {
+        case msg, ok := <-p.Messages():
+            if !ok {
+                return nil
+            }
+            e, ok := ParseKeyspaceMessage(msg)
+            if !ok {
+                continue
+            }
+            select {
+            case events <- e:
+            case <-stop:
+            }
+        case <-stop:
+            running = false
+        }
+    }
+    return nil
+}
+
+// Publish a message to a redis server, returning the number of
+// subscribers that received it.
+func (self *client) Publish(channel string, val []byte) (int, os.Error) {
+    res, err := self.sendCommand("PUBLISH", channel, string(val))
+    if err != nil {
+        return -1, err
+    }
+
+    n, err := intReply("PUBLISH", res)
+    return int(n), err
+}
+
+// Publishes a message to a shard channel, which in a cluster only reaches
+// the nodes of the channel's shard. Returns the number of subscribers
+// that received it.
+func (self *client) Spublish(channel string, val []byte) (int, os.Error) {
+    res, err := self.sendCommand("SPUBLISH", channel, string(val))
+    if err != nil {
+        return -1, err
+    }
+
+    n, err := intReply("SPUBLISH", res)
+    return int(n), err
+}
+
+func (self *client) pubsubChannels(sub string, pattern string) ([]string, os.Error) {
+    args := []string{sub}
+    if pattern != "" {
+        args = append(args, pattern)
+    }
+    res, err := self.sendCommand("PUBSUB", args...)
+    if err != nil {
+        return nil, err
+    }
+
+    data, err := multiBulkReply("PUBSUB", res)
+    if err != nil {
+        return nil, err
+    }
+    channels := make([]string, len(data))
+    for i, channel := range data {
+        channels[i] = string(channel)
+    }
+    return channels, nil
+}
+
+func (self *client) pubsubNumsub(sub string, channels []string) (map[string]int, os.Error) {
+    res, err := self.sendCommand("PUBSUB", append([]string{sub}, channels...)...)
+    if err != nil {
+        return nil, err
+    }
+
+    data, err := multiBulkReply("PUBSUB", res)
+    if err != nil {
+        return nil, err
+    }
+    counts := make(map[string]int, len(data)/2)
+    for i := 0; i+1 < len(data); i += 2 {
+        n, err := strconv.Atoi(string(data[i+1]))
+        if err != nil {
+            return nil, &UnexpectedReplyError{"PUBSUB", res}
+        }
+        counts[string(data[i])] = n
+    }
+    return counts, nil
+}
+
+// Returns the channels with subscribers that match pattern, or every such
+// channel if pattern is empty. Pattern subscriptions aren't included.
+func (self *client) PubsubChannels(pattern string) ([]string, os.Error) {
+    return self.pubsubChannels("CHANNELS", pattern)
+}
+
+// Returns the number of subscribers to each of the channels, not counting
+// pattern subscriptions.
+func (self *client) PubsubNumsub(channels ...string) (map[string]int, os.Error) {
+    return self.pubsubNumsub("NUMSUB", channels)
+}
+
+// Returns the number of patterns subscribed to, across all clients.
+func (self *client) PubsubNumpat() (int, os.Error) {
+    res, err := self.sendCommand("PUBSUB", "NUMPAT")
+    if err != nil {
+        return -1, err
+    }
+
+    n, err := intReply("PUBSUB", res)
+    return int(n), err
+}
+
+// Like PubsubChannels, for shard channels.
+func (self *client) PubsubShardchannels(pattern string) ([]string, os.Error) {
+    return self.pubsubChannels("SHARDCHANNELS", pattern)
+}
+
+// Like PubsubNumsub, for shard channels.
+func (self *client) PubsubShardnumsub(channels ...string) (map[string]int, os.Error) {
+    return self.pubsubNumsub("SHARDNUMSUB", channels)
+}
+
+//Server commands
+
+func (self *client) Save() os.Error {
+    _, err := self.sendCommand("SAVE")
+    if err != nil {
+        return err
+    }
+    return nil
+}
+
+func (self *client) Bgsave() os.Error {
+    _, err := self.sendCommand("BGSAVE")
+    if err != nil {
+        return err
+    }
+    return nil
+}
+
+func (self *client) Lastsave() (int64, os.Error) {
+    res, err := self.sendCommand("LASTSAVE")
+    if err != nil {
+        return 0, err
+    }
+
+    return intReply("LASTSAVE", res)
+}
+
+func (self *client) Bgrewriteaof() os.Error {
+    _, err := self.sendCommand("BGREWRITEAOF")
+    if err != nil {
+        return err
+    }
+    return nil
+}
+
+// A parsed INFO reply. Sections maps lowercase section names, such as
+// "server" or "memory", to their fields. The keyspace section's lines are
+// also decoded into Keyspace, by database number.
+type Info struct {
+    Sections map[string]map[string]string
+    Keyspace map[int]KeyspaceInfo
+}
+
+// A database's line in the keyspace section. AvgTTL is in nanoseconds.
+type KeyspaceInfo struct {
+    Keys    int64
+    Expires int64
+    AvgTTL  int64
+}
+
+// Returns the value of a field from any section, or "" if there's none.
+func (info *Info) Get(field string) string {
+    for _, fields := range info.Sections {
+        if val, ok := fields[field]; ok {
+            return val
+        }
+    }
+    return ""
+}
+
+func parseInfo(data string) *Info {
+    info := &Info{make(map[string]map[string]string), make(map[int]KeyspaceInfo)}
+    section := ""
+    for _, line := range strings.Split(data, "\n") {
+        line = strings.TrimSpace(line)
+        if line == "" {
+            continue
+        }
+        if line[0] == '#' {
+            section = strings.ToLower(strings.TrimSpace(line[1:]))
+            continue
+        }
+        i := strings.Index(line, ":")
+        if i < 0 {
+            continue
+        }
+        key, val := line[:i], line[i+1:]
+        if info.Sections[section] == nil {
+            info.Sections[section] = make(map[string]string)
+        }
+        info.Sections[section][key] = val
+
+        // db13:keys=1,expires=0,avg_ttl=0
+        if section != "keyspace" || !strings.HasPrefix(key, "db") {
+            continue
+        }
+        db, err := strconv.Atoi(key[2:])
+        if err != nil {
+            continue
+        }
+        var ks KeyspaceInfo
+        for _, pair := range strings.Split(val, ",") {
+            j := strings.Index(pair, "=")
+            if j < 0 {
+                continue
+            }
+            n, _ := strconv.Atoi64(pair[j+1:])
+            switch pair[:j] {
+            case "keys":
+                ks.Keys = n
+            case "expires":
+                ks.Expires = n
+            case "avg_ttl":
+                ks.AvgTTL = n * 1e6
+            }
+        }
+        info.Keyspace[db] = ks
+    }
+    return info
+}
+
+// Returns information about the server, from the given sections or the
+// default ones if there are none.
+func (self *client) Info(sections ...string) (*Info, os.Error) {
+    res, err := self.sendCommand("INFO", sections...)
+    if err != nil {
+        return nil, err
+    }
+
+    data, err := bulkReply("INFO", res)
+    if err != nil {
+        return nil, err
+    }
+    return parseInfo(string(data)), nil
+}
+
+// Returns the configuration parameters matching pattern, with their
+// values.
+func (self *client) ConfigGet(pattern string) (map[string]string, os.Error) {
+    res, err := self.sendCommand("CONFIG", "GET", pattern)
+    if err != nil {
+        return nil, err
+    }
+
+    config, err := StringMap(res, nil)
+    if err != nil {
+        return nil, &UnexpectedReplyError{"CONFIG", res}
+    }
+    return config, nil
+}
+
+func (self *client) ConfigSet(param string, value string) os.Error {
+    _, err := self.sendCommand("CONFIG", "SET", param, value)
+    return err
+}
+
+// Writes the running configuration to the server's config file.
+func (self *client) ConfigRewrite() os.Error {
+    _, err := self.sendCommand("CONFIG", "REWRITE")
+    return err
+}
+
+// Resets the statistics reported by Info.
+func (self *client) ConfigResetstat() os.Error {
+    _, err := self.sendCommand("CONFIG", "RESETSTAT")
+    return err
+}
+
+// A connection to the server, as listed by ClientList. Age and Idle are
+// in seconds. Fields holds every field, including ones without a struct
+// field of their own.
+type ClientInfo struct {
+    ID     int64
+    Addr   string
+    Name   string
+    Age    int64
+    Idle   int64
+    Flags  string
+    DB     int
+    Cmd    string
+    Fields map[string]string
+}
+
+func parseClientList(data string) []ClientInfo {
+    var clients []ClientInfo
+    for _, line := range strings.Split(data, "\n") {
+        line = strings.TrimSpace(line)
+        if line == "" {
+            continue
+        }
+        c := ClientInfo{Fields: make(map[string]string)}
+        for _, pair := range strings.Split(line, " ") {
+            i := strings.Index(pair, "=")
+            if i < 0 {
+                continue
+            }
+            c.Fields[pair[:i]] = pair[i+1:]
+        }
+        c.ID, _ = strconv.Atoi64(c.Fields["id"])
+        c.Addr = c.Fields["addr"]
+        c.Name = c.Fields["name"]
+        c.Age, _ = strconv.Atoi64(c.Fields["age"])
+        c.Idle, _ = strconv.Atoi64(c.Fields["idle"])
+        c.Flags = c.Fields["flags"]
+        c.DB, _ = strconv.Atoi(c.Fields["db"])
+        c.Cmd = c.Fields["cmd"]
+        clients = append(clients, c)
+    }
+    return clients
+}
+
+// Returns the connections to the server.
+func (self *client) ClientList() ([]ClientInfo, os.Error) {
+    res, err := self.sendCommand("CLIENT", "LIST")
+    if err != nil {
+        return nil, err
+    }
+
+    data, err := bulkReply("CLIENT", res)
+    if err != nil {
+        return nil, err
+    }
+    return parseClientList(string(data)), nil
+}
+
+// Closes the connection from addr, an ip:port as listed by ClientList.
+func (self *client) ClientKill(addr string) os.Error {
+    _, err := self.sendCommand("CLIENT", "KILL", addr)
+    return err
+}
+
+// Closes the connection with the given ID, returning whether it existed.
+func (self *client) ClientKillID(id int64) (bool, os.Error) {
+    res, err := self.sendCommand("CLIENT", "KILL", "ID", strconv.Itoa64(id))
+    if err != nil {
+        return false, err
+    }
+
+    return boolReply("CLIENT", res)
+}
+
+// Names the client's connections, as shown by ClientList. Pooled
+// connections are closed, and connections are named as they're opened,
+// so call this before sharing the client between goroutines. An empty
+// name removes it.
+func (self *client) ClientSetname(name string) os.Error {
+    _, err := self.sendCommand("CLIENT", "SETNAME", name)
+    if err != nil {
+        return err
+    }
+    self.lock.Lock()
+    self.name = name
+    self.lock.Unlock()
+    self.drainPool()
+    return nil
+}
+
+// Returns the name set with ClientSetname, as the server reports it, or
+// "" if there's none.
+func (self *client) ClientGetname() (string, os.Error) {
+    res, err := self.sendCommand("CLIENT", "GETNAME")
+    if err != nil {
+        return "", err
+    }
+
+    data, err := bulkReply("CLIENT", res)
+    if err == ErrNil {
+        return "", nil
+    }
+    return string(data), err
+}
+
+// Returns the ID of the connection the command was sent on, one of the
+// client's pooled connections.
+func (self *client) ClientID() (int64, os.Error) {
+    res, err := self.sendCommand("CLIENT", "ID")
+    if err != nil {
+        return -1, err
+    }
+
+    return intReply("CLIENT", res)
+}
+
+// Returns the server's clock as a unix time in nanoseconds, with
+// microsecond precision.
+func (self *client) Time() (int64, os.Error) {
+    res, err := self.sendCommand("TIME")
+    if err != nil {
+        return -1, err
+    }
+
+    data, err := multiBulkReply("TIME", res)
+    if err != nil {
+        return -1, err
+    }
+    if len(data) != 2 {
+        return -1, &UnexpectedReplyError{"TIME", res}
+    }
+    secs, err1 := strconv.Atoi64(string(data[0]))
+    usecs, err2 := strconv.Atoi64(string(data[1]))
+    if err1 != nil || err2 != nil {
+        return -1, &UnexpectedReplyError{"TIME", res}
+    }
+    return secs*1e9 + usecs*1e3, nil
+}
+
+// A replica, as listed by a master's Role.
+type ReplicaInfo struct {
+    Addr   string
+    Offset int64
+}
+
+// The server's replication role. Role is "master", "slave" or "sentinel".
+// Masters list their replicas, replicas give their master's address and
+// their replication state, e.g. "connected", and sentinels list the
+// masters they monitor. Offset is the replication offset.
+type RoleInfo struct {
+    Role       string
+    Offset     int64
+    Replicas   []ReplicaInfo
+    MasterAddr string
+    State      string
+    Masters    []string
+}
+
+// converts a multi-bulk element that may be an integer or a bulk holding
+// one, as ROLE mixes both
+func intValue(cmd string, reply interface{}) (int64, os.Error) {
+    if data, ok := reply.([]byte); ok {
+        n, err := strconv.Atoi64(string(data))
+        if err != nil {
+            return -1, &UnexpectedReplyError{cmd, reply}
+        }
+        return n, nil
+    }
+    return intReply(cmd, reply)
+}
+
+func parseRole(reply interface{}) (*RoleInfo, os.Error) {
+    items, err := valuesReply("ROLE", reply)
+    if err != nil {
+        return nil, err
+    }
+    if len(items) == 0 {
+        return nil, &UnexpectedReplyError{"ROLE", reply}
+    }
+    role, err := bulkReply("ROLE", items[0])
+    if err != nil {
+        return nil, err
+    }
+    info := &RoleInfo{Role: string(role)}
+    switch {
+    case info.Role == "master" && len(items) == 3:
+        if info.Offset, err = intValue("ROLE", items[1]); err != nil {
+            return nil, err
+        }
+        replicas, err := valuesReply("ROLE", items[2])
+        if err != nil {
+            return nil, err
+        }
+        for _, r := range replicas {
+            // [ip, port, offset]
+            fields, err := multiBulkReply("ROLE", r)
+            if err != nil {
+                return nil, err
+            }
+            if len(fields) != 3 {
+                return nil, &UnexpectedReplyError{"ROLE", reply}
+            }
+            offset, _ := strconv.Atoi64(string(fields[2]))
+            info.Replicas = append(info.Replicas, ReplicaInfo{net.JoinHostPort(string(fields[0]), string(fields[1])), offset})
+        }
+    case info.Role == "slave" && len(items) == 5:
+        host, err := bulkReply("ROLE", items[1])
+        if err != nil {
+            return nil, err
+        }
+        port, err := intValue("ROLE", items[2])
+        if err != nil {
+            return nil, err
+        }
+        state, err := bulkReply("ROLE", items[3])
+        if err != nil {
+            return nil, err
+        }
+        if info.Offset, err = intValue("ROLE", items[4]); err != nil {
+            return nil, err
+        }
+        info.MasterAddr = net.JoinHostPort(string(host), strconv.Itoa64(port))
+        info.State = string(state)
+    case info.Role == "sentinel" && len(items) == 2:
+        masters, err := multiBulkReply("ROLE", items[1])
+        if err != nil {
+            return nil, err
+        }
+        for _, m := range masters {
+            info.Masters = append(info.Masters, string(m))
+        }
+    default:
+        return nil, &UnexpectedReplyError{"ROLE", reply}
+    }
+    return info, nil
+}
+
+func (self *client) Role() (*RoleInfo, os.Error) {
+    res, err := self.sendCommand("ROLE")
+    if err != nil {
+        return nil, err
+    }
+
+    return parseRole(res)
 }
 
-func (self *client) Hvals(key string) ([][]byte, os.Error) {
-    res, err := self.sendCommand("HVALS", key)
+// A slow command, as logged by the server. Time is a unix time in seconds
+// and Duration is in nanoseconds, with microsecond precision. The client
+// fields are empty for servers before 4.0.
+type SlowlogEntry struct {
+    ID         int64
+    Time       int64
+    Duration   int64
+    Args       []string
+    ClientAddr string
+    ClientName string
+}
 
+func parseSlowlog(reply interface{}) ([]SlowlogEntry, os.Error) {
+    items, err := valuesReply("SLOWLOG", reply)
     if err != nil {
         return nil, err
     }
-    return res.([][]byte), nil
-}
-
-func writeTo(data []byte, val reflect.Value) os.Error {
-    s := string(data)
-    switch v := val; v.Kind() {
-    // if we're writing to an interace value, just set the byte data
-    // TODO: should we support writing to a pointer?
-    case reflect.Interface:
-        v.Set(reflect.ValueOf(data))
-    case reflect.Bool:
-        b, err := strconv.Atob(s)
-        if err != nil {
-            return err
-        }
-        v.SetBool(b)
-    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-        i, err := strconv.Atoi64(s)
-        if err != nil {
-            return err
+    entries := make([]SlowlogEntry, len(items))
+    for i, item := range items {
+        // [id, time, duration, [args], addr, name]
+        fields, ok := item.([]interface{})
+        if !ok || len(fields) < 4 {
+            return nil, &UnexpectedReplyError{"SLOWLOG", reply}
         }
-        v.SetInt(i)
-    case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
-        ui, err := strconv.Atoui64(s)
-        if err != nil {
-            return err
+        e := &entries[i]
+        if e.ID, err = intReply("SLOWLOG", fields[0]); err != nil {
+            return nil, err
         }
-        v.SetUint(ui)
-    case reflect.Float32, reflect.Float64:
-        f, err := strconv.Atof64(s)
-        if err != nil {
-            return err
+        if e.Time, err = intReply("SLOWLOG", fields[1]); err != nil {
+            return nil, err
         }
-        v.SetFloat(f)
-
-    case reflect.String:
-        v.SetString(s)
-    case reflect.Slice:
-        typ := v.Type()
-        if typ.Elem().Kind() == reflect.Uint || typ.Elem().Kind() == reflect.Uint8 || typ.Elem().Kind() == reflect.Uint16 || typ.Elem().Kind() == reflect.Uint32 || typ.Elem().Kind() == reflect.Uint64 || typ.Elem().Kind() == reflect.Uintptr {
-            v.Set(reflect.ValueOf(data))
+        if e.Duration, err = intReply("SLOWLOG", fields[2]); err != nil {
+            return nil, err
         }
-    }
-    return nil
-}
-
-func writeToContainer(data [][]byte, val reflect.Value) os.Error {
-    switch v := val; v.Kind() {
-    case reflect.Ptr:
-        return writeToContainer(data, reflect.Indirect(v))
-    case reflect.Interface:
-        return writeToContainer(data, v.Elem())
-    case reflect.Map:
-        if v.Type().Key().Kind() != reflect.String {
-            return os.NewError("Invalid map type")
+        e.Duration *= 1e3
+        args, err := multiBulkReply("SLOWLOG", fields[3])
+        if err != nil {
+            return nil, err
         }
-        elemtype := v.Type().Elem()
-        for i := 0; i < len(data)/2; i++ {
-            mk := reflect.ValueOf(string(data[i*2]))
-            mv := reflect.New(elemtype).Elem()
-            writeTo(data[i*2+1], mv)
-            v.SetMapIndex(mk, mv)
+        for _, arg := range args {
+            e.Args = append(e.Args, string(arg))
         }
-    case reflect.Struct:
-        for i := 0; i < len(data)/2; i++ {
-            name := string(data[i*2])
-            field := v.FieldByName(name)
-            if !field.IsValid() {
-                continue
+        if len(fields) == 6 {
+            addr, err1 := bulkReply("SLOWLOG", fields[4])
+            name, err2 := bulkReply("SLOWLOG", fields[5])
+            if err1 != nil || err2 != nil {
+                return nil, &UnexpectedReplyError{"SLOWLOG", reply}
             }
-            writeTo(data[i*2+1], field)
+            e.ClientAddr, e.ClientName = string(addr), string(name)
         }
-    default:
-        return os.NewError("Invalid container type")
     }
-    return nil
+    return entries, nil
 }
 
-
-func (self *client) Hgetall(key string, val interface{}) os.Error {
-    res, err := self.sendCommand("HGETALL", key)
+// Returns up to count of the most recent slowlog entries, newest first.
+func (self *client) SlowlogGet(count int) ([]SlowlogEntry, os.Error) {
+    res, err := self.sendCommand("SLOWLOG", "GET", strconv.Itoa(count))
     if err != nil {
-        return err
+        return nil, err
     }
 
-    data := res.([][]byte)
-    if data == nil || len(data) == 0 {
-        return RedisError("Key `" + key + "` does not exist")
-    }
-    err = writeToContainer(data, reflect.ValueOf(val))
+    return parseSlowlog(res)
+}
+
+func (self *client) SlowlogLen() (int, os.Error) {
+    res, err := self.sendCommand("SLOWLOG", "LEN")
     if err != nil {
-        return err
+        return -1, err
     }
 
-    return nil
+    n, err := intReply("SLOWLOG", res)
+    return int(n), err
 }
 
-//Publish/Subscribe
-
-// Container for messages received from publishers on channels that we're subscribed to.
-type Message struct {
-    ChannelMatched string
-    Channel        string
-    Message        []byte
+func (self *client) SlowlogReset() os.Error {
+    _, err := self.sendCommand("SLOWLOG", "RESET")
+    return err
 }
 
-// Subscribe to redis serve channels, this method will block until one of the sub/unsub channels are closed.
-// There are two pairs of channels subscribe/unsubscribe & psubscribe/punsubscribe.
-// The former does an exact match on the channel, the later uses glob patterns on the redis channels.
-// Closing either of these channels will unblock this method call.
-// Messages that are received are sent down the messages channel.
-func (self *client) Subscribe(subscribe <-chan string, unsubscribe <-chan string, psubscribe <-chan string, punsubscribe <-chan string, messages chan<- Message) os.Error {
-    cmds := make(chan []string, 0)
-    data := make(chan interface{}, 0)
+// how many entries each poll by SlowlogPoll reads, the server's default
+// slowlog-max-len
+const slowlogPollSize = 128
 
-    go func() {
-        for {
-            var channel string
-            var cmd string
+// Polls the slowlog every interval nanoseconds, sending the entries logged
+// since the poller started on the returned channel, oldest first. Errors
+// are passed to onError, which may be nil, and polling continues. Call the
+// returned function to stop polling, which closes the channel.
+func (self *client) SlowlogPoll(interval int64, onError func(os.Error)) (<-chan SlowlogEntry, func()) {
+    entries := make(chan SlowlogEntry)
+    stop := make(chan bool)
 
-            select {
-            case channel = <-subscribe:
-                cmd = "SUBSCRIBE"
-            case channel = <-unsubscribe:
-                cmd = "UNSUBSCRIBE"
-            case channel = <-psubscribe:
-                cmd = "PSUBSCRIBE"
-            case channel = <-punsubscribe:
-                cmd = "UNPSUBSCRIBE"
+    go func() {
+        defer close(entries)
+
+        // the ID of the newest entry seen, or -1 if there was none. Until
+        // the first read succeeds it isn't known, and nothing is sent, so
+        // entries logged before the poller started are never delivered.
+        last := int64(-1)
+        known := false
+        latest, err := self.SlowlogGet(1)
+        if err == nil {
+            known = true
+            if len(latest) > 0 {
+                last = latest[0].ID
+            }
+        }
 
+        ticker := time.NewTicker(interval)
+        defer ticker.Stop()
+        for {
+            if err != nil && onError != nil {
+                onError(err)
             }
-            if channel == "" {
-                break
-            } else {
-                cmds <- []string{cmd, channel}
+            select {
+            case <-stop:
+                return
+            case <-ticker.C:
             }
-        }
-        close(cmds)
-        close(data)
-    }()
 
-    go func() {
-        for response := range data {
-            db := response.([][]byte)
-            messageType := string(db[0])
-            switch messageType {
-            case "message":
-                channel, message := string(db[1]), db[2]
-                messages <- Message{channel, channel, message}
-            case "subscribe":
-                // Ignore
-            case "unsubscribe":
-                // Ignore
-            case "pmessage":
-                channelMatched, channel, message := string(db[1]), string(db[2]), db[3]
-                messages <- Message{channelMatched, channel, message}
-            case "psubscribe":
-                // Ignore
-            case "punsubscribe":
-                // Ignore
+            if !known {
+                latest, err = self.SlowlogGet(1)
+                if err == nil {
+                    known = true
+                    if len(latest) > 0 {
+                        last = latest[0].ID
+                    }
+                }
+                continue
+            }
 
-            default:
-                // log.Printf("Unknown message '%s'", messageType)
+            var got []SlowlogEntry
+            got, err = self.SlowlogGet(slowlogPollSize)
+            if err != nil || len(got) == 0 {
+                continue
             }
+            // IDs start over when the server restarts
+            if got[0].ID < last {
+                last = -1
+            }
+            for i := len(got) - 1; i >= 0; i-- {
+                if got[i].ID <= last {
+                    continue
+                }
+                select {
+                case entries <- got[i]:
+                case <-stop:
+                    return
+                }
+            }
+            last = got[0].ID
         }
     }()
 
-    err := self.sendCommands(cmds, data)
+    return entries, func() { close(stop) }
+}
 
-    return err
+// The latest and maximum latencies of an event, as reported by
+// LatencyLatest. Time is the unix time of the latest spike in seconds,
+// and the latencies are in nanoseconds, with millisecond precision.
+type LatencyEvent struct {
+    Event  string
+    Time   int64
+    Latest int64
+    Max    int64
 }
 
-// Publish a message to a redis server.
-func (self *client) Publish(channel string, val []byte) os.Error {
-    _, err := self.sendCommand("PUBLISH", channel, string(val))
+// Returns the latest latency spike of each event.
+func (self *client) LatencyLatest() ([]LatencyEvent, os.Error) {
+    res, err := self.sendCommand("LATENCY", "LATEST")
     if err != nil {
-        return err
+        return nil, err
     }
-    return nil
+
+    items, err := valuesReply("LATENCY", res)
+    if err != nil {
+        return nil, err
+    }
+    events := make([]LatencyEvent, len(items))
+    for i, item := range items {
+        // [event, time, latest, max]
+        fields, err := multiBulkReply("LATENCY", item)
+        if err != nil {
+            return nil, err
+        }
+        if len(fields) < 4 {
+            return nil, &UnexpectedReplyError{"LATENCY", res}
+        }
+        t, err1 := strconv.Atoi64(string(fields[1]))
+        latest, err2 := strconv.Atoi64(string(fields[2]))
+        max, err3 := strconv.Atoi64(string(fields[3]))
+        if err1 != nil || err2 != nil || err3 != nil {
+            return nil, &UnexpectedReplyError{"LATENCY", res}
+        }
+        events[i] = LatencyEvent{string(fields[0]), t, latest * 1e6, max * 1e6}
+    }
+    return events, nil
 }
 
-//Server commands
+// A latency spike, as reported by LatencyHistory, with the same units as
+// LatencyEvent.
+type LatencySample struct {
+    Time    int64
+    Latency int64
+}
 
-func (self *client) Save() os.Error {
-    _, err := self.sendCommand("SAVE")
+// Returns the recorded latency spikes of an event, oldest first.
+func (self *client) LatencyHistory(event string) ([]LatencySample, os.Error) {
+    res, err := self.sendCommand("LATENCY", "HISTORY", event)
     if err != nil {
-        return err
+        return nil, err
     }
-    return nil
+
+    items, err := valuesReply("LATENCY", res)
+    if err != nil {
+        return nil, err
+    }
+    samples := make([]LatencySample, len(items))
+    for i, item := range items {
+        // [time, latency]
+        fields, err := multiBulkReply("LATENCY", item)
+        if err != nil {
+            return nil, err
+        }
+        if len(fields) != 2 {
+            return nil, &UnexpectedReplyError{"LATENCY", res}
+        }
+        t, err1 := strconv.Atoi64(string(fields[0]))
+        latency, err2 := strconv.Atoi64(string(fields[1]))
+        if err1 != nil || err2 != nil {
+            return nil, &UnexpectedReplyError{"LATENCY", res}
+        }
+        samples[i] = LatencySample{t, latency * 1e6}
+    }
+    return samples, nil
 }
 
-func (self *client) Bgsave() os.Error {
-    _, err := self.sendCommand("BGSAVE")
+// Returns the server's human readable analysis of its latency spikes.
+func (self *client) LatencyDoctor() (string, os.Error) {
+    res, err := self.sendCommand("LATENCY", "DOCTOR")
     if err != nil {
-        return err
+        return "", err
     }
-    return nil
+
+    data, err := bulkReply("LATENCY", res)
+    return string(data), err
 }
 
-func (self *client) Lastsave() (int64, os.Error) {
-    res, err := self.sendCommand("LASTSAVE")
+// Clears the spikes recorded for the given events, or for every event if
+// there are none. Returns the number of events cleared.
+func (self *client) LatencyReset(events ...string) (int, os.Error) {
+    res, err := self.sendCommand("LATENCY", append([]string{"RESET"}, events...)...)
     if err != nil {
-        return 0, err
+        return -1, err
     }
 
-    return res.(int64), nil
+    n, err := intReply("LATENCY", res)
+    return int(n), err
 }
 
-func (self *client) Bgrewriteaof() os.Error {
-    _, err := self.sendCommand("BGREWRITEAOF")
+// A command processed by the server, as reported by Monitor. Time is a
+// unix time in nanoseconds, with microsecond precision. Addr is the
+// client's address, or "lua" for commands run by scripts.
+type MonitorEvent struct {
+    Time    int64
+    DB      int
+    Addr    string
+    Command string
+    Args    []string
+}
+
+// parses a MONITOR line, e.g.
+// 1339518083.107412 [0 127.0.0.1:60866] "set" "k" "a \"quoted\" value"
+func parseMonitorLine(line string) (*MonitorEvent, os.Error) {
+    bad := RedisError("unexpected MONITOR line: " + line)
+    i := strings.Index(line, " [")
+    j := strings.Index(line, "] ")
+    if i < 0 || j < i {
+        return nil, bad
+    }
+
+    e := new(MonitorEvent)
+    t := strings.Split(line[:i], ".")
+    secs, err := strconv.Atoi64(t[0])
+    if err != nil || len(t) != 2 {
+        return nil, bad
+    }
+    usecs, err := strconv.Atoi64(t[1])
     if err != nil {
-        return err
+        return nil, bad
     }
-    return nil
+    e.Time = secs*1e9 + usecs*1e3
+
+    source := line[i+2 : j]
+    k := strings.Index(source, " ")
+    if k < 0 {
+        return nil, bad
+    }
+    if e.DB, err = strconv.Atoi(source[:k]); err != nil {
+        return nil, bad
+    }
+    e.Addr = source[k+1:]
+
+    // the arguments are quoted with C style escapes, close enough to Go's
+    rest := line[j+2:]
+    for len(rest) > 0 {
+        if rest[0] != '"' {
+            return nil, bad
+        }
+        end := 1
+        for end < len(rest) && rest[end] != '"' {
+            if rest[end] == '\\' {
+                end++
+            }
+            end++
+        }
+        if end >= len(rest) {
+            return nil, bad
+        }
+        arg, err := strconv.Unquote(rest[:end+1])
+        if err != nil {
+            return nil, bad
+        }
+        if e.Command == "" {
+            e.Command = arg
+        } else {
+            e.Args = append(e.Args, arg)
+        }
+        rest = strings.TrimLeft(rest[end+1:], " ")
+    }
+    return e, nil
+}
+
+// Streams every command the server processes on the returned channel,
+// from a connection of its own. Lines that can't be parsed are skipped.
+// The channel is closed when the connection fails or the returned
+// function is called to stop; calling it again does nothing. Monitoring
+// slows the server down noticeably.
+func (self *client) Monitor() (<-chan *MonitorEvent, func(), os.Error) {
+    c, err := self.openConnection()
+    if err != nil {
+        return nil, nil, err
+    }
+    // the events follow the OK without a pause, so keep one reader for
+    // everything
+    reader := bufio.NewReader(c)
+    err = writeRequest(c, "MONITOR")
+    if err == nil {
+        _, err = readResponse(reader)
+    }
+    if err != nil {
+        c.Close()
+        return nil, nil, err
+    }
+
+    events := make(chan *MonitorEvent)
+    stop := make(chan bool)
+
+    go func() {
+        defer close(events)
+        defer c.Close()
+
+        for {
+            res, err := readResponse(reader)
+            if err != nil {
+                return
+            }
+            line, ok := res.(string)
+            if !ok {
+                continue
+            }
+            e, err := parseMonitorLine(line)
+            if err != nil {
+                continue
+            }
+            select {
+            case events <- e:
+            case <-stop:
+                return
+            }
+        }
+    }()
+
+    // closing the connection ends a pending read
+    var once sync.Once
+    return events, func() {
+        once.Do(func() {
+            close(stop)
+            c.Close()
+        })
+    }, nil
 }
@@ -1,14 +1,19 @@
 package redis
 
 import (
+    "bufio"
     "container/vector"
     "fmt"
     "json"
+    "math"
+    "net"
     "os"
+    "rand"
     "reflect"
     "runtime"
     "strconv"
     "strings"
+    "sync"
     "time"
     "testing"
 )
@@ -52,11 +57,197 @@ func TestBasic(t *testing.T) {
 
     client.Del("a")
 
-    if ok, _ := client.Exists("a"); ok {
+    if n, _ := client.Exists("a"); n != 0 {
         t.Fatal("Should be deleted")
     }
 }
 
+func TestDo(t *testing.T) {
+    if _, err := client.Do("SET", "a", []byte("x"), 1, 2.5, "y"); err == nil {
+        t.Fatal("Do should have passed through the server error")
+    }
+
+    if s, err := String(client.Do("SET", "a", []byte("hello"))); err != nil || s != "OK" {
+        t.Fatal("Do SET failed", s)
+    }
+    if b, err := Bytes(client.Do("GET", "a")); err != nil || string(b) != "hello" {
+        t.Fatal("Do GET failed", string(b))
+    }
+    if ok, err := Bool(client.Do("EXISTS", "a")); err != nil || !ok {
+        t.Fatal("Do EXISTS failed")
+    }
+    if _, err := Int(client.Do("GET", "a")); err == nil {
+        t.Fatal("Int should fail on a non-numeric reply")
+    }
+
+    if n, err := Int(client.Do("INCRBY", "n", 42)); err != nil || n != 42 {
+        t.Fatal("Do INCRBY failed", n)
+    }
+    if f, err := Float(client.Do("INCRBYFLOAT", "n", 0.5)); err != nil || f != 42.5 {
+        t.Fatal("Do INCRBYFLOAT failed", f)
+    }
+
+    client.Do("RPUSH", "l", "a", []byte("b"), 3)
+    if vals, err := Strings(client.Do("LRANGE", "l", 0, -1)); err != nil || !reflect.DeepEqual(vals, []string{"a", "b", "3"}) {
+        t.Fatal("Do LRANGE failed", vals)
+    }
+    if vals, err := Values(client.Do("LRANGE", "l", 0, 0)); err != nil || len(vals) != 1 {
+        t.Fatal("Do Values failed", vals)
+    }
+    if _, err := Strings(client.Do("GET", "a")); err == nil {
+        t.Fatal("Strings should fail on a bulk reply")
+    }
+
+    client.Do("HSET", "h", "f1", "v1")
+    client.Do("HSET", "h", "f2", 2)
+    m, err := StringMap(client.Do("HGETALL", "h"))
+    if err != nil {
+        t.Fatal("Do HGETALL failed", err.String())
+    }
+    if !reflect.DeepEqual(m, map[string]string{"f1": "v1", "f2": "2"}) {
+        t.Fatal("StringMap failed", m)
+    }
+
+    client.Del("a", "n", "l", "h")
+}
+
+// writes a random reply of any shape readResponse can produce
+func randomReply(r *rand.Rand, depth int) string {
+    n := 7
+    if depth > 2 {
+        // no more multi-bulks
+        n = 4
+    }
+    switch r.Intn(n) {
+    case 0:
+        return fmt.Sprintf(":%d\r\n", r.Intn(4)-1)
+    case 1:
+        bulks := []string{"", "0", "1", "2.5", "inf", "abc", "a b c"}
+        b := bulks[r.Intn(len(bulks))]
+        return fmt.Sprintf("$%d\r\n%s\r\n", len(b), b)
+    case 2:
+        return "$-1\r\n"
+    case 3:
+        return "+OK\r\n"
+    case 4:
+        return "-ERR fuzz\r\n"
+    case 5:
+        return "*-1\r\n"
+    }
+    size := r.Intn(5)
+    reply := fmt.Sprintf("*%d\r\n", size)
+    for i := 0; i < size; i++ {
+        reply += randomReply(r, depth+1)
+    }
+    return reply
+}
+
+// answers every command with a random reply
+func serveRandomReplies(l net.Listener) {
+    for seed := int64(1); ; seed++ {
+        c, err := l.Accept()
+        if err != nil {
+            return
+        }
+        go func(c net.Conn, r *rand.Rand) {
+            reader := bufio.NewReader(c)
+            for {
+                if _, err := readResponse(reader); err != nil {
+                    break
+                }
+                c.Write([]byte(randomReply(r, 0)))
+            }
+            c.Close()
+        }(c, rand.New(rand.NewSource(seed)))
+    }
+}
+
+func bulk(s string) string {
+    return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
+
+// answers commands with canned replies, looked up by the command and its
+// arguments, then by the command and its first argument, then by the
+// command alone
+func serveReplies(l net.Listener, replies map[string]string) {
+    serveFunc(l, func(args []string) string {
+        for n := len(args); n > 0; n-- {
+            if r, ok := replies[strings.ToUpper(strings.Join(args[:n], " "))]; ok {
+                return r
+            }
+        }
+        return "-ERR unknown command\r\n"
+    })
+}
+
+// answers each command with the reply returned by f
+func serveFunc(l net.Listener, f func(args []string) string) {
+    for {
+        c, err := l.Accept()
+        if err != nil {
+            return
+        }
+        go func(c net.Conn) {
+            reader := bufio.NewReader(c)
+            for {
+                res, err := readResponse(reader)
+                if err != nil {
+                    break
+                }
+                args, _ := Strings(res, nil)
+                c.Write([]byte(f(args)))
+            }
+            c.Close()
+        }(c)
+    }
+}
+
+func callWithRecover(t *testing.T, name string, f reflect.Value, args []reflect.Value) {
+    defer func() {
+        if x := recover(); x != nil {
+            t.Fatalf("%s panicked: %v", name, x)
+        }
+    }()
+    f.Call(args)
+}
+
+// methods that block or loop rather than returning after one reply
+var fuzzSkip = map[string]bool{"Subscribe": true, "SlowlogPoll": true, "Monitor": true, "SubscribeKeyspace": true, "SubscribeValues": true}
+
+func TestReplyFuzz(t *testing.T) {
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal("Listen failed", err.String())
+    }
+    defer l.Close()
+    go serveRandomReplies(l)
+
+    c := reflect.ValueOf(NewClient(l.Addr().String(), 0, ""))
+    typ := c.Type()
+    for i := 0; i < typ.NumMethod(); i++ {
+        m := typ.Method(i)
+        if fuzzSkip[m.Name] {
+            continue
+        }
+        n := m.Type.NumIn()
+        if m.Type.IsVariadic() {
+            n--
+        }
+        args := []reflect.Value{c}
+        for j := 1; j < n; j++ {
+            // pointers, like *Bitfield, point to a zero value
+            if in := m.Type.In(j); in.Kind() == reflect.Ptr {
+                args = append(args, reflect.New(in.Elem()))
+            } else {
+                args = append(args, reflect.Zero(in))
+            }
+        }
+        for j := 0; j < 50; j++ {
+            callWithRecover(t, m.Name, m.Func, args)
+        }
+    }
+}
+
 func setget(t *testing.T, i int) {
 
     s := strconv.Itoa(i)
@@ -96,6 +287,42 @@ func TestEmptyGet(t *testing.T) {
     }
 }
 
+func TestNil(t *testing.T) {
+    if _, err := client.Get("missing"); err != ErrNil {
+        t.Fatal("Get on a missing key should return ErrNil", err)
+    }
+    if _, err := client.Lpop("missing"); err != ErrNil {
+        t.Fatal("Lpop on an empty list should return ErrNil", err)
+    }
+    if _, err := client.Hget("missing", "f"); err != ErrNil {
+        t.Fatal("Hget on a missing field should return ErrNil", err)
+    }
+    if _, err := client.Zscore("missing", []byte("m")); err != ErrNil {
+        t.Fatal("Zscore on a missing member should return ErrNil", err)
+    }
+    if _, err := client.Zrank("missing", []byte("m")); err != ErrNil {
+        t.Fatal("Zrank on a missing member should return ErrNil", err)
+    }
+    if _, err := Bytes(client.Do("GET", "missing")); err != ErrNil {
+        t.Fatal("Bytes on a nil reply should return ErrNil", err)
+    }
+
+    client.Set("empty", []byte{})
+    if val, err := client.Get("empty"); err != nil || val == nil || len(val) != 0 {
+        t.Fatal("Get on an empty value failed", val, err)
+    }
+
+    vals, err := client.Mget("empty", "missing")
+    if err != nil {
+        t.Fatal("Mget failed", err.String())
+    }
+    if vals[0] == nil || vals[1] != nil {
+        t.Fatal("Mget should return nil only for the missing key")
+    }
+
+    client.Del("empty")
+}
+
 func TestConcurrent(t *testing.T) {
     for i := 0; i < 20; i++ {
         go setget(t, i)
@@ -129,7 +356,7 @@ func TestSet(t *testing.T) {
     }
 
     for _, v := range vals {
-        if ok, err := client.Srem("s", []byte(v)); err != nil || !ok {
+        if n, err := client.Srem("s", []byte(v)); err != nil || n != 1 {
             t.Fatal("Sismember test failed")
         }
     }
@@ -147,6 +374,52 @@ func TestSet(t *testing.T) {
 }
 
 
+func TestVariadic(t *testing.T) {
+    client.Set("a", []byte("1"))
+    client.Set("b", []byte("2"))
+
+    if n, err := client.Exists("a", "b", "c"); err != nil || n != 2 {
+        t.Fatal("Exists failed", n)
+    }
+
+    if n, err := client.Rpush("l", []byte("b"), []byte("c")); err != nil || n != 2 {
+        t.Fatal("Rpush failed", n)
+    }
+    if n, err := client.Lpush("l", []byte("a"), []byte("z")); err != nil || n != 4 {
+        t.Fatal("Lpush failed", n)
+    }
+    vals, err := client.Lrange("l", 0, -1)
+    if err != nil {
+        t.Fatal("Lrange failed", err.String())
+    }
+    if !reflect.DeepEqual(vals, [][]byte{[]byte("z"), []byte("a"), []byte("b"), []byte("c")}) {
+        t.Fatal("Variadic push failed")
+    }
+
+    if n, err := client.Sadd("s", []byte("a"), []byte("b"), []byte("a")); err != nil || n != 2 {
+        t.Fatal("Sadd failed", n)
+    }
+    if n, err := client.Srem("s", []byte("a"), []byte("c")); err != nil || n != 1 {
+        t.Fatal("Srem failed", n)
+    }
+
+    client.Hmset("h", map[string][]byte{"a": []byte("aa"), "b": []byte("bb"), "c": []byte("cc")})
+    hvals, err := client.Hmget("h", "c", "missing", "a")
+    if err != nil {
+        t.Fatal("Hmget failed", err.String())
+    }
+    if len(hvals) != 3 || string(hvals[0]) != "cc" || hvals[1] != nil || string(hvals[2]) != "aa" {
+        t.Fatal("Hmget failed", hvals)
+    }
+    if n, err := client.Hdel("h", "a", "b", "missing"); err != nil || n != 2 {
+        t.Fatal("Hdel failed", n)
+    }
+
+    if n, err := client.Del("a", "b", "l", "s", "h", "missing"); err != nil || n != 5 {
+        t.Fatal("Del failed", n)
+    }
+}
+
 func TestList(t *testing.T) {
     //var err os.Error
 
@@ -194,10 +467,84 @@ func TestList(t *testing.T) {
 
 }
 
+func TestListCommands(t *testing.T) {
+    if n, err := client.Rpushx("l", []byte("a")); err != nil || n != 0 {
+        t.Fatal("Rpushx on missing list should not push", n)
+    }
+    client.Rpush("l", []byte("a"), []byte("b"), []byte("a"), []byte("c"), []byte("a"))
+    if n, err := client.Lpushx("l", []byte("z")); err != nil || n != 6 {
+        t.Fatal("Lpushx failed", n)
+    }
+
+    if n, err := client.Lrem("l", -2, []byte("a")); err != nil || n != 2 {
+        t.Fatal("Lrem failed", n)
+    }
+    if n, err := client.Linsert("l", true, []byte("b"), []byte("y")); err != nil || n != 5 {
+        t.Fatal("Linsert failed", n)
+    }
+    if n, err := client.Linsert("l", false, []byte("missing"), []byte("y")); err != nil || n != -1 {
+        t.Fatal("Linsert with missing pivot failed", n)
+    }
+    vals, _ := client.Lrange("l", 0, -1)
+    if !reflect.DeepEqual(vals, [][]byte{[]byte("z"), []byte("a"), []byte("y"), []byte("b"), []byte("c")}) {
+        t.Fatal("Lrem/Linsert failed")
+    }
+
+    client.Rpush("l", []byte("a"), []byte("a"))
+    if i, err := client.Lpos("l", []byte("a"), 0, 0); err != nil || i != 1 {
+        t.Fatal("Lpos failed", i)
+    }
+    if i, err := client.Lpos("l", []byte("a"), -1, 0); err != nil || i != 6 {
+        t.Fatal("Lpos with rank failed", i)
+    }
+    if i, err := client.Lpos("l", []byte("missing"), 0, 0); err != nil || i != -1 {
+        t.Fatal("Lpos for missing value failed", i)
+    }
+    if idx, err := client.Lposcount("l", []byte("a"), 0, 0, 0); err != nil || !reflect.DeepEqual(idx, []int{1, 5, 6}) {
+        t.Fatal("Lposcount failed", idx)
+    }
+    if idx, err := client.Lposcount("l", []byte("a"), 0, 2, 6); err != nil || !reflect.DeepEqual(idx, []int{1, 5}) {
+        t.Fatal("Lposcount with maxlen failed", idx)
+    }
+
+    if val, err := client.Lmove("l", "l2", Left, Right); err != nil || string(val) != "z" {
+        t.Fatal("Lmove failed", string(val))
+    }
+    if val, err := client.Blmove("l", "l2", Right, Left, 1); err != nil || string(val) != "a" {
+        t.Fatal("Blmove failed", string(val))
+    }
+    if vals, _ := client.Lrange("l2", 0, -1); !reflect.DeepEqual(vals, [][]byte{[]byte("a"), []byte("z")}) {
+        t.Fatal("Lmove/Blmove failed")
+    }
+
+    client.Del("l", "l2")
+}
+
+func TestLmpop(t *testing.T) {
+    client.Rpush("l2", []byte("a"), []byte("b"), []byte("c"))
+    key, vals, err := client.Lmpop([]string{"l", "l2"}, Right, 2)
+    if err != nil {
+        t.Fatal("Lmpop failed", err.String())
+    }
+    if key == nil || *key != "l2" || !reflect.DeepEqual(vals, [][]byte{[]byte("c"), []byte("b")}) {
+        t.Fatal("Lmpop failed", vals)
+    }
+
+    client.Del("l2")
+
+    key, vals, err = client.Blmpop([]string{"l", "l2"}, Left, 1, 1)
+    if err != nil {
+        t.Fatal("Blmpop failed", err.String())
+    }
+    if key != nil || vals != nil {
+        t.Fatal("Blmpop should have timed out")
+    }
+}
+
 func TestBrpop(t *testing.T) {
     go func() {
         time.Sleep(100 * 1000)
-        if err := client.Lpush("l", []byte("a")); err != nil {
+        if _, err := client.Lpush("l", []byte("a")); err != nil {
             t.Fatal("Lpush failed", err.String())
         }
     }()
@@ -216,7 +563,7 @@ func TestBrpop(t *testing.T) {
 func TestBlpop(t *testing.T) {
     go func() {
         time.Sleep(100 * 1000)
-        if err := client.Lpush("l", []byte("a")); err != nil {
+        if _, err := client.Lpush("l", []byte("a")); err != nil {
             t.Fatal("Lpush failed", err.String())
         }
     }()
@@ -294,7 +641,7 @@ func TestSubscribe(t *testing.T) {
             case <-timeout:
                 t.Fatal("TestSubscribe timeout")
             case <-tick:
-                if err := client.Publish("ccc", data); err != nil {
+                if _, err := client.Publish("ccc", data); err != nil {
                     t.Fatal("Pubish failed", err.String())
                 }
             }
@@ -360,7 +707,7 @@ func TestUnsubscribe(t *testing.T) {
 
         for i := 0; i < 10; i++ {
             <-tick
-            if err := client.Publish("ccc", data); err != nil {
+            if _, err := client.Publish("ccc", data); err != nil {
                 t.Fatal("Pubish failed", err.String())
             }
         }
@@ -426,7 +773,7 @@ func TestPSubscribe(t *testing.T) {
             case <-timeout:
                 t.Fatal("TestSubscribe timeout")
             case <-tick:
-                if err := client.Publish("ccc.foo", data); err != nil {
+                if _, err := client.Publish("ccc.foo", data); err != nil {
                     t.Fatal("Pubish failed", err.String())
                 }
             }
@@ -447,135 +794,2201 @@ func TestPSubscribe(t *testing.T) {
     close(subscribe)
 }
 */
-func verifyHash(t *testing.T, key string, expected map[string][]byte) {
-    //test Hget
-    m1 := make(map[string][]byte)
-    for k, _ := range expected {
-        actual, err := client.Hget(key, k)
-        if err != nil {
-            t.Fatal("verifyHash Hget failed", err.String())
-        }
-        m1[k] = actual
+type event struct {
+    Kind  string
+    Count int
+}
+
+func TestExpiration(t *testing.T) {
+    client.Set("exp", []byte("v"))
+
+    if ok, err := client.Pexpire("exp", 10e9, ExpireAlways); err != nil || !ok {
+        t.Fatal("Pexpire failed", err)
     }
-    if !reflect.DeepEqual(m1, expected) {
-        t.Fatal("verifyHash Hget failed")
+    if ttl, err := client.Pttl("exp"); err != nil || ttl <= 9e9 || ttl > 10e9 || ttl%1e6 != 0 {
+        t.Fatal("Pttl failed", ttl)
+    }
+    if ok, _ := client.Pexpire("exp", 5e9, ExpireGT); ok {
+        t.Fatal("Pexpire with ExpireGT shouldn't shorten the expiration")
+    }
+    if ok, _ := client.Pexpire("exp", 5e9, ExpireLT); !ok {
+        t.Fatal("Pexpire with ExpireLT failed")
+    }
+    if ok, _ := client.Pexpire("exp", 60e9, ExpireNX); ok {
+        t.Fatal("Pexpire with ExpireNX should fail when there's an expiration")
     }
 
-    //test Hkeys
-    keys, err := client.Hkeys(key)
-    if err != nil {
-        t.Fatal("verifyHash Hkeys failed", err.String())
+    at := time.Seconds() + 100
+    if ok, err := client.Expireat("exp", time.SecondsToUTC(at), ExpireXX); err != nil || !ok {
+        t.Fatal("Expireat failed", err)
     }
-    if len(keys) != len(expected) {
-        fmt.Printf("%v\n", keys)
-        t.Fatal("verifyHash Hkeys failed - length not equal")
+    if t2, err := client.Expiretime("exp"); err != nil || t2.Seconds() != at {
+        t.Fatal("Expiretime failed", t2)
     }
-    for _, key := range keys {
-        if expected[key] == nil {
-            t.Fatal("verifyHash Hkeys failed missing key", key)
-        }
+    if ok, err := client.Pexpireat("exp", time.NanosecondsToUTC(at*1e9+500e6), ExpireAlways); err != nil || !ok {
+        t.Fatal("Pexpireat failed", err)
+    }
+    if t2, err := client.Pexpiretime("exp"); err != nil || t2.Nanoseconds() != at*1e9+500e6 {
+        t.Fatal("Pexpiretime failed", t2)
+    }
+    if _, err := client.Expireat("exp", nil, ExpireAlways); err == nil {
+        t.Fatal("Expireat should fail without a time")
+    }
+    if _, err := client.Pexpireat("exp", nil, ExpireAlways); err == nil {
+        t.Fatal("Pexpireat should fail without a time")
     }
 
-    //test Hvals
-    vals, err := client.Hvals(key)
-    if err != nil {
-        t.Fatal("verifyHash Hvals failed", err.String())
+    if ok, err := client.Persist("exp"); err != nil || !ok {
+        t.Fatal("Persist failed", err)
     }
-    if len(vals) != len(expected) {
-        t.Fatal("verifyHash Hvals failed")
+    if ttl, _ := client.Pttl("exp"); ttl != -1 {
+        t.Fatal("Pttl should return -1 without an expiration", ttl)
+    }
+    if ttl, _ := client.Pttl("missing"); ttl != -2 {
+        t.Fatal("Pttl should return -2 for a missing key", ttl)
+    }
+    if t2, err := client.Expiretime("exp"); err != nil || t2 != nil {
+        t.Fatal("Expiretime should return nil without an expiration", t2)
+    }
+    if _, err := client.Pexpiretime("missing"); err != ErrNil {
+        t.Fatal("Pexpiretime should return ErrNil for a missing key", err)
     }
 
-    m2 := map[string][]byte{}
-    //test Hgetall
-    err = client.Hgetall(key, m2)
-    if err != nil {
-        t.Fatal("verifyHash Hgetall failed", err.String())
+    // less than a millisecond rounds up rather than expiring the key
+    if ok, err := client.Pexpire("exp", 500e3, ExpireAlways); err != nil || !ok {
+        t.Fatal("Pexpire of less than a millisecond failed", err)
     }
-    if !reflect.DeepEqual(m2, expected) {
-        t.Fatal("verifyHash Hgetall failed")
+    if ttl, _ := client.Pttl("exp"); ttl < 0 || ttl > Millisecond {
+        t.Fatal("Pexpire of less than a millisecond should round up", ttl)
     }
+
+    client.Del("exp")
 }
 
-func TestSortedSet(t *testing.T) {
-    svals := []string{"a", "b", "c", "d", "e"}
-    ranks := []float64{0.0, 1.0, 2.0, 3.0, 4.0}
-    vals := make([][]byte, len(svals))
-    for i := 0; i < len(svals); i++ {
-        vals[i] = []byte(svals[i])
-        _, err := client.Zadd("zs", vals[i], ranks[i])
-        if err != nil {
-            t.Fatal("zdd failed" + err.String())
-        }
-        score, err := client.Zscore("zs", vals[i])
-        if err != nil {
-            t.Fatal("zscore failed" + err.String())
-        }
-        if score != ranks[i] {
-            t.Fatal("zscore failed")
-        }
-    }
+func TestSetOptions(t *testing.T) {
+    client.Del("so")
 
-    card, err := client.Zcard("zs")
-    if err != nil {
-        t.Fatal("zcard failed" + err.String())
+    if ok, err := client.SetWith("so", []byte("a"), &SetOptions{Expire: 1500e6, NX: true}); err != nil || !ok {
+        t.Fatal("SetWith failed", err)
     }
-    if card != 5 {
-        t.Fatal("zcard failed", card)
+    if ttl, _ := client.Pttl("so"); ttl <= 0 || ttl > 1500e6 {
+        t.Fatal("SetWith should set a timeout in milliseconds", ttl)
     }
-    for i := 0; i <= 4; i++ {
-        data, _ := client.Zrange("zs", 0, i)
-        if !reflect.DeepEqual(data, vals[0:i+1]) {
-            t.Fatal("zrange failed")
-        }
+    if ok, err := client.SetWith("so", []byte("b"), &SetOptions{NX: true}); err != nil || ok {
+        t.Fatal("SetWith with NX should fail for an existing key", err)
     }
-    for i := 0; i <= 4; i++ {
-        data, _ := client.Zrangebyscore("zs", 0, float64(i))
-        if !reflect.DeepEqual(data, vals[0:i+1]) {
-            t.Fatal("zrangebyscore failed")
-        }
+    if ok, _ := client.SetWith("so", []byte("b"), &SetOptions{XX: true, KeepTTL: true}); !ok {
+        t.Fatal("SetWith with XX failed")
+    }
+    if ttl, _ := client.Pttl("so"); ttl <= 0 {
+        t.Fatal("SetWith with KeepTTL should keep the expiration", ttl)
     }
-    //incremement
-    for i := 0; i <= 4; i++ {
-        client.Zincrby("zs", vals[i], 1)
 
-        score, err := client.Zscore("zs", vals[i])
-        if err != nil {
-            t.Fatal("zscore failed" + err.String())
-        }
-        if score != ranks[i]+1 {
-            t.Fatal("zscore failed")
-        }
+    old, err := client.SetGet("so", []byte("c"), &SetOptions{Expire: 60e9})
+    if err != nil || string(old) != "b" {
+        t.Fatal("SetGet failed", err)
+    }
+    if ttl, _ := client.Ttl("so"); ttl != 60 {
+        t.Fatal("SetGet should set a timeout in seconds", ttl)
+    }
+    if _, err := client.SetGet("so2", []byte("c"), &SetOptions{}); err != ErrNil {
+        t.Fatal("SetGet should return ErrNil for a new key", err)
+    }
+    if ok, err := client.SetWith("so3", []byte("c"), nil); err != nil || !ok {
+        t.Fatal("SetWith with nil options failed", err)
+    }
+    if old, err := client.SetGet("so3", []byte("d"), nil); err != nil || string(old) != "c" {
+        t.Fatal("SetGet with nil options failed", err)
+    }
+    if val, err := client.Getex("so3", nil); err != nil || string(val) != "d" {
+        t.Fatal("Getex with nil options failed", err)
     }
 
-    for i := 0; i <= 4; i++ {
-        client.Zincrby("zs", vals[i], -1)
+    at := time.NanosecondsToUTC((time.Seconds() + 100) * 1e9)
+    val, err := client.Getex("so", &GetexOptions{ExpireAt: at})
+    if err != nil || string(val) != "c" {
+        t.Fatal("Getex failed", err)
+    }
+    if t2, _ := client.Pexpiretime("so"); t2 == nil || t2.Nanoseconds() != at.Nanoseconds() {
+        t.Fatal("Getex should set the expiration", t2)
+    }
+    client.Getex("so", &GetexOptions{Persist: true})
+    if ttl, _ := client.Pttl("so"); ttl != -1 {
+        t.Fatal("Getex with Persist should remove the expiration", ttl)
     }
 
-    //clean up
-    _, err = client.Zrem("zs", []byte("a"))
-    if err != nil {
-        t.Fatal("zrem failed" + err.String())
+    if val, err := client.Getdel("so"); err != nil || string(val) != "c" {
+        t.Fatal("Getdel failed", err)
+    }
+    if _, err := client.Getdel("so"); err != ErrNil {
+        t.Fatal("Getdel should have deleted the key", err)
     }
 
-    _, err = client.Zremrangebyrank("zs", 0, 1)
-    if err != nil {
-        t.Fatal("zremrangebynrank failed" + err.String())
+    client.Del("so2", "so3")
+}
+
+func TestKeyMetadata(t *testing.T) {
+    client.Set("km1", []byte("12345"))
+    client.Set("km2", []byte("v"))
+
+    if n, err := client.Touch("km1", "km2", "missing"); err != nil || n != 2 {
+        t.Fatal("Touch failed", n)
+    }
+    if idle, err := client.ObjectIdletime("km1"); err != nil || idle < 0 {
+        t.Fatal("ObjectIdletime failed", idle)
     }
 
-    _, err = client.Zremrangebyscore("zs", 3, 4)
-    if err != nil {
-        t.Fatal("zremrangebyscore failed" + err.String())
+    if ok, err := client.Copy("km1", "km2", -1, false); err != nil || ok {
+        t.Fatal("Copy shouldn't replace an existing key", err)
+    }
+    if ok, err := client.Copy("km1", "km2", -1, true); err != nil || !ok {
+        t.Fatal("Copy failed", err)
+    }
+    if val, _ := client.Get("km2"); string(val) != "12345" {
+        t.Fatal("Copy failed", string(val))
     }
 
-    card, err = client.Zcard("zs")
+    data, err := client.Dump("km1")
     if err != nil {
-        t.Fatal("zcard failed" + err.String())
+        t.Fatal("Dump failed", err.String())
     }
-    if card != 0 {
-        t.Fatal("zcard failed", card)
+    if err := client.Restore("km3", 60e9, data, false); err != nil {
+        t.Fatal("Restore failed", err.String())
+    }
+    if val, _ := client.Get("km3"); string(val) != "12345" {
+        t.Fatal("Restore failed", string(val))
+    }
+    if ttl, _ := client.Ttl("km3"); ttl <= 0 {
+        t.Fatal("Restore should set the expiration", ttl)
+    }
+    if err := client.Restore("km3", 0, data, false); err == nil {
+        t.Fatal("Restore should fail for an existing key")
     }
 
-    client.Del("zs")
+    if n, err := client.Unlink("km1", "km2", "km3"); err != nil || n != 3 {
+        t.Fatal("Unlink failed", n)
+    }
+}
+
+func TestObjectEncoding(t *testing.T) {
+    client.Set("km1", []byte("12345"))
+    if enc, err := client.ObjectEncoding("km1"); err != nil || enc != "int" {
+        t.Fatal("ObjectEncoding failed", enc)
+    }
+    if _, err := client.ObjectFreq("km1"); err == nil {
+        t.Fatal("ObjectFreq should fail without an LFU eviction policy")
+    }
+    client.Del("km1")
+}
+
+func TestServerInfo(t *testing.T) {
+    info, err := client.Info("clients")
+    if err != nil {
+        t.Fatal("Info failed", err.String())
+    }
+    if n, _ := strconv.Atoi(info.Sections["clients"]["connected_clients"]); n < 1 || info.Get("connected_clients") == "" {
+        t.Fatal("Info failed", info.Sections)
+    }
+
+    now, err := client.Time()
+    if err != nil || now-time.Nanoseconds() > 5e9 || time.Nanoseconds()-now > 5e9 {
+        t.Fatal("Time failed", now)
+    }
+
+    c := NewClient("127.0.0.1:7379", 13, "")
+    if name, err := c.ClientGetname(); err != nil || name != "" {
+        t.Fatal("ClientGetname should return an empty name", name)
+    }
+    if err := c.ClientSetname("tester"); err != nil {
+        t.Fatal("ClientSetname failed", err.String())
+    }
+    if name, err := c.ClientGetname(); err != nil || name != "tester" {
+        t.Fatal("ClientGetname failed", name)
+    }
+}
+
+func TestServerIntrospection(t *testing.T) {
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal("Listen failed", err.String())
+    }
+    defer l.Close()
+    go serveReplies(l, map[string]string{
+        "INFO":              bulk("# Server\r\nredis_version:7.2.4\r\nprocess_id:1\r\n\r\n# Keyspace\r\ndb0:keys=3,expires=1,avg_ttl=2000\r\ndb13:keys=10,expires=0,avg_ttl=0\r\n"),
+        "CONFIG GET":        "*4\r\n" + bulk("maxmemory") + bulk("0") + bulk("maxmemory-policy") + bulk("noeviction"),
+        "CLIENT LIST":       bulk("id=3 addr=127.0.0.1:5000 laddr=127.0.0.1:6379 fd=8 name=web age=10 idle=2 flags=N db=13 cmd=client|list\nid=4 addr=127.0.0.1:5001 laddr=127.0.0.1:6379 fd=9 name= age=1 idle=1 flags=P db=0 cmd=subscribe\n"),
+        "CLIENT KILL ID 3":  ":1\r\n",
+        "CLIENT KILL ID 99": ":0\r\n",
+        "ROLE":              "*3\r\n" + bulk("master") + ":3129659\r\n*2\r\n*3\r\n" + bulk("10.0.0.2") + bulk("6379") + bulk("3129242") + "*3\r\n" + bulk("10.0.0.3") + bulk("6380") + bulk("3129543"),
+    })
+
+    c := NewClient(l.Addr().String(), 0, "")
+    info, err := c.Info()
+    if err != nil {
+        t.Fatal("Info failed", err.String())
+    }
+    if info.Sections["server"]["redis_version"] != "7.2.4" || info.Get("process_id") != "1" {
+        t.Fatal("Info failed", info.Sections)
+    }
+    if ks := info.Keyspace[0]; ks.Keys != 3 || ks.Expires != 1 || ks.AvgTTL != 2e9 || info.Keyspace[13].Keys != 10 {
+        t.Fatal("Info failed to decode the keyspace", info.Keyspace)
+    }
+
+    config, err := c.ConfigGet("maxmemory*")
+    if err != nil || len(config) != 2 || config["maxmemory-policy"] != "noeviction" {
+        t.Fatal("ConfigGet failed", config)
+    }
+
+    clients, err := c.ClientList()
+    if err != nil {
+        t.Fatal("ClientList failed", err.String())
+    }
+    if len(clients) != 2 || clients[0].ID != 3 || clients[0].Addr != "127.0.0.1:5000" || clients[0].Name != "web" || clients[0].Age != 10 || clients[0].DB != 13 || clients[1].Cmd != "subscribe" || clients[1].Fields["fd"] != "9" {
+        t.Fatal("ClientList failed", clients)
+    }
+    if ok, err := c.ClientKillID(3); err != nil || !ok {
+        t.Fatal("ClientKillID failed", err)
+    }
+    if ok, _ := c.ClientKillID(99); ok {
+        t.Fatal("ClientKillID should return false for unknown IDs")
+    }
+
+    role, err := c.Role()
+    if err != nil {
+        t.Fatal("Role failed", err.String())
+    }
+    if role.Role != "master" || role.Offset != 3129659 || len(role.Replicas) != 2 || role.Replicas[1].Addr != "10.0.0.3:6380" || role.Replicas[1].Offset != 3129543 {
+        t.Fatal("Role failed", role)
+    }
+
+    role, err = parseRole([]interface{}{[]byte("slave"), []byte("10.0.0.1"), int64(6379), []byte("connected"), int64(3167038)})
+    if err != nil || role.MasterAddr != "10.0.0.1:6379" || role.State != "connected" || role.Offset != 3167038 {
+        t.Fatal("parseRole failed for a replica", role)
+    }
+    role, err = parseRole([]interface{}{[]byte("slave"), []byte("fe80::1"), int64(6379), []byte("connected"), int64(1)})
+    if err != nil || role.MasterAddr != "[fe80::1]:6379" {
+        t.Fatal("parseRole failed for an IPv6 master", role)
+    }
+    role, err = parseRole([]interface{}{[]byte("master"), int64(1), []interface{}{[][]byte{[]byte("fe80::2"), []byte("6380"), []byte("1")}}})
+    if err != nil || len(role.Replicas) != 1 || role.Replicas[0].Addr != "[fe80::2]:6380" {
+        t.Fatal("parseRole failed for an IPv6 replica", role)
+    }
+    role, err = parseRole([]interface{}{[]byte("sentinel"), [][]byte{[]byte("mymaster")}})
+    if err != nil || len(role.Masters) != 1 || role.Masters[0] != "mymaster" {
+        t.Fatal("parseRole failed for a sentinel", role)
+    }
+}
+
+func slowlogReply(ids ...int) string {
+    reply := fmt.Sprintf("*%d\r\n", len(ids))
+    for _, id := range ids {
+        reply += fmt.Sprintf("*6\r\n:%d\r\n:1700000000\r\n:%d\r\n*2\r\n%s%s%s%s", id, id*1000, bulk("GET"), bulk("k"), bulk("127.0.0.1:5000"), bulk("web"))
+    }
+    return reply
+}
+
+func TestSlowlog(t *testing.T) {
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal("Listen failed", err.String())
+    }
+    defer l.Close()
+    go serveReplies(l, map[string]string{
+        "SLOWLOG GET":     slowlogReply(2, 1),
+        "SLOWLOG LEN":     ":2\r\n",
+        "SLOWLOG RESET":   "+OK\r\n",
+        "LATENCY LATEST":  "*1\r\n*4\r\n" + bulk("command") + ":1700000000\r\n:25\r\n:40\r\n",
+        "LATENCY HISTORY": "*2\r\n*2\r\n:1700000000\r\n:40\r\n*2\r\n:1700000010\r\n:25\r\n",
+        "LATENCY DOCTOR":  bulk("Dave, no latency spike was observed."),
+        "LATENCY RESET":   ":1\r\n",
+    })
+    c := NewClient(l.Addr().String(), 0, "")
+
+    entries, err := c.SlowlogGet(10)
+    if err != nil {
+        t.Fatal("SlowlogGet failed", err.String())
+    }
+    if len(entries) != 2 || entries[0].ID != 2 || entries[0].Time != 1700000000 || entries[0].Duration != 2e6 || len(entries[0].Args) != 2 || entries[0].Args[1] != "k" || entries[0].ClientAddr != "127.0.0.1:5000" || entries[0].ClientName != "web" {
+        t.Fatal("SlowlogGet failed", entries)
+    }
+    if n, err := c.SlowlogLen(); err != nil || n != 2 {
+        t.Fatal("SlowlogLen failed", n)
+    }
+    if err := c.SlowlogReset(); err != nil {
+        t.Fatal("SlowlogReset failed", err.String())
+    }
+
+    events, err := c.LatencyLatest()
+    if err != nil || len(events) != 1 || events[0].Event != "command" || events[0].Latest != 25e6 || events[0].Max != 40e6 {
+        t.Fatal("LatencyLatest failed", events)
+    }
+    samples, err := c.LatencyHistory("command")
+    if err != nil || len(samples) != 2 || samples[1].Time != 1700000010 || samples[1].Latency != 25e6 {
+        t.Fatal("LatencyHistory failed", samples)
+    }
+    if doctor, err := c.LatencyDoctor(); err != nil || !strings.HasPrefix(doctor, "Dave") {
+        t.Fatal("LatencyDoctor failed", doctor)
+    }
+    if n, err := c.LatencyReset(); err != nil || n != 1 {
+        t.Fatal("LatencyReset failed", n)
+    }
+}
+
+func TestSlowlogPoll(t *testing.T) {
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal("Listen failed", err.String())
+    }
+    defer l.Close()
+
+    // the slowlog as the poller sees it on each call
+    polls := make(chan string, 4)
+    polls <- slowlogReply(5)
+    polls <- slowlogReply(7, 6, 5)
+    polls <- slowlogReply(8, 7, 6)
+    polls <- slowlogReply(2, 1)
+    go serveFunc(l, func(args []string) string {
+        select {
+        case reply := <-polls:
+            return reply
+        default:
+        }
+        return slowlogReply(2, 1)
+    })
+
+    entries, stop := NewClient(l.Addr().String(), 0, "").SlowlogPoll(1e6, nil)
+    var ids []int64
+    timeout := time.After(5e9)
+    for len(ids) < 5 {
+        select {
+        case e := <-entries:
+            ids = append(ids, e.ID)
+        case <-timeout:
+            t.Fatal("SlowlogPoll didn't send every new entry", ids)
+        }
+    }
+    stop()
+    if fmt.Sprint(ids) != "[6 7 8 1 2]" {
+        t.Fatal("SlowlogPoll failed", ids)
+    }
+    for _ = range entries {
+    }
+}
+
+func TestParseMonitorLine(t *testing.T) {
+    e, err := parseMonitorLine(`1339518083.107412 [13 127.0.0.1:60866] "set" "k" "a \"quoted\" value\r\n" "\xff\\"`)
+    if err != nil {
+        t.Fatal("parseMonitorLine failed", err.String())
+    }
+    if e.Time != 1339518083107412000 || e.DB != 13 || e.Addr != "127.0.0.1:60866" || e.Command != "set" {
+        t.Fatal("parseMonitorLine failed", e)
+    }
+    if len(e.Args) != 3 || e.Args[0] != "k" || e.Args[1] != "a \"quoted\" value\r\n" || e.Args[2] != "\xff\\" {
+        t.Fatal("parseMonitorLine failed to unquote", e.Args)
+    }
+
+    e, err = parseMonitorLine(`1339518083.000001 [0 lua] "get" "k"`)
+    if err != nil || e.Addr != "lua" || e.Time != 1339518083000001000 || len(e.Args) != 1 {
+        t.Fatal("parseMonitorLine failed for a script", e)
+    }
+
+    for _, line := range []string{"OK", `1339518083.1 [0 lua] "unterminated`, `x.1 [0 lua] "get"`} {
+        if _, err := parseMonitorLine(line); err == nil {
+            t.Fatal("parseMonitorLine should fail for", line)
+        }
+    }
+}
+
+func TestMonitor(t *testing.T) {
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal("Listen failed", err.String())
+    }
+    defer l.Close()
+    go func() {
+        c, err := l.Accept()
+        if err != nil {
+            return
+        }
+        readResponse(bufio.NewReader(c))
+        c.Write([]byte("+OK\r\n+1339518083.107412 [0 127.0.0.1:60866] \"get\" \"a\"\r\n+garbage\r\n+1339518084.000000 [1 lua] \"del\" \"b\"\r\n"))
+        // stays open until the monitor stops
+        readResponse(bufio.NewReader(c))
+        c.Close()
+    }()
+
+    events, stop, err := NewClient(l.Addr().String(), 0, "").Monitor()
+    if err != nil {
+        t.Fatal("Monitor failed", err.String())
+    }
+    e1, e2 := <-events, <-events
+    if e1 == nil || e1.Command != "get" || e1.Args[0] != "a" || e2 == nil || e2.DB != 1 || e2.Command != "del" {
+        t.Fatal("Monitor failed", e1, e2)
+    }
+    stop()
+    if _, ok := <-events; ok {
+        t.Fatal("Monitor should close the channel once stopped")
+    }
+    // stopping again does nothing
+    stop()
+}
+
+func receive(t *testing.T, messages <-chan Message) Message {
+    select {
+    case msg := <-messages:
+        return msg
+    case <-time.After(5e9):
+        t.Fatal("no message received")
+    }
+    return Message{}
+}
+
+func TestPubSub(t *testing.T) {
+    p, err := NewPubSub(client)
+    if err != nil {
+        t.Fatal("NewPubSub failed", err.String())
+    }
+    if err := p.Subscribe("ps1", "ps2"); err != nil {
+        t.Fatal("PubSub.Subscribe failed", err.String())
+    }
+    if err := p.PSubscribe("ps.*"); err != nil {
+        t.Fatal("PubSub.PSubscribe failed", err.String())
+    }
+
+    if n, err := client.Publish("ps2", []byte("a")); err != nil || n != 1 {
+        t.Fatal("Publish should return the number of receivers", n)
+    }
+    if msg := receive(t, p.Messages()); msg.Channel != "ps2" || msg.ChannelMatched != "ps2" || string(msg.Message) != "a" {
+        t.Fatal("PubSub failed to deliver a message", msg)
+    }
+    client.Publish("ps.x", []byte("b"))
+    if msg := receive(t, p.Messages()); msg.Channel != "ps.x" || msg.ChannelMatched != "ps.*" || string(msg.Message) != "b" {
+        t.Fatal("PubSub failed to deliver a pattern message", msg)
+    }
+
+    if err := p.Unsubscribe("ps2"); err != nil {
+        t.Fatal("PubSub.Unsubscribe failed", err.String())
+    }
+    if err := p.PUnsubscribe("ps.*"); err != nil {
+        t.Fatal("PubSub.PUnsubscribe failed", err.String())
+    }
+    client.Publish("ps2", []byte("dropped"))
+    client.Publish("ps.x", []byte("dropped"))
+    client.Publish("ps1", []byte("c"))
+    if msg := receive(t, p.Messages()); msg.Channel != "ps1" || string(msg.Message) != "c" {
+        t.Fatal("PubSub should have unsubscribed", msg)
+    }
+
+    channels, err := client.PubsubChannels("ps*")
+    if err != nil || len(channels) != 1 || channels[0] != "ps1" {
+        t.Fatal("PubsubChannels failed", channels)
+    }
+    counts, err := client.PubsubNumsub("ps1", "ps2")
+    if err != nil || len(counts) != 2 || counts["ps1"] != 1 || counts["ps2"] != 0 {
+        t.Fatal("PubsubNumsub failed", counts)
+    }
+    p.PSubscribe("a.*", "b.*")
+    if n, err := client.PubsubNumpat(); err != nil || n != 2 {
+        t.Fatal("PubsubNumpat failed", n)
+    }
+
+    if err := p.Subscribe(); err == nil {
+        t.Fatal("PubSub.Subscribe should fail without channels")
+    }
+    if err := p.Close(); err != nil {
+        t.Fatal("PubSub.Close failed", err.String())
+    }
+    if _, ok := <-p.Messages(); ok {
+        t.Fatal("PubSub.Close should close the messages channel")
+    }
+    if err := p.Subscribe("ps1"); err != ErrClosed {
+        t.Fatal("PubSub.Subscribe should fail once closed", err)
+    }
+}
+
+func TestShardedPubSub(t *testing.T) {
+    p, err := NewPubSub(client)
+    if err != nil {
+        t.Fatal("NewPubSub failed", err.String())
+    }
+    defer p.Close()
+    if err := p.SSubscribe("shard1"); err != nil {
+        t.Fatal("PubSub.SSubscribe failed", err.String())
+    }
+
+    if n, err := client.Spublish("shard1", []byte("a")); err != nil || n != 1 {
+        t.Fatal("Spublish failed", n)
+    }
+    if msg := receive(t, p.Messages()); msg.Channel != "shard1" || string(msg.Message) != "a" {
+        t.Fatal("PubSub failed to deliver a shard message", msg)
+    }
+
+    channels, err := client.PubsubShardchannels("")
+    if err != nil || len(channels) != 1 || channels[0] != "shard1" {
+        t.Fatal("PubsubShardchannels failed", channels)
+    }
+    if counts, err := client.PubsubShardnumsub("shard1"); err != nil || counts["shard1"] != 1 {
+        t.Fatal("PubsubShardnumsub failed", counts)
+    }
+
+    if err := p.SUnsubscribe("shard1"); err != nil {
+        t.Fatal("PubSub.SUnsubscribe failed", err.String())
+    }
+    if n, _ := client.Spublish("shard1", []byte("b")); n != 0 {
+        t.Fatal("PubSub.SUnsubscribe failed", n)
+    }
+}
+
+func TestPubSubReconnect(t *testing.T) {
+    defer func(keepalive int64) { pubsubKeepalive = keepalive }(pubsubKeepalive)
+    pubsubKeepalive = 50e6
+
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal("Listen failed", err.String())
+    }
+    defer l.Close()
+    go func() {
+        for i := 0; ; i++ {
+            c, err := l.Accept()
+            if err != nil {
+                return
+            }
+            reader := bufio.NewReader(c)
+            readResponse(reader)
+            c.Write([]byte("*3\r\n" + bulk("subscribe") + bulk("news") + ":1\r\n"))
+            switch i {
+            case 0:
+                // drop the connection
+                c.Close()
+            case 1:
+                // go silent, ignoring pings until the client gives up
+                for {
+                    if _, err := readResponse(reader); err != nil {
+                        break
+                    }
+                }
+            default:
+                c.Write([]byte("*3\r\n" + bulk("message") + bulk("news") + bulk("back") + "\r\n"))
+                readResponse(reader)
+            }
+        }
+    }()
+
+    p, err := NewPubSub(NewClient(l.Addr().String(), 0, ""))
+    if err != nil {
+        t.Fatal("NewPubSub failed", err.String())
+    }
+    defer p.Close()
+    if err := p.Subscribe("news"); err != nil {
+        t.Fatal("PubSub.Subscribe failed", err.String())
+    }
+    if msg := receive(t, p.Messages()); msg.Channel != "news" || string(msg.Message) != "back" {
+        t.Fatal("PubSub should have resubscribed", msg)
+    }
+}
+
+func TestPubSubRefused(t *testing.T) {
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal("Listen failed", err.String())
+    }
+    defer l.Close()
+    accepted := make(chan bool, 4)
+    go func() {
+        for {
+            c, err := l.Accept()
+            if err != nil {
+                return
+            }
+            accepted <- true
+            reader := bufio.NewReader(c)
+            for {
+                res, err := readResponse(reader)
+                if err != nil {
+                    break
+                }
+                args, _ := Strings(res, nil)
+                switch strings.ToUpper(args[0]) {
+                case "SSUBSCRIBE":
+                    c.Write([]byte("-ERR unknown command 'SSUBSCRIBE'\r\n"))
+                case "SUBSCRIBE":
+                    c.Write([]byte("*3\r\n" + bulk("subscribe") + bulk(args[1]) + ":1\r\n"))
+                    c.Write([]byte("*3\r\n" + bulk("message") + bulk(args[1]) + bulk("still here")))
+                }
+            }
+            c.Close()
+        }
+    }()
+
+    p, err := NewPubSub(NewClient(l.Addr().String(), 0, ""))
+    if err != nil {
+        t.Fatal("NewPubSub failed", err.String())
+    }
+    defer p.Close()
+    if err := p.SSubscribe("shard1"); err == nil {
+        t.Fatal("PubSub.SSubscribe should fail when redis refuses it")
+    }
+    // the connection is kept
+    if err := p.Subscribe("news"); err != nil {
+        t.Fatal("PubSub.Subscribe failed after a refused command", err.String())
+    }
+    if msg := receive(t, p.Messages()); string(msg.Message) != "still here" {
+        t.Fatal("PubSub should keep reading after a refused command", msg)
+    }
+    if len(accepted) != 1 {
+        t.Fatal("PubSub shouldn't reconnect after a refused command", len(accepted))
+    }
+}
+
+type payload struct {
+    Name  string
+    Count int
+}
+
+func TestPublishValue(t *testing.T) {
+    values := make(chan *payload, 4)
+    failures := make(chan Message, 4)
+    handler := func(channel string, v interface{}) { values <- v.(*payload) }
+    onError := func(msg Message, err os.Error) { failures <- msg }
+
+    if _, err := client.SubscribeValues(nil, nil, handler, onError, "typed"); err == nil {
+        t.Fatal("SubscribeValues should fail without an example")
+    }
+
+    for _, codec := range []Codec{JSONCodec, GobCodec} {
+        p, err := client.SubscribeValues(codec, payload{}, handler, onError, "typed")
+        if err != nil {
+            t.Fatal("SubscribeValues failed", err.String())
+        }
+
+        if n, err := client.PublishValue(codec, "typed", payload{"a", 1}); err != nil || n != 1 {
+            t.Fatal("PublishValue failed", n, err)
+        }
+        select {
+        case v := <-values:
+            if v.Name != "a" || v.Count != 1 {
+                t.Fatal("SubscribeValues decoded the wrong value", v)
+            }
+        case <-time.After(5e9):
+            t.Fatal("SubscribeValues received nothing")
+        }
+
+        client.Publish("typed", []byte("not a payload"))
+        select {
+        case msg := <-failures:
+            if string(msg.Message) != "not a payload" {
+                t.Fatal("SubscribeValues passed the wrong message to onError", msg)
+            }
+        case <-values:
+            t.Fatal("SubscribeValues should have failed to decode")
+        case <-time.After(5e9):
+            t.Fatal("SubscribeValues dropped an undecodable message")
+        }
+        p.Close()
+    }
+}
+
+func TestParseKeyspaceMessage(t *testing.T) {
+    if p := KeyspacePattern(13, "user:*"); p != "__keyspace@13__:user:*" {
+        t.Fatal("KeyspacePattern failed", p)
+    }
+    if p := KeyeventPattern(-1, "expired"); p != "__keyevent@*__:expired" {
+        t.Fatal("KeyeventPattern failed", p)
+    }
+
+    e, ok := ParseKeyspaceMessage(Message{"__keyspace@*__:*", "__keyspace@13__:user:1", []byte("set")})
+    if !ok || e.DB != 13 || e.Key != "user:1" || e.Op != "set" {
+        t.Fatal("ParseKeyspaceMessage failed", e)
+    }
+    e, ok = ParseKeyspaceMessage(Message{"__keyevent@0__:*", "__keyevent@0__:expired", []byte("session:a:b")})
+    if !ok || e.DB != 0 || e.Key != "session:a:b" || e.Op != "expired" {
+        t.Fatal("ParseKeyspaceMessage failed for a keyevent", e)
+    }
+    for _, channel := range []string{"news", "__keyspace@x__:k", "__keyevent@0"} {
+        if _, ok := ParseKeyspaceMessage(Message{channel, channel, nil}); ok {
+            t.Fatal("ParseKeyspaceMessage should fail for", channel)
+        }
+    }
+}
+
+func pmessage(pattern string, channel string, message string) string {
+    return "*4\r\n" + bulk("pmessage") + bulk(pattern) + bulk(channel) + bulk(message)
+}
+
+func TestSubscribeKeyspace(t *testing.T) {
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal("Listen failed", err.String())
+    }
+    defer l.Close()
+    pattern := KeyeventPattern(0, "*")
+    go serveReplies(l, map[string]string{
+        "CONFIG SET": "+OK\r\n",
+        "PING":       "+PONG\r\n",
+        "PSUBSCRIBE " + strings.ToUpper(pattern): "*3\r\n" + bulk("psubscribe") + bulk(pattern) + ":1\r\n" +
+            pmessage(pattern, "__keyevent@0__:del", "a") + pmessage("other", "other", "x") + pmessage(pattern, "__keyevent@0__:expired", "b"),
+    })
+
+    events := make(chan KeyspaceEvent)
+    stop := make(chan bool)
+    done := make(chan os.Error)
+    go func() {
+        done <- NewClient(l.Addr().String(), 0, "").SubscribeKeyspace("Ex", []string{pattern}, events, stop)
+    }()
+
+    e1, e2 := <-events, <-events
+    if e1.Key != "a" || e1.Op != "del" || e2.Key != "b" || e2.Op != "expired" {
+        t.Fatal("SubscribeKeyspace failed", e1, e2)
+    }
+    close(stop)
+    select {
+    case err := <-done:
+        if err != nil {
+            t.Fatal("SubscribeKeyspace failed", err.String())
+        }
+    case <-time.After(5e9):
+        t.Fatal("SubscribeKeyspace didn't return once stopped")
+    }
+}
+
+// polls cond for up to five seconds
+func waitUntil(t *testing.T, what string, cond func() bool) {
+    for i := 0; !cond(); i++ {
+        if i == 500 {
+            t.Fatal("timed out waiting for", what)
+        }
+        time.Sleep(10e6)
+    }
+}
+
+func TestCache(t *testing.T) {
+    cache := NewCache(client, 10, 0)
+    defer cache.Close()
+
+    client.Set("cached", []byte("a"))
+    if v, err := cache.Get("cached"); err != nil || string(v) != "a" {
+        t.Fatal("Cache.Get failed", v, err)
+    }
+    if cache.Len() != 1 {
+        t.Fatal("Cache.Get should have cached the value")
+    }
+    client.Set("cached", []byte("b"))
+    waitUntil(t, "the invalidation", func() bool { return cache.Len() == 0 })
+    if v, err := cache.Get("cached"); err != nil || string(v) != "b" {
+        t.Fatal("Cache.Get returned a stale value", v, err)
+    }
+
+    client.Hset("cachedh", "f", []byte("1"))
+    m := map[string][]byte{}
+    if err := cache.Hgetall("cachedh", m); err != nil || string(m["f"]) != "1" {
+        t.Fatal("Cache.Hgetall failed", m, err)
+    }
+    if _, err := cache.Get("cachedh"); err == nil {
+        t.Fatal("Cache.Get should fail on a hash")
+    }
+    if err := cache.Hgetall("cachednx", m); err != ErrNil {
+        t.Fatal("Cache.Hgetall should return ErrNil for a missing key", err)
+    }
+}
+
+func TestCacheInvalidation(t *testing.T) {
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal("Listen failed", err.String())
+    }
+    defer l.Close()
+    invals := make(chan net.Conn, 4)
+    tracked := make(chan net.Conn, 8)
+    gets := make(chan bool, 100)
+    go func() {
+        for {
+            c, err := l.Accept()
+            if err != nil {
+                return
+            }
+            go func(c net.Conn) {
+                reader := bufio.NewReader(c)
+                for {
+                    res, err := readResponse(reader)
+                    if err != nil {
+                        break
+                    }
+                    args, _ := Strings(res, nil)
+                    if len(args) == 1 {
+                        c.Write([]byte("+PONG\r\n"))
+                        continue
+                    }
+                    switch strings.Join(args[:2], " ") {
+                    case "CLIENT ID":
+                        c.Write([]byte(":7\r\n"))
+                    case "CLIENT TRACKING":
+                        c.Write([]byte("+OK\r\n"))
+                        tracked <- c
+                    case "SUBSCRIBE " + invalidateChannel:
+                        c.Write([]byte("*3\r\n" + bulk("subscribe") + bulk(invalidateChannel) + ":1\r\n"))
+                        invals <- c
+                    default:
+                        gets <- true
+                        c.Write([]byte(bulk(args[1])))
+                    }
+                }
+                c.Close()
+            }(c)
+        }
+    }()
+    get := func(cache *Cache, key string, reads int) {
+        if v, err := cache.Get(key); err != nil || string(v) != key {
+            t.Fatal("Cache.Get failed", v, err)
+        }
+        if len(gets) != reads {
+            t.Fatal("Cache.Get should have read", key, "from redis", reads, len(gets))
+        }
+    }
+
+    cache := NewCache(NewClient(l.Addr().String(), 0, ""), 2, 0)
+    defer cache.Close()
+    get(cache, "a", 1)
+    get(cache, "a", 1)
+    inval := <-invals
+
+    inval.Write([]byte("*3\r\n" + bulk("message") + bulk(invalidateChannel) + "*1\r\n" + bulk("a")))
+    waitUntil(t, "the invalidation", func() bool { return cache.Len() == 0 })
+    get(cache, "a", 2)
+
+    // c evicts a, the least recently used
+    get(cache, "b", 3)
+    get(cache, "c", 4)
+    get(cache, "b", 4)
+    get(cache, "a", 5)
+    if cache.Len() != 2 {
+        t.Fatal("Cache should hold two values", cache.Len())
+    }
+
+    // a nil list of keys means the database was flushed
+    inval.Write([]byte("*3\r\n" + bulk("message") + bulk(invalidateChannel) + "*-1\r\n"))
+    waitUntil(t, "the flush", func() bool { return cache.Len() == 0 })
+
+    get(cache, "a", 6)
+    inval.Close()
+    waitUntil(t, "the flush on disconnect", func() bool { return cache.Len() == 0 })
+    get(cache, "a", 7)
+    <-invals
+    get(cache, "a", 7)
+
+    short := NewCache(NewClient(l.Addr().String(), 0, ""), 0, 20e6)
+    defer short.Close()
+    get(short, "d", 8)
+    get(short, "d", 8)
+    time.Sleep(30e6)
+    get(short, "d", 9)
+
+    // losing the tracked connection flushes the cache too, even though
+    // only hits are read
+    for len(tracked) > 0 {
+        <-tracked
+    }
+    lost := NewCache(NewClient(l.Addr().String(), 0, ""), 0, 0)
+    defer lost.Close()
+    lost.interval = 20e6
+    get(lost, "e", 10)
+    get(lost, "e", 10)
+    (<-tracked).Close()
+    waitUntil(t, "the flush on losing the tracked connection", func() bool { return lost.Len() == 0 })
+
+    cache.Close()
+    if _, err := cache.Get("a"); err != ErrCacheClosed {
+        t.Fatal("Cache.Get should fail once closed", err)
+    }
+}
+
+// a fake sentinel monitoring mymaster, at the address master returns.
+// Subscribed connections are passed to subs.
+func serveSentinel(l net.Listener, master func() string, subs chan<- net.Conn) {
+    for {
+        c, err := l.Accept()
+        if err != nil {
+            return
+        }
+        go func(c net.Conn) {
+            reader := bufio.NewReader(c)
+            for {
+                res, err := readResponse(reader)
+                if err != nil {
+                    break
+                }
+                args, _ := Strings(res, nil)
+                switch strings.ToUpper(args[0]) {
+                case "SENTINEL":
+                    if args[2] != "mymaster" {
+                        c.Write([]byte("*-1\r\n"))
+                        break
+                    }
+                    hostPort := strings.Split(master(), ":")
+                    c.Write([]byte("*2\r\n" + bulk(hostPort[0]) + bulk(hostPort[1])))
+                case "SUBSCRIBE":
+                    c.Write([]byte("*3\r\n" + bulk("subscribe") + bulk(args[1]) + ":1\r\n"))
+                    subs <- c
+                case "PING":
+                    c.Write([]byte("*2\r\n" + bulk("pong") + bulk("")))
+                }
+            }
+            c.Close()
+        }(c)
+    }
+}
+
+func TestSentinel(t *testing.T) {
+    masterRole := "*3\r\n" + bulk("master") + ":0\r\n*0\r\n"
+    var servers []net.Listener
+    listen := func() net.Listener {
+        l, err := net.Listen("tcp", "127.0.0.1:0")
+        if err != nil {
+            t.Fatal("Listen failed", err.String())
+        }
+        servers = append(servers, l)
+        return l
+    }
+    defer func() {
+        for _, l := range servers {
+            l.Close()
+        }
+    }()
+
+    m1, m2, replica := listen(), listen(), listen()
+    go serveReplies(m1, map[string]string{"ROLE": masterRole, "GET": bulk("m1")})
+    go serveReplies(m2, map[string]string{"ROLE": masterRole, "GET": bulk("m2")})
+    go serveReplies(replica, map[string]string{"ROLE": "*5\r\n" + bulk("slave") + bulk("127.0.0.1") + ":6379\r\n" + bulk("connected") + ":0\r\n"})
+
+    var lock sync.Mutex
+    master := m1.Addr().String()
+    subs := make(chan net.Conn, 4)
+    // the first sentinel is down and the second hasn't noticed a failover
+    dead, behind, good := listen(), listen(), listen()
+    dead.Close()
+    go serveSentinel(behind, func() string { return replica.Addr().String() }, make(chan net.Conn, 4))
+    go serveSentinel(good, func() string {
+        lock.Lock()
+        defer lock.Unlock()
+        return master
+    }, subs)
+    sentinels := []string{dead.Addr().String(), behind.Addr().String(), good.Addr().String()}
+
+    c := NewClient("", 0, "")
+    if _, err := NewSentinel(c, sentinels[:1], "mymaster"); err == nil || c.checkAddr {
+        t.Fatal("NewSentinel should fail without a live sentinel and leave the client alone", err)
+    }
+    s, err := NewSentinel(c, sentinels, "mymaster")
+    if err != nil {
+        t.Fatal("NewSentinel failed", err.String())
+    }
+    defer s.Close()
+    if v, err := c.Get("k"); err != nil || string(v) != "m1" {
+        t.Fatal("NewSentinel should point the client at the master", v, err)
+    }
+
+    sub := <-subs
+    lock.Lock()
+    master = m2.Addr().String()
+    lock.Unlock()
+    notice := "mymaster " + strings.Replace(m1.Addr().String(), ":", " ", 1) + " " + strings.Replace(m2.Addr().String(), ":", " ", 1)
+    sub.Write([]byte("*3\r\n" + bulk("message") + bulk("+switch-master") + bulk(notice)))
+    waitUntil(t, "the failover", func() bool {
+        v, _ := c.Get("k")
+        return string(v) == "m2"
+    })
+    if addr, err := s.Resolve(); err != nil || addr != m2.Addr().String() {
+        t.Fatal("Sentinel.Resolve failed", addr, err)
+    }
+
+    if _, err := NewSentinel(NewClient("", 0, ""), sentinels, "other"); err == nil {
+        t.Fatal("NewSentinel should fail for an unknown master")
+    }
+    if _, err := NewSentinel(NewClient("", 0, ""), sentinels[:2], "mymaster"); err == nil {
+        t.Fatal("NewSentinel should fail when no master confirms its role")
+    }
+}
+
+func TestKeySlot(t *testing.T) {
+    if crc := crc16([]byte("123456789")); crc != 0x31c3 {
+        t.Fatalf("crc16 failed: %x", crc)
+    }
+    if slot := KeySlot("foo"); slot != 12182 {
+        t.Fatal("KeySlot failed", slot)
+    }
+    tags := map[string]string{
+        "{user1000}.following": "user1000",
+        "foo{bar}{zap}":        "bar",
+        "foo{{bar}}zap":        "{bar",
+        "foo{}{bar}":           "foo{}{bar}",
+        "foo{bar":              "foo{bar",
+    }
+    for key, hashed := range tags {
+        if KeySlot(key) != KeySlot(hashed) {
+            t.Fatal("KeySlot should only hash", hashed, "of", key)
+        }
+    }
+}
+
+// a fake cluster whose nodes serve GET, SET, MGET, MSET, DEL and EXISTS
+// for the slots they own, redirecting like redis does
+type mockCluster struct {
+    lock  sync.Mutex
+    addrs []string
+    owner []int
+    // slots being migrated, to the node importing them
+    importing map[int]int
+    data      []map[string]string
+    // whether CLUSTER SHARDS is supported
+    shards bool
+    // when set, nodes hang up on commands instead of replying, counting
+    // them in hangups
+    hangup  bool
+    hangups int
+}
+
+func newMockCluster(t *testing.T, n int) (*mockCluster, func()) {
+    m := &mockCluster{owner: make([]int, clusterSlots), importing: make(map[int]int)}
+    var listeners []net.Listener
+    for i := 0; i < n; i++ {
+        l, err := net.Listen("tcp", "127.0.0.1:0")
+        if err != nil {
+            t.Fatal("Listen failed", err.String())
+        }
+        listeners = append(listeners, l)
+        m.addrs = append(m.addrs, l.Addr().String())
+        m.data = append(m.data, make(map[string]string))
+        go m.serve(l, i)
+    }
+    for slot := range m.owner {
+        m.owner[slot] = slot * n / clusterSlots
+    }
+    return m, func() {
+        for _, l := range listeners {
+            l.Close()
+        }
+    }
+}
+
+func (m *mockCluster) serve(l net.Listener, node int) {
+    for {
+        c, err := l.Accept()
+        if err != nil {
+            return
+        }
+        go func(c net.Conn) {
+            reader := bufio.NewReader(c)
+            asking := false
+            for {
+                res, err := readResponse(reader)
+                if err != nil {
+                    break
+                }
+                args, _ := Strings(res, nil)
+                m.lock.Lock()
+                reply := m.reply(node, args, asking)
+                hangup := m.hangup && strings.ToUpper(args[0]) != "CLUSTER"
+                if hangup {
+                    m.hangups++
+                }
+                m.lock.Unlock()
+                if hangup {
+                    break
+                }
+                asking = strings.ToUpper(args[0]) == "ASKING"
+                c.Write([]byte(reply))
+            }
+            c.Close()
+        }(c)
+    }
+}
+
+func (m *mockCluster) reply(node int, args []string, asking bool) string {
+    cmd := strings.ToUpper(args[0])
+    switch cmd {
+    case "ASKING":
+        return "+OK\r\n"
+    case "CLUSTER":
+        if strings.ToUpper(args[1]) == "SLOTS" {
+            return m.slotsReply()
+        }
+        if m.shards {
+            return m.shardsReply()
+        }
+        return "-ERR unknown subcommand 'SHARDS'. Try CLUSTER HELP.\r\n"
+    }
+
+    var keys []string
+    for i := 1; i < len(args); i++ {
+        keys = append(keys, args[i])
+        if cmd == "SET" || cmd == "MSET" {
+            i++
+        }
+    }
+    slot := KeySlot(keys[0])
+    for _, key := range keys {
+        if KeySlot(key) != slot {
+            return "-CROSSSLOT Keys in request don't hash to the same slot\r\n"
+        }
+    }
+    owner := m.owner[slot]
+    if to, ok := m.importing[slot]; ok && node == owner {
+        return "-ASK " + strconv.Itoa(slot) + " " + m.addrs[to] + "\r\n"
+    } else if node != owner && !(ok && node == to && asking) {
+        return "-MOVED " + strconv.Itoa(slot) + " " + m.addrs[owner] + "\r\n"
+    }
+
+    data := m.data[node]
+    switch cmd {
+    case "GET":
+        v, ok := data[keys[0]]
+        if !ok {
+            return "$-1\r\n"
+        }
+        return bulk(v)
+    case "SET", "MSET":
+        for i := 1; i+1 < len(args); i += 2 {
+            data[args[i]] = args[i+1]
+        }
+        return "+OK\r\n"
+    case "MGET":
+        reply := "*" + strconv.Itoa(len(keys)) + "\r\n"
+        for _, key := range keys {
+            if v, ok := data[key]; ok {
+                reply += bulk(v)
+            } else {
+                reply += "$-1\r\n"
+            }
+        }
+        return reply
+    }
+    n := 0
+    for _, key := range keys {
+        if _, ok := data[key]; ok {
+            n++
+            if cmd == "DEL" {
+                data[key] = "", false
+            }
+        }
+    }
+    return ":" + strconv.Itoa(n) + "\r\n"
+}
+
+// returns the slot ranges each node owns, as start, end pairs
+func (m *mockCluster) ranges() [][]int {
+    ranges := make([][]int, len(m.addrs))
+    for slot, node := range m.owner {
+        r := ranges[node]
+        if len(r) > 0 && r[len(r)-1] == slot-1 {
+            r[len(r)-1] = slot
+        } else {
+            r = append(r, slot, slot)
+        }
+        ranges[node] = r
+    }
+    return ranges
+}
+
+func (m *mockCluster) slotsReply() string {
+    reply, count := "", 0
+    for node, r := range m.ranges() {
+        hostPort := strings.Split(m.addrs[node], ":")
+        for i := 0; i < len(r); i += 2 {
+            reply += "*3\r\n:" + strconv.Itoa(r[i]) + "\r\n:" + strconv.Itoa(r[i+1]) + "\r\n"
+            reply += "*3\r\n" + bulk(hostPort[0]) + ":" + hostPort[1] + "\r\n" + bulk("node"+strconv.Itoa(node))
+            count++
+        }
+    }
+    return "*" + strconv.Itoa(count) + "\r\n" + reply
+}
+
+func (m *mockCluster) shardsReply() string {
+    reply := "*" + strconv.Itoa(len(m.addrs)) + "\r\n"
+    for node, r := range m.ranges() {
+        hostPort := strings.Split(m.addrs[node], ":")
+        reply += "*4\r\n" + bulk("slots") + "*" + strconv.Itoa(len(r)) + "\r\n"
+        for _, slot := range r {
+            reply += ":" + strconv.Itoa(slot) + "\r\n"
+        }
+        reply += bulk("nodes") + "*2\r\n"
+        reply += "*10\r\n" + bulk("id") + bulk("node"+strconv.Itoa(node)) + bulk("port") + ":" + hostPort[1] + "\r\n"
+        reply += bulk("ip") + bulk(hostPort[0]) + bulk("endpoint") + bulk(hostPort[0]) + bulk("role") + bulk("master")
+        // a replica, which shouldn't be used
+        reply += "*6\r\n" + bulk("port") + ":1\r\n" + bulk("ip") + bulk("10.0.0.1") + bulk("role") + bulk("replica")
+    }
+    return reply
+}
+
+// moves a slot, and the keys in it, to another node
+func (m *mockCluster) move(slot int, to int) {
+    m.lock.Lock()
+    defer m.lock.Unlock()
+
+    from := m.owner[slot]
+    for key, v := range m.data[from] {
+        if KeySlot(key) == slot {
+            m.data[to][key] = v
+            m.data[from][key] = "", false
+        }
+    }
+    m.owner[slot] = to
+}
+
+func TestClusterClient(t *testing.T) {
+    m, stop := newMockCluster(t, 3)
+    defer stop()
+
+    for _, shards := range []bool{false, true} {
+        m.lock.Lock()
+        m.shards = shards
+        m.lock.Unlock()
+        c, err := NewClusterClient([]string{"127.0.0.1:1", m.addrs[1]}, "")
+        if err != nil {
+            t.Fatal("NewClusterClient failed", err.String())
+        }
+        for slot := 0; slot < clusterSlots; slot += 1000 {
+            if addr := c.SlotAddr(slot); addr != m.addrs[m.owner[slot]] {
+                t.Fatal("NewClusterClient loaded the wrong slot map", shards, slot, addr)
+            }
+        }
+    }
+
+    c, _ := NewClusterClient(m.addrs[:1], "")
+    keys := []string{"a", "b", "c", "d", "e", "f"}
+    for _, key := range keys {
+        if err := c.Set(key, []byte("v"+key)); err != nil {
+            t.Fatal("ClusterClient.Set failed", err.String())
+        }
+        m.lock.Lock()
+        _, ok := m.data[m.owner[KeySlot(key)]][key]
+        m.lock.Unlock()
+        if !ok {
+            t.Fatal("ClusterClient.Set sent", key, "to the wrong node")
+        }
+    }
+    vals, err := c.Mget(append(keys, "missing")...)
+    if err != nil || len(vals) != 7 || string(vals[0]) != "va" || string(vals[5]) != "vf" || vals[6] != nil {
+        t.Fatal("ClusterClient.Mget failed", vals, err)
+    }
+    if err := c.Mset(map[string][]byte{"{t}1": []byte("1"), "{t}2": []byte("2"), "g": []byte("vg")}); err != nil {
+        t.Fatal("ClusterClient.Mset failed", err.String())
+    }
+    if n, err := c.Exists("{t}1", "{t}2", "g", "missing"); err != nil || n != 3 {
+        t.Fatal("ClusterClient.Exists failed", n, err)
+    }
+    if n, err := c.Del("a", "b", "missing"); err != nil || n != 2 {
+        t.Fatal("ClusterClient.Del failed", n, err)
+    }
+    if v, err := c.Do("GET", "c"); err != nil || string(v.([]byte)) != "vc" {
+        t.Fatal("ClusterClient.Do failed", v, err)
+    }
+
+    // MOVED updates the slot map
+    slot := KeySlot("c")
+    to := (m.owner[slot] + 1) % 3
+    m.move(slot, to)
+    if v, err := c.Get("c"); err != nil || string(v) != "vc" {
+        t.Fatal("ClusterClient should follow MOVED", v, err)
+    }
+    if addr := c.SlotAddr(slot); addr != m.addrs[to] {
+        t.Fatal("MOVED should update the slot map", addr)
+    }
+    waitUntil(t, "the slot map refresh", func() bool {
+        c.lock.Lock()
+        defer c.lock.Unlock()
+        return !c.refreshing
+    })
+
+    // ASK doesn't
+    slot = KeySlot("d")
+    from := m.owner[slot]
+    m.lock.Lock()
+    to = (from + 1) % 3
+    m.importing[slot] = to
+    m.data[to]["d"] = "vd"
+    m.data[from]["d"] = "", false
+    m.lock.Unlock()
+    if v, err := c.Get("d"); err != nil || string(v) != "vd" {
+        t.Fatal("ClusterClient should follow ASK", v, err)
+    }
+    if addr := c.SlotAddr(slot); addr != m.addrs[from] {
+        t.Fatal("ASK shouldn't update the slot map", addr)
+    }
+
+    // a command that was sent may have been applied, so it isn't resent
+    // when the reply is lost
+    m.lock.Lock()
+    m.hangup = true
+    m.lock.Unlock()
+    if err := c.Set("e", []byte("ve2")); err == nil {
+        t.Fatal("ClusterClient.Set should fail when the reply is lost")
+    }
+    m.lock.Lock()
+    hangups := m.hangups
+    m.hangup = false
+    m.lock.Unlock()
+    if hangups != 1 {
+        t.Fatal("ClusterClient shouldn't resend a command that was sent", hangups)
+    }
+
+    if _, err := NewClusterClient([]string{"127.0.0.1:1"}, ""); err == nil {
+        t.Fatal("NewClusterClient should fail without a node")
+    }
+}
+
+func TestReplicaClient(t *testing.T) {
+    var servers []net.Listener
+    listen := func(name string, replies map[string]string) string {
+        l, err := net.Listen("tcp", "127.0.0.1:0")
+        if err != nil {
+            t.Fatal("Listen failed", err.String())
+        }
+        servers = append(servers, l)
+        replies["GET"] = bulk(name)
+        replies["PING"] = "+PONG\r\n"
+        replies["SET"] = "+OK\r\n"
+        go serveReplies(l, replies)
+        return l.Addr().String()
+    }
+    defer func() {
+        for _, l := range servers {
+            l.Close()
+        }
+    }()
+    replica1 := listen("r1", map[string]string{})
+    replica2 := listen("r2", map[string]string{})
+    role := "*3\r\n" + bulk("master") + ":10\r\n*2\r\n"
+    for _, addr := range []string{replica1, replica2} {
+        hostPort := strings.Split(addr, ":")
+        role += "*3\r\n" + bulk(hostPort[0]) + bulk(hostPort[1]) + bulk("10")
+    }
+    master := listen("master", map[string]string{"ROLE": role})
+
+    get := func(c *ReplicaClient, expected string) {
+        if v, err := c.Get("k"); err != nil || string(v) != expected {
+            t.Fatal("ReplicaClient.Get should have read from", expected, string(v), err)
+        }
+    }
+
+    c, err := NewReplicaClient(NewClient(master, 0, ""), nil, RoundRobin, 0)
+    if err != nil {
+        t.Fatal("NewReplicaClient failed", err.String())
+    }
+    for _, expected := range []string{"r1", "r2", "r1", "r2"} {
+        get(c, expected)
+    }
+    if err := c.Set("k", []byte("v")); err != nil {
+        t.Fatal("ReplicaClient.Set failed", err.String())
+    }
+
+    // reads follow writes to the master for the pinning window
+    pinned, _ := NewReplicaClient(NewClient(master, 0, ""), []string{replica1}, RoundRobin, 50e6)
+    get(pinned, "r1")
+    pinned.Set("k", []byte("v"))
+    get(pinned, "master")
+    time.Sleep(60e6)
+    get(pinned, "r1")
+
+    // reads sent to the master follow it when it moves, e.g. on failover
+    promoted := listen("promoted", map[string]string{})
+    pinned.client.setAddr(promoted)
+    pinned.Set("k", []byte("v"))
+    get(pinned, "promoted")
+
+    // the window starts once a write finishes, however long it took
+    slow, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal("Listen failed", err.String())
+    }
+    servers = append(servers, slow)
+    go serveFunc(slow, func(args []string) string {
+        if strings.ToUpper(args[0]) == "SET" {
+            time.Sleep(60e6)
+            return "+OK\r\n"
+        }
+        return bulk("slow")
+    })
+    slowPinned, _ := NewReplicaClient(NewClient(slow.Addr().String(), 0, ""), []string{replica1}, RoundRobin, 50e6)
+    slowPinned.Set("k", []byte("v"))
+    get(slowPinned, "slow")
+
+    // replicas that are down are skipped
+    down, _ := NewReplicaClient(NewClient(master, 0, ""), []string{"127.0.0.1:1", replica2}, RoundRobin, 0)
+    get(down, "master")
+    get(down, "r2")
+    get(down, "r2")
+
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal("Listen failed", err.String())
+    }
+    servers = append(servers, l)
+    go serveFunc(l, func(args []string) string {
+        time.Sleep(20e6)
+        return bulk("slow")
+    })
+    fast := listen("fast", map[string]string{})
+    nearest, _ := NewReplicaClient(NewClient(master, 0, ""), []string{l.Addr().String(), fast}, LowestLatency, 0)
+    defer nearest.Close()
+    get(nearest, "fast")
+    get(nearest, "fast")
+
+    // servers before 2.8.12 only report replicas in INFO
+    info := "# Replication\r\nrole:master\r\nconnected_slaves:2\r\n"
+    info += "slave0:ip=127.0.0.1,port=" + strings.Split(replica1, ":")[1] + ",state=online,offset=1,lag=0\r\n"
+    info += "slave1:ip=127.0.0.1,port=1,state=wait_bgsave,offset=0,lag=0\r\n"
+    old := listen("master", map[string]string{"INFO": bulk(info)})
+    c, err = NewReplicaClient(NewClient(old, 0, ""), nil, RoundRobin, 0)
+    if err != nil {
+        t.Fatal("NewReplicaClient failed", err.String())
+    }
+    get(c, "r1")
+    get(c, "r1")
+}
+
+func TestBitmaps(t *testing.T) {
+    // daily active users, by user id
+    for _, id := range []int64{1, 3, 9} {
+        client.Setbit("active:mon", id, true)
+    }
+    for _, id := range []int64{3, 4} {
+        client.Setbit("active:tue", id, true)
+    }
+
+    if old, err := client.Setbit("active:mon", 9, false); err != nil || !old {
+        t.Fatal("Setbit failed", err)
+    }
+    if bit, err := client.Getbit("active:mon", 3); err != nil || !bit {
+        t.Fatal("Getbit failed", err)
+    }
+    if bit, _ := client.Getbit("active:mon", 9); bit {
+        t.Fatal("Setbit should have cleared the bit")
+    }
+
+    if n, err := client.Bitcount("active:mon"); err != nil || n != 2 {
+        t.Fatal("Bitcount failed", n)
+    }
+    client.Setbit("active:mon", 20, true)
+    if n, err := client.BitcountRange("active:mon", 1, -1, false); err != nil || n != 1 {
+        t.Fatal("BitcountRange failed", n)
+    }
+
+    if n, err := client.Bitop(BitOr, "active:both", "active:mon", "active:tue"); err != nil || n != 3 {
+        t.Fatal("Bitop failed", n)
+    }
+    if n, _ := client.Bitcount("active:both"); n != 4 {
+        t.Fatal("Bitop OR failed", n)
+    }
+    client.Bitop(BitAnd, "active:both", "active:mon", "active:tue")
+    if n, _ := client.Bitcount("active:both"); n != 1 {
+        t.Fatal("Bitop AND failed", n)
+    }
+
+    if pos, err := client.Bitpos("active:tue", true); err != nil || pos != 3 {
+        t.Fatal("Bitpos failed", pos)
+    }
+    if pos, err := client.BitposRange("active:mon", true, 1, -1, false); err != nil || pos != 20 {
+        t.Fatal("BitposRange failed", pos)
+    }
+    if pos, _ := client.Bitpos("missing", true); pos != -1 {
+        t.Fatal("Bitpos should return -1", pos)
+    }
+
+    client.Del("active:mon", "active:tue", "active:both")
+}
+
+func TestBitfield(t *testing.T) {
+    b := NewBitfield("bf").Set("u8", 0, 200).Incrby("u8", 0, 100).Overflow(OverflowSat).Incrby("u8", 8, 300).Overflow(OverflowFail).Incrby("i8", 16, 200).Get("u8", 0)
+    res, err := client.Bitfield(b)
+    if err != nil {
+        t.Fatal("Bitfield failed", err.String())
+    }
+    if len(res) != 5 || *res[0] != 0 || *res[1] != 44 || *res[2] != 255 || res[3] != nil || *res[4] != 44 {
+        t.Fatal("Bitfield failed", res)
+    }
+
+    vals, err := client.BitfieldRo(NewBitfield("bf").Get("u8", 8).Get("i8", 0))
+    if err != nil || len(vals) != 2 || vals[0] != 255 || vals[1] != 44 {
+        t.Fatal("BitfieldRo failed", vals)
+    }
+
+    if n, err := client.BitcountRange("bf", 8, 15, true); err != nil || n != 8 {
+        t.Fatal("BitcountRange in bits failed", n)
+    }
+
+    client.Del("bf")
+}
+
+func TestHyperLogLog(t *testing.T) {
+    if changed, err := client.Pfadd("hll1", []byte("a"), []byte("b"), []byte("c")); err != nil || !changed {
+        t.Fatal("Pfadd failed", err)
+    }
+    if changed, _ := client.Pfadd("hll1", []byte("a")); changed {
+        t.Fatal("Pfadd shouldn't change the count for a known element")
+    }
+    client.Pfadd("hll2", []byte("c"), []byte("d"))
+
+    if n, err := client.Pfcount("hll1"); err != nil || n != 3 {
+        t.Fatal("Pfcount failed", n)
+    }
+    if n, err := client.Pfcount("hll1", "hll2"); err != nil || n != 4 {
+        t.Fatal("Pfcount with several keys failed", n)
+    }
+    if err := client.Pfmerge("hll3", "hll1", "hll2"); err != nil {
+        t.Fatal("Pfmerge failed", err.String())
+    }
+    if n, _ := client.Pfcount("hll3"); n != 4 {
+        t.Fatal("Pfmerge failed", n)
+    }
+
+    client.Del("hll1", "hll2", "hll3")
+}
+
+func TestHllWindow(t *testing.T) {
+    if _, err := NewHllWindow(client, "visitors:", 0, 86400); err == nil {
+        t.Fatal("NewHllWindow should reject a zero interval")
+    }
+    w, err := NewHllWindow(client, "visitors:", 3600, 86400)
+    if err != nil {
+        t.Fatal("NewHllWindow failed", err.String())
+    }
+    hour := time.Seconds()
+    hour -= hour % 3600
+
+    // a long expired interval is ignored rather than expiring at once
+    if err := w.Add(hour-2*86400, []byte("mallory")); err != nil {
+        t.Fatal("HllWindow.Add of an expired interval failed", err.String())
+    }
+    if n, _ := client.Exists(w.Key(hour - 2*86400)); n != 0 {
+        t.Fatal("HllWindow.Add shouldn't write an expired interval")
+    }
+
+    w.Add(hour, []byte("alice"), []byte("bob"))
+    w.Add(hour+3599, []byte("carol"))
+    w.Add(hour+3600, []byte("alice"), []byte("dave"))
+
+    if key := w.Key(hour + 10); key != "visitors:"+strconv.Itoa64(hour) {
+        t.Fatal("HllWindow.Key failed", key)
+    }
+    if ttl, _ := client.Ttl(w.Key(hour)); ttl <= 86400 || ttl > 86400+3600 {
+        t.Fatal("HllWindow.Add should set an expiration", ttl)
+    }
+
+    if n, err := w.Count(hour, hour+3600); err != nil || n != 3 {
+        t.Fatal("HllWindow.Count failed", n)
+    }
+    if n, err := w.Count(hour+60, hour+3601); err != nil || n != 4 {
+        t.Fatal("HllWindow.Count over two hours failed", n)
+    }
+
+    if err := w.Merge("visitors:day", hour, hour+7200, 60); err != nil {
+        t.Fatal("HllWindow.Merge failed", err.String())
+    }
+    if n, _ := client.Pfcount("visitors:day"); n != 4 {
+        t.Fatal("HllWindow.Merge failed", n)
+    }
+    if ttl, _ := client.Ttl("visitors:day"); ttl <= 0 || ttl > 60 {
+        t.Fatal("HllWindow.Merge should set an expiration", ttl)
+    }
+
+    client.Del(w.Key(hour), w.Key(hour+3600), "visitors:day")
+}
+
+var (
+    palermo = GeoMember{[]byte("Palermo"), GeoPos{13.361389, 38.115556}}
+    catania = GeoMember{[]byte("Catania"), GeoPos{15.087269, 37.502669}}
+)
+
+func TestGeo(t *testing.T) {
+    if n, err := client.Geoadd("sicily", 0, palermo, catania); err != nil || n != 2 {
+        t.Fatal("Geoadd failed", n)
+    }
+
+    dist, err := client.Geodist("sicily", []byte("Palermo"), []byte("Catania"), Kilometers)
+    if err != nil || math.Fabs(dist-166.2742) > 0.001 {
+        t.Fatal("Geodist failed", dist)
+    }
+    if _, err := client.Geodist("sicily", []byte("Palermo"), []byte("Rome"), Meters); err != ErrNil {
+        t.Fatal("Geodist should return ErrNil", err)
+    }
+
+    pos, err := client.Geopos("sicily", []byte("Palermo"), []byte("Rome"))
+    if err != nil {
+        t.Fatal("Geopos failed", err.String())
+    }
+    if len(pos) != 2 || pos[1] != nil || math.Fabs(pos[0].Longitude-13.361389) > 0.0001 || math.Fabs(pos[0].Latitude-38.115556) > 0.0001 {
+        t.Fatal("Geopos failed", pos)
+    }
+    if pos, _ = client.Geopos("sicily", []byte("Rome")); len(pos) != 1 || pos[0] != nil {
+        t.Fatal("Geopos should return nil for missing members", pos)
+    }
+
+    client.Del("sicily")
+}
+
+func TestGeosearch(t *testing.T) {
+    client.Geoadd("sicily", 0, palermo, catania)
+    if n, err := client.Geoadd("sicily", ZaddNX, GeoMember{[]byte("Palermo"), GeoPos{0, 0}}); err != nil || n != 0 {
+        t.Fatal("Geoadd with ZaddNX failed", n)
+    }
+
+    locs, err := client.Geosearch("sicily", &GeoQuery{Pos: GeoPos{15, 37}, Radius: 200, Unit: Kilometers, Sort: "ASC"})
+    if err != nil {
+        t.Fatal("Geosearch failed", err.String())
+    }
+    if len(locs) != 2 || string(locs[0].Member) != "Catania" || math.Fabs(locs[0].Dist-56.4413) > 0.001 || locs[0].Hash == 0 || math.Fabs(locs[1].Pos.Longitude-13.361389) > 0.0001 {
+        t.Fatal("Geosearch failed", locs)
+    }
+
+    locs, err = client.Geosearch("sicily", &GeoQuery{Member: []byte("Palermo"), Width: 400, Height: 400, Unit: Kilometers, Sort: "DESC", Count: 1})
+    if err != nil || len(locs) != 1 || string(locs[0].Member) != "Catania" {
+        t.Fatal("Geosearch by box failed", locs)
+    }
+
+    n, err := client.Geosearchstore("near", "sicily", &GeoQuery{Pos: GeoPos{15, 37}, Radius: 100, Unit: Kilometers}, true)
+    if err != nil || n != 1 {
+        t.Fatal("Geosearchstore failed", n)
+    }
+    if dist, _ := client.Zscore("near", []byte("Catania")); math.Fabs(dist-56.4413) > 0.001 {
+        t.Fatal("Geosearchstore with storeDist failed", dist)
+    }
+
+    client.Del("sicily", "near")
+}
+
+func TestStream(t *testing.T) {
+    var ids []string
+    for i := 0; i < 5; i++ {
+        id, err := client.Xadd("st", "*", false, nil, event{"click", i})
+        if err != nil {
+            t.Fatal("Xadd failed", err.String())
+        }
+        ids = append(ids, id)
+    }
+
+    if _, err := client.Xadd("missing", "*", true, nil, map[string]string{"a": "b"}); err != ErrNil {
+        t.Fatal("Xadd with NOMKSTREAM should return ErrNil", err)
+    }
+
+    if n, err := client.Xlen("st"); err != nil || n != 5 {
+        t.Fatal("Xlen failed", n)
+    }
+
+    entries, err := client.Xrange("st", "-", "+", 2)
+    if err != nil {
+        t.Fatal("Xrange failed", err.String())
+    }
+    if len(entries) != 2 || entries[0].ID != ids[0] || string(entries[1].Fields["Count"]) != "1" {
+        t.Fatal("Xrange failed", entries)
+    }
+    var ev event
+    if err := entries[1].Decode(&ev); err != nil || ev.Kind != "click" || ev.Count != 1 {
+        t.Fatal("StreamEntry.Decode failed", ev)
+    }
+
+    entries, err = client.Xrevrange("st", "+", ids[2], 0)
+    if err != nil {
+        t.Fatal("Xrevrange failed", err.String())
+    }
+    if len(entries) != 3 || entries[0].ID != ids[4] || entries[2].ID != ids[2] {
+        t.Fatal("Xrevrange failed", entries)
+    }
+
+    client.Xadd("st2", "*", false, nil, map[string]string{"a": "b"})
+    streams, err := client.Xread(map[string]string{"st": ids[3], "st2": "0"}, 10, -1)
+    if err != nil {
+        t.Fatal("Xread failed", err.String())
+    }
+    if len(streams) != 2 || len(streams["st"]) != 1 || streams["st"][0].ID != ids[4] || string(streams["st2"][0].Fields["a"]) != "b" {
+        t.Fatal("Xread failed", streams)
+    }
+
+    if streams, err = client.Xread(map[string]string{"st": "$"}, 0, 10); err != nil || streams != nil {
+        t.Fatal("Xread should have timed out", streams)
+    }
+
+    if n, err := client.Xdel("st", ids[0], "0-1"); err != nil || n != 1 {
+        t.Fatal("Xdel failed", n)
+    }
+    if n, err := client.Xtrim("st", StreamTrim{MaxLen: 2}); err != nil || n != 2 {
+        t.Fatal("Xtrim failed", n)
+    }
+    if _, err := client.Xadd("st", "*", false, &StreamTrim{MinID: ids[4]}, map[string]string{"a": "b"}); err != nil {
+        t.Fatal("Xadd with trimming failed", err.String())
+    }
+    if n, _ := client.Xlen("st"); n != 2 {
+        t.Fatal("Xadd should have trimmed the stream", n)
+    }
+
+    client.Del("st", "st2")
+}
+
+func TestStreamGroups(t *testing.T) {
+    if err := client.XgroupCreate("sg", "workers", "$", true); err != nil {
+        t.Fatal("XgroupCreate failed", err.String())
+    }
+    id1, _ := client.Xadd("sg", "*", false, nil, map[string]string{"job": "1"})
+    id2, _ := client.Xadd("sg", "*", false, nil, map[string]string{"job": "2"})
+
+    streams, err := client.Xreadgroup("workers", "alice", map[string]string{"sg": ">"}, 0, -1, false)
+    if err != nil {
+        t.Fatal("Xreadgroup failed", err.String())
+    }
+    if len(streams["sg"]) != 2 || streams["sg"][1].ID != id2 {
+        t.Fatal("Xreadgroup failed", streams)
+    }
+
+    pending, err := client.Xpending("sg", "workers", 0, "-", "+", 10, "")
+    if err != nil {
+        t.Fatal("Xpending failed", err.String())
+    }
+    if len(pending) != 2 || pending[0].ID != id1 || pending[0].Consumer != "alice" || pending[0].Deliveries != 1 {
+        t.Fatal("Xpending failed", pending)
+    }
+
+    if n, err := client.Xack("sg", "workers", id1); err != nil || n != 1 {
+        t.Fatal("Xack failed", n)
+    }
+
+    next, entries, _, err := client.Xautoclaim("sg", "workers", "bob", 0, "0-0", 10)
+    if err != nil {
+        t.Fatal("Xautoclaim failed", err.String())
+    }
+    if next != "0-0" || len(entries) != 1 || entries[0].ID != id2 || string(entries[0].Fields["job"]) != "2" {
+        t.Fatal("Xautoclaim failed", next, entries)
+    }
+
+    entries, err = client.Xclaim("sg", "workers", "alice", 0, id2)
+    if err != nil || len(entries) != 1 {
+        t.Fatal("Xclaim failed", entries)
+    }
+    if pending, _ = client.Xpending("sg", "workers", 0, "-", "+", 10, "alice"); len(pending) != 1 || pending[0].Deliveries != 3 {
+        t.Fatal("Xclaim should have moved the entry back to alice", pending)
+    }
+
+    // pending entries deleted from the stream come back without fields
+    id3, _ := client.Xadd("sg", "*", false, nil, map[string]string{"job": "3"})
+    client.Xreadgroup("workers", "alice", map[string]string{"sg": ">"}, 0, -1, false)
+    client.Xdel("sg", id3)
+    streams, err = client.Xreadgroup("workers", "alice", map[string]string{"sg": "0"}, 0, -1, false)
+    if err != nil {
+        t.Fatal("Xreadgroup of a deleted pending entry failed", err.String())
+    }
+    if e := streams["sg"]; len(e) != 2 || e[0].ID != id2 || e[0].Fields == nil || e[1].ID != id3 || e[1].Fields != nil {
+        t.Fatal("Xreadgroup should return deleted pending entries with nil fields", e)
+    }
+
+    if ok, err := client.XgroupDestroy("sg", "workers"); err != nil || !ok {
+        t.Fatal("XgroupDestroy failed", err)
+    }
+    client.Del("sg")
+}
+
+func TestStreamConsumer(t *testing.T) {
+    handled := make(chan string, 10)
+    failed := false
+    consumer := NewStreamConsumer(client, "jobs", "workers", "alice", func(entry *StreamEntry) os.Error {
+        job := string(entry.Fields["job"])
+        // fail the first attempt at job 2, so it has to be reclaimed
+        if job == "2" && !failed {
+            failed = true
+            return os.NewError("failed")
+        }
+        handled <- job
+        return nil
+    })
+    // stopping a consumer that isn't running does nothing
+    consumer.Stop()
+
+    // a pending entry deleted from the stream is just acknowledged
+    client.XgroupCreate("jobs", "workers", "$", true)
+    deleted, _ := client.Xadd("jobs", "*", false, nil, map[string]string{"job": "deleted"})
+    client.Xreadgroup("workers", "alice", map[string]string{"jobs": ">"}, 0, -1, false)
+    client.Xdel("jobs", deleted)
+
+    consumer.BlockMs = 50
+    consumer.MinIdleMs = 100
+    consumer.Concurrency = 2
+    if err := consumer.Start(); err != nil {
+        t.Fatal("StreamConsumer.Start failed", err.String())
+    }
+
+    for i := 1; i <= 3; i++ {
+        client.Xadd("jobs", "*", false, nil, map[string]int{"job": i})
+    }
+
+    seen := map[string]bool{}
+    timeout := time.After(5e9)
+    for len(seen) < 3 {
+        select {
+        case job := <-handled:
+            seen[job] = true
+        case <-timeout:
+            t.Fatal("StreamConsumer didn't handle every entry", seen)
+        }
+    }
+    consumer.Stop()
+    consumer.Stop()
+
+    if !failed {
+        t.Fatal("StreamConsumer handler wasn't retried")
+    }
+    if pending, _ := client.Xpending("jobs", "workers", 0, "-", "+", 10, ""); len(pending) != 0 {
+        t.Fatal("StreamConsumer should have acknowledged every entry", pending)
+    }
+
+    client.Del("jobs")
+}
+
+func TestEval(t *testing.T) {
+    res, err := client.Eval("return {1, 'two', {KEYS[1], ARGV[1]}, redis.status_reply('OK'), redis.error_reply('oops')}", []string{"k"}, 3.5)
+    if err != nil {
+        t.Fatal("Eval failed", err.String())
+    }
+    expected := []interface{}{int64(1), []byte("two"), []interface{}{[]byte("k"), []byte("3.5")}, "OK", RedisError("oops")}
+    if !reflect.DeepEqual(res, expected) {
+        t.Fatalf("Eval failed: %#v", res)
+    }
+
+    if _, err := client.Eval("return redis.error_reply('ERR oops')", nil); err == nil || err.String() != "Redis Error: oops" {
+        t.Fatal("Eval should return a top-level error reply as an error", err)
+    }
+}
+
+func TestScript(t *testing.T) {
+    if err := client.ScriptFlush(); err != nil {
+        t.Fatal("ScriptFlush failed", err.String())
+    }
+
+    script := NewScript("return redis.call('INCRBY', KEYS[1], ARGV[1])")
+    if exists, err := client.ScriptExists(script.Hash()); err != nil || exists[0] {
+        t.Fatal("ScriptExists should be false after a flush", exists)
+    }
+
+    // the first run falls back to EVAL, which caches the script
+    if n, err := Int(script.Run(client, []string{"counter"}, 2)); err != nil || n != 2 {
+        t.Fatal("Script.Run failed", n, err)
+    }
+    if exists, err := client.ScriptExists(script.Hash(), "0000"); err != nil || !reflect.DeepEqual(exists, []bool{true, false}) {
+        t.Fatal("ScriptExists failed", exists)
+    }
+    if n, err := Int(script.Run(client, []string{"counter"}, 3)); err != nil || n != 5 {
+        t.Fatal("Script.Run failed", n, err)
+    }
+
+    sha, err := client.ScriptLoad("return ARGV[1]")
+    if err != nil {
+        t.Fatal("ScriptLoad failed", err.String())
+    }
+    if s, err := String(client.Evalsha(sha, nil, "hi")); err != nil || s != "hi" {
+        t.Fatal("Evalsha failed", s)
+    }
+
+    client.Del("counter")
+}
+
+func TestFunction(t *testing.T) {
+    code := "#!lua name=testlib\nredis.register_function('echo', function(keys, args) return args[1] end)"
+    name, err := client.FunctionLoad(code, true)
+    if err != nil {
+        t.Fatal("FunctionLoad failed", err.String())
+    }
+    if name != "testlib" {
+        t.Fatal("FunctionLoad returned the wrong library", name)
+    }
+    if s, err := String(client.Fcall("echo", nil, "hi")); err != nil || s != "hi" {
+        t.Fatal("Fcall failed", s)
+    }
+    if err := client.FunctionDelete("testlib"); err != nil {
+        t.Fatal("FunctionDelete failed", err.String())
+    }
+}
+
+func verifyHash(t *testing.T, key string, expected map[string][]byte) {
+    //test Hget
+    m1 := make(map[string][]byte)
+    for k, _ := range expected {
+        actual, err := client.Hget(key, k)
+        if err != nil {
+            t.Fatal("verifyHash Hget failed", err.String())
+        }
+        m1[k] = actual
+    }
+    if !reflect.DeepEqual(m1, expected) {
+        t.Fatal("verifyHash Hget failed")
+    }
+
+    //test Hkeys
+    keys, err := client.Hkeys(key)
+    if err != nil {
+        t.Fatal("verifyHash Hkeys failed", err.String())
+    }
+    if len(keys) != len(expected) {
+        fmt.Printf("%v\n", keys)
+        t.Fatal("verifyHash Hkeys failed - length not equal")
+    }
+    for _, key := range keys {
+        if expected[key] == nil {
+            t.Fatal("verifyHash Hkeys failed missing key", key)
+        }
+    }
+
+    //test Hvals
+    vals, err := client.Hvals(key)
+    if err != nil {
+        t.Fatal("verifyHash Hvals failed", err.String())
+    }
+    if len(vals) != len(expected) {
+        t.Fatal("verifyHash Hvals failed")
+    }
+
+    m2 := map[string][]byte{}
+    //test Hgetall
+    err = client.Hgetall(key, m2)
+    if err != nil {
+        t.Fatal("verifyHash Hgetall failed", err.String())
+    }
+    if !reflect.DeepEqual(m2, expected) {
+        t.Fatal("verifyHash Hgetall failed")
+    }
+}
+
+func TestSortedSet(t *testing.T) {
+    svals := []string{"a", "b", "c", "d", "e"}
+    ranks := []float64{0.0, 1.0, 2.0, 3.0, 4.0}
+    vals := make([][]byte, len(svals))
+    for i := 0; i < len(svals); i++ {
+        vals[i] = []byte(svals[i])
+        _, err := client.Zadd("zs", 0, ScoredMember{vals[i], ranks[i]})
+        if err != nil {
+            t.Fatal("zdd failed" + err.String())
+        }
+        score, err := client.Zscore("zs", vals[i])
+        if err != nil {
+            t.Fatal("zscore failed" + err.String())
+        }
+        if score != ranks[i] {
+            t.Fatal("zscore failed")
+        }
+    }
+
+    card, err := client.Zcard("zs")
+    if err != nil {
+        t.Fatal("zcard failed" + err.String())
+    }
+    if card != 5 {
+        t.Fatal("zcard failed", card)
+    }
+    for i := 0; i <= 4; i++ {
+        data, _ := client.Zrange("zs", 0, i)
+        if !reflect.DeepEqual(data, vals[0:i+1]) {
+            t.Fatal("zrange failed")
+        }
+    }
+    for i := 0; i <= 4; i++ {
+        data, _ := client.Zrangebyscore("zs", Inclusive(0), Inclusive(float64(i)), 0, -1)
+        if !reflect.DeepEqual(data, vals[0:i+1]) {
+            t.Fatal("zrangebyscore failed")
+        }
+    }
+    //incremement
+    for i := 0; i <= 4; i++ {
+        client.Zincrby("zs", vals[i], 1)
+
+        score, err := client.Zscore("zs", vals[i])
+        if err != nil {
+            t.Fatal("zscore failed" + err.String())
+        }
+        if score != ranks[i]+1 {
+            t.Fatal("zscore failed")
+        }
+    }
+
+    for i := 0; i <= 4; i++ {
+        client.Zincrby("zs", vals[i], -1)
+    }
+
+    //clean up
+    _, err = client.Zrem("zs", []byte("a"))
+    if err != nil {
+        t.Fatal("zrem failed" + err.String())
+    }
+
+    _, err = client.Zremrangebyrank("zs", 0, 1)
+    if err != nil {
+        t.Fatal("zremrangebynrank failed" + err.String())
+    }
+
+    _, err = client.Zremrangebyscore("zs", 3, 4)
+    if err != nil {
+        t.Fatal("zremrangebyscore failed" + err.String())
+    }
+
+    card, err = client.Zcard("zs")
+    if err != nil {
+        t.Fatal("zcard failed" + err.String())
+    }
+    if card != 0 {
+        t.Fatal("zcard failed", card)
+    }
+
+    client.Del("zs")
+}
+
+func TestSortedSetRanges(t *testing.T) {
+    members := []string{"a", "b", "c", "d", "e"}
+    for i, m := range members {
+        client.Zadd("zs", 0, ScoredMember{[]byte(m), float64(i) + 0.5})
+    }
+
+    scored, err := client.ZrangeWithScores("zs", 0, -1)
+    if err != nil {
+        t.Fatal("zrange withscores failed", err.String())
+    }
+    if len(scored) != 5 || string(scored[1].Member) != "b" || scored[1].Score != 1.5 {
+        t.Fatal("zrange withscores failed", scored)
+    }
+
+    scored, err = client.ZrevrangeWithScores("zs", 0, 0)
+    if err != nil {
+        t.Fatal("zrevrange withscores failed", err.String())
+    }
+    if len(scored) != 1 || string(scored[0].Member) != "e" || scored[0].Score != 4.5 {
+        t.Fatal("zrevrange withscores failed", scored)
+    }
+
+    data, err := client.Zrangebyscore("zs", Exclusive(1.5), MaxScore, 0, -1)
+    if err != nil {
+        t.Fatal("zrangebyscore failed", err.String())
+    }
+    if !reflect.DeepEqual(data, [][]byte{[]byte("c"), []byte("d"), []byte("e")}) {
+        t.Fatal("zrangebyscore exclusive failed")
+    }
+
+    data, err = client.Zrangebyscore("zs", MinScore, MaxScore, 1, 2)
+    if err != nil {
+        t.Fatal("zrangebyscore failed", err.String())
+    }
+    if !reflect.DeepEqual(data, [][]byte{[]byte("b"), []byte("c")}) {
+        t.Fatal("zrangebyscore limit failed")
+    }
+
+    scored, err = client.ZrevrangebyscoreWithScores("zs", Exclusive(4.5), MinScore, 0, 1)
+    if err != nil {
+        t.Fatal("zrevrangebyscore failed", err.String())
+    }
+    if len(scored) != 1 || string(scored[0].Member) != "d" || scored[0].Score != 3.5 {
+        t.Fatal("zrevrangebyscore withscores failed", scored)
+    }
+
+    if n, err := client.Zcount("zs", Inclusive(1.5), Exclusive(3.5)); err != nil || n != 2 {
+        t.Fatal("zcount failed", n)
+    }
+
+    client.Del("zs")
+
+    for _, m := range members {
+        client.Zadd("zl", 0, ScoredMember{[]byte(m), 0})
+    }
+
+    data, err = client.Zrangebylex("zl", ExclusiveLex([]byte("b")), InclusiveLex([]byte("d")), 0, -1)
+    if err != nil {
+        t.Fatal("zrangebylex failed", err.String())
+    }
+    if !reflect.DeepEqual(data, [][]byte{[]byte("c"), []byte("d")}) {
+        t.Fatal("zrangebylex failed")
+    }
+
+    if n, err := client.Zlexcount("zl", MinLex, ExclusiveLex([]byte("c"))); err != nil || n != 2 {
+        t.Fatal("zlexcount failed", n)
+    }
+
+    client.Del("zl")
+}
+
+func TestZaddFlags(t *testing.T) {
+    n, err := client.Zadd("zs", 0, ScoredMember{[]byte("a"), 1}, ScoredMember{[]byte("b"), 2}, ScoredMember{[]byte("c"), 3})
+    if err != nil {
+        t.Fatal("zadd failed", err.String())
+    }
+    if n != 3 {
+        t.Fatal("zadd failed, expected 3 members added but got", n)
+    }
+
+    if n, _ = client.Zadd("zs", ZaddNX, ScoredMember{[]byte("a"), 10}, ScoredMember{[]byte("d"), 4}); n != 1 {
+        t.Fatal("zadd nx failed", n)
+    }
+    if n, _ = client.Zadd("zs", ZaddXX|ZaddCH, ScoredMember{[]byte("a"), 5}, ScoredMember{[]byte("e"), 5}); n != 1 {
+        t.Fatal("zadd xx ch failed", n)
+    }
+    if n, _ = client.Zadd("zs", ZaddGT|ZaddCH, ScoredMember{[]byte("a"), 0}, ScoredMember{[]byte("b"), 6}); n != 1 {
+        t.Fatal("zadd gt ch failed", n)
+    }
+
+    scores, err := client.Zmscore("zs", []byte("a"), []byte("e"), []byte("b"))
+    if err != nil {
+        t.Fatal("zmscore failed", err.String())
+    }
+    if len(scores) != 3 || *scores[0] != 5 || scores[1] != nil || *scores[2] != 6 {
+        t.Fatal("zmscore failed", scores)
+    }
+
+    if score, ok, err := client.Zaddincr("zs", 0, []byte("c"), 1.5); err != nil || !ok || score != 4.5 {
+        t.Fatal("zadd incr failed", score)
+    }
+    if _, ok, err := client.Zaddincr("zs", ZaddNX, []byte("c"), 1); err != nil || ok {
+        t.Fatal("zadd incr nx should not have updated")
+    }
+
+    popped, err := client.Zpopmin("zs", 2)
+    if err != nil {
+        t.Fatal("zpopmin failed", err.String())
+    }
+    if len(popped) != 2 || string(popped[0].Member) != "d" || string(popped[1].Member) != "c" || popped[1].Score != 4.5 {
+        t.Fatal("zpopmin failed", popped)
+    }
+
+    popped, err = client.Zpopmax("zs", 1)
+    if err != nil {
+        t.Fatal("zpopmax failed", err.String())
+    }
+    if len(popped) != 1 || string(popped[0].Member) != "b" || popped[0].Score != 6 {
+        t.Fatal("zpopmax failed", popped)
+    }
+
+    client.Del("zs")
+}
+
+func TestBzpopmin(t *testing.T) {
+    go func() {
+        time.Sleep(100 * 1000)
+        if _, err := client.Zadd("zs", 0, ScoredMember{[]byte("a"), 5}); err != nil {
+            t.Fatal("Zadd failed", err.String())
+        }
+    }()
+    key, member, err := client.Bzpopmin([]string{"zs"}, 1)
+    if err != nil {
+        t.Fatal("Bzpopmin failed", err.String())
+    }
+    if *key != "zs" {
+        t.Fatalf("Expected %s but got %s", "zs", *key)
+    }
+    if string(member.Member) != "a" || member.Score != 5 {
+        t.Fatalf("Expected a/5 but got %s/%v", string(member.Member), member.Score)
+    }
+}
+
+func TestBzpopmaxTimeout(t *testing.T) {
+    key, member, err := client.Bzpopmax([]string{"zs"}, 1)
+    if err != nil {
+        t.Fatal("BzpopmaxTimeout failed", err.String())
+    }
+    if key != nil {
+        t.Fatalf("Expected nil but got '%s'", *key)
+    }
+    if member != nil {
+        t.Fatalf("Expected nil but got '%v'", member)
+    }
 }
 
 type tt struct {
@@ -759,7 +3172,7 @@ func BenchmarkJsonFieldSet(b *testing.B) {
 
 func BenchmarkZadd(b *testing.B) {
     for i := 0; i < b.N; i++ {
-        client.Zadd("zrs", []byte("hi"+strconv.Itoa(i)), float64(i))
+        client.Zadd("zrs", 0, ScoredMember{[]byte("hi" + strconv.Itoa(i)), float64(i)})
     }
     client.Del("zrs")
 }
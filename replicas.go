@@ -0,0 +1,377 @@
+package redis
+
+import (
+    "net"
+    "os"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// How a ReplicaClient picks the replica for each read.
+type ReplicaSelect int
+
+const (
+    // Each replica in turn.
+    RoundRobin ReplicaSelect = iota
+    // The replica that answered the latest PING fastest. Replicas are
+    // pinged every replicaPingInterval.
+    LowestLatency
+)
+
+var replicaPingInterval int64 = 1e9
+
+// How long a replica that failed is left out of the rotation.
+const replicaRetryDelay = 1e9
+
+// A client that sends the read methods below to replicas and every other
+// command to the master. Reads go to the master while no replica is up.
+//
+// Replicas lag behind the master, so a read that follows a write may not
+// see it. To avoid that, reads go to the master for a while after each
+// command sent to it; see NewReplicaClient.
+type ReplicaClient struct {
+    *client
+    mode     ReplicaSelect
+    pin      int64
+    interval int64
+    // sends reads to the master, through its pool, without pinning
+    masterReads *client
+    closing     chan bool
+
+    // guards the fields below
+    lock     sync.Mutex
+    replicas []*replica
+    next     int
+    closed   bool
+}
+
+type replica struct {
+    client    *client
+    latency   int64
+    downUntil int64
+}
+
+// Creates a client for master and the replicas at the given addresses,
+// or if there are none, the replicas the master reports. After each
+// command sent to the master, reads go to it for pin nanoseconds; 0
+// disables pinning.
+func NewReplicaClient(master *client, replicas []string, mode ReplicaSelect, pin int64) (*ReplicaClient, os.Error) {
+    c := new(ReplicaClient)
+    c.client = master
+    c.mode = mode
+    c.pin = pin
+    c.interval = replicaPingInterval
+    c.masterReads = NewClient("", master.db, master.password)
+    c.masterReads.parent = master
+    c.masterReads.pool = master.pool
+    c.closing = make(chan bool)
+
+    if replicas == nil {
+        err := c.Discover()
+        if err != nil {
+            return nil, err
+        }
+    } else {
+        c.SetReplicas(replicas)
+    }
+
+    if mode == LowestLatency {
+        c.MeasureLatency()
+        go c.measure()
+    }
+    return c, nil
+}
+
+// Replaces the replicas with the given addresses.
+func (self *ReplicaClient) SetReplicas(addrs []string) {
+    replicas := make([]*replica, len(addrs))
+    for i, addr := range addrs {
+        c := NewClient(addr, self.client.db, self.client.password)
+        c.name = self.client.clientName()
+        replicas[i] = &replica{client: c}
+    }
+
+    self.lock.Lock()
+    old := self.replicas
+    self.replicas = replicas
+    self.next = 0
+    self.lock.Unlock()
+
+    for _, r := range old {
+        r.client.drainPool()
+    }
+}
+
+// Replaces the replicas with those the master reports in ROLE, or in
+// INFO replication for servers before 2.8.12.
+func (self *ReplicaClient) Discover() os.Error {
+    var addrs []string
+    role, err := self.masterReads.Role()
+    if err == nil {
+        for _, r := range role.Replicas {
+            addrs = append(addrs, r.Addr)
+        }
+    } else {
+        if _, ok := err.(RedisError); !ok {
+            return err
+        }
+        addrs, err = self.infoReplicas()
+        if err != nil {
+            return err
+        }
+    }
+
+    self.SetReplicas(addrs)
+    return nil
+}
+
+// reads the online replicas from lines like
+// slave0:ip=127.0.0.1,port=6380,state=online,offset=1,lag=0
+func (self *ReplicaClient) infoReplicas() ([]string, os.Error) {
+    info, err := self.masterReads.Info("replication")
+    if err != nil {
+        return nil, err
+    }
+    var addrs []string
+    for i := 0; ; i++ {
+        line := info.Get("slave" + strconv.Itoa(i))
+        if line == "" {
+            break
+        }
+        fields := make(map[string]string)
+        for _, pair := range strings.Split(line, ",") {
+            j := strings.Index(pair, "=")
+            if j < 0 {
+                continue
+            }
+            fields[pair[:j]] = pair[j+1:]
+        }
+        if fields["state"] == "online" {
+            addrs = append(addrs, net.JoinHostPort(fields["ip"], fields["port"]))
+        }
+    }
+    return addrs, nil
+}
+
+// Pings each replica, recording how long it took for LowestLatency.
+// Replicas that fail are left out for a while.
+func (self *ReplicaClient) MeasureLatency() {
+    self.lock.Lock()
+    replicas := self.replicas
+    self.lock.Unlock()
+
+    for _, r := range replicas {
+        start := time.Nanoseconds()
+        _, err := r.client.sendCommand("PING")
+        latency := time.Nanoseconds() - start
+
+        self.lock.Lock()
+        if err != nil {
+            r.downUntil = time.Nanoseconds() + replicaRetryDelay
+        } else {
+            r.latency = latency
+        }
+        self.lock.Unlock()
+    }
+}
+
+// Stops measuring latency. The client can still be used.
+func (self *ReplicaClient) Close() os.Error {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+
+    if !self.closed {
+        self.closed = true
+        close(self.closing)
+    }
+    return nil
+}
+
+func (self *ReplicaClient) measure() {
+    ticker := time.NewTicker(self.interval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-self.closing:
+            return
+        case <-ticker.C:
+        }
+        self.MeasureLatency()
+    }
+}
+
+// returns the replica to read from, or nil to read from the master
+func (self *ReplicaClient) pick() *replica {
+    if self.pin > 0 && time.Nanoseconds()-self.client.lastSent() < self.pin {
+        return nil
+    }
+
+    self.lock.Lock()
+    defer self.lock.Unlock()
+
+    now := time.Nanoseconds()
+    var best *replica
+    for i := range self.replicas {
+        j := (self.next + i) % len(self.replicas)
+        r := self.replicas[j]
+        if r.downUntil > now {
+            continue
+        }
+        if self.mode == RoundRobin {
+            self.next = j + 1
+            return r
+        }
+        if best == nil || r.latency < best.latency {
+            best = r
+        }
+    }
+    return best
+}
+
+// runs a read on a replica, or on the master if there's none or the
+// replica can't be reached
+func (self *ReplicaClient) read(f func(c *client) os.Error) os.Error {
+    r := self.pick()
+    if r == nil {
+        return f(self.masterReads)
+    }
+
+    err := f(r.client)
+    switch err.(type) {
+    case nil, RedisError, *UnexpectedReplyError:
+        return err
+    }
+    self.lock.Lock()
+    r.downUntil = time.Nanoseconds() + replicaRetryDelay
+    self.lock.Unlock()
+    return f(self.masterReads)
+}
+
+func (self *ReplicaClient) Exists(keys ...string) (n int, err os.Error) {
+    err = self.read(func(c *client) (err os.Error) {
+        n, err = c.Exists(keys...)
+        return
+    })
+    return
+}
+
+func (self *ReplicaClient) Get(key string) (val []byte, err os.Error) {
+    err = self.read(func(c *client) (err os.Error) {
+        val, err = c.Get(key)
+        return
+    })
+    return
+}
+
+func (self *ReplicaClient) Mget(keys ...string) (vals [][]byte, err os.Error) {
+    err = self.read(func(c *client) (err os.Error) {
+        vals, err = c.Mget(keys...)
+        return
+    })
+    return
+}
+
+func (self *ReplicaClient) Llen(key string) (n int, err os.Error) {
+    err = self.read(func(c *client) (err os.Error) {
+        n, err = c.Llen(key)
+        return
+    })
+    return
+}
+
+func (self *ReplicaClient) Lrange(key string, start int, end int) (vals [][]byte, err os.Error) {
+    err = self.read(func(c *client) (err os.Error) {
+        vals, err = c.Lrange(key, start, end)
+        return
+    })
+    return
+}
+
+func (self *ReplicaClient) Scard(key string) (n int, err os.Error) {
+    err = self.read(func(c *client) (err os.Error) {
+        n, err = c.Scard(key)
+        return
+    })
+    return
+}
+
+func (self *ReplicaClient) Sismember(key string, value []byte) (ok bool, err os.Error) {
+    err = self.read(func(c *client) (err os.Error) {
+        ok, err = c.Sismember(key, value)
+        return
+    })
+    return
+}
+
+func (self *ReplicaClient) Smembers(key string) (vals [][]byte, err os.Error) {
+    err = self.read(func(c *client) (err os.Error) {
+        vals, err = c.Smembers(key)
+        return
+    })
+    return
+}
+
+func (self *ReplicaClient) Zcard(key string) (n int, err os.Error) {
+    err = self.read(func(c *client) (err os.Error) {
+        n, err = c.Zcard(key)
+        return
+    })
+    return
+}
+
+func (self *ReplicaClient) Zrange(key string, start int, end int) (vals [][]byte, err os.Error) {
+    err = self.read(func(c *client) (err os.Error) {
+        vals, err = c.Zrange(key, start, end)
+        return
+    })
+    return
+}
+
+func (self *ReplicaClient) Zrangebyscore(key string, min ScoreBound, max ScoreBound, offset int, count int) (vals [][]byte, err os.Error) {
+    err = self.read(func(c *client) (err os.Error) {
+        vals, err = c.Zrangebyscore(key, min, max, offset, count)
+        return
+    })
+    return
+}
+
+func (self *ReplicaClient) Zscore(key string, member []byte) (score float64, err os.Error) {
+    err = self.read(func(c *client) (err os.Error) {
+        score, err = c.Zscore(key, member)
+        return
+    })
+    return
+}
+
+func (self *ReplicaClient) Hexists(key string, field string) (ok bool, err os.Error) {
+    err = self.read(func(c *client) (err os.Error) {
+        ok, err = c.Hexists(key, field)
+        return
+    })
+    return
+}
+
+func (self *ReplicaClient) Hget(key string, field string) (val []byte, err os.Error) {
+    err = self.read(func(c *client) (err os.Error) {
+        val, err = c.Hget(key, field)
+        return
+    })
+    return
+}
+
+func (self *ReplicaClient) Hmget(key string, fields ...string) (vals [][]byte, err os.Error) {
+    err = self.read(func(c *client) (err os.Error) {
+        vals, err = c.Hmget(key, fields...)
+        return
+    })
+    return
+}
+
+func (self *ReplicaClient) Hgetall(key string, val interface{}) os.Error {
+    return self.read(func(c *client) os.Error {
+        return c.Hgetall(key, val)
+    })
+}
@@ -0,0 +1,244 @@
+package redis
+
+import (
+    "bufio"
+    "net"
+    "os"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Keeps a client pointed at the master that a group of sentinels monitor.
+//
+// The master is looked up by asking each sentinel in turn, and is only
+// used once it confirms its role. A connection to the sentinel that
+// answered stays subscribed to +switch-master, and on failover the
+// master is looked up again. Pooled connections to the old master are
+// closed, so that no command goes to a demoted node, though commands
+// already sent to it may still fail.
+type Sentinel struct {
+    client    *client
+    sentinels []string
+    master    string
+    interval  int64
+    closing   chan bool
+
+    // guards the fields below
+    lock    sync.Mutex
+    current int
+    conn    net.Conn
+    closed  bool
+}
+
+// Looks up the named master and points c at it, then follows failovers
+// in the background until Close. The address c was created with is
+// ignored.
+func NewSentinel(c *client, sentinels []string, master string) (*Sentinel, os.Error) {
+    s := new(Sentinel)
+    s.client = c
+    s.sentinels = append([]string(nil), sentinels...)
+    s.master = master
+    s.interval = pubsubKeepalive
+    s.closing = make(chan bool)
+
+    c.lock.Lock()
+    c.checkAddr = true
+    c.lock.Unlock()
+
+    _, err := s.Resolve()
+    if err != nil {
+        c.lock.Lock()
+        c.checkAddr = false
+        c.lock.Unlock()
+        return nil, err
+    }
+    go s.watch()
+    return s, nil
+}
+
+// Looks up the master again, pointing the client at it, and returns its
+// address.
+func (self *Sentinel) Resolve() (string, os.Error) {
+    var err os.Error = RedisError("no sentinels")
+    for i, sentinel := range self.sentinels {
+        var addr string
+        addr, err = self.ask(sentinel)
+        if err == nil {
+            err = self.checkMaster(addr)
+        }
+        if err != nil {
+            continue
+        }
+
+        // watch the sentinel that answered
+        self.lock.Lock()
+        self.current = i
+        self.lock.Unlock()
+
+        self.client.setAddr(addr)
+        return addr, nil
+    }
+    return "", err
+}
+
+// Stops following failovers.
+func (self *Sentinel) Close() os.Error {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+
+    if self.closed {
+        return nil
+    }
+    self.closed = true
+    close(self.closing)
+    if self.conn != nil {
+        return self.conn.Close()
+    }
+    return nil
+}
+
+// returns the master's address as the sentinel knows it
+func (self *Sentinel) ask(sentinel string) (string, os.Error) {
+    c, err := net.Dial("tcp", sentinel)
+    if err != nil {
+        return "", err
+    }
+    defer c.Close()
+
+    res, err := self.client.rawSend(c, commandBytes("SENTINEL", "GET-MASTER-ADDR-BY-NAME", self.master), readResponse)
+    if err != nil {
+        return "", err
+    }
+    if res == nil {
+        return "", RedisError("sentinel " + sentinel + " doesn't know master " + self.master)
+    }
+    hostPort, err := multiBulkReply("SENTINEL", res)
+    if err != nil {
+        return "", err
+    }
+    if len(hostPort) != 2 {
+        return "", &UnexpectedReplyError{"SENTINEL", res}
+    }
+    return net.JoinHostPort(string(hostPort[0]), string(hostPort[1])), nil
+}
+
+// fails unless the server at addr says it's a master, since a sentinel
+// may not have noticed a failover yet
+func (self *Sentinel) checkMaster(addr string) os.Error {
+    c, err := net.Dial("tcp", addr)
+    if err != nil {
+        return err
+    }
+    defer c.Close()
+
+    res, err := self.client.rawSend(c, commandBytes("ROLE"), readResponse)
+    if err != nil {
+        return err
+    }
+    info, err := parseRole(res)
+    if err != nil {
+        return err
+    }
+    if info.Role != "master" {
+        return RedisError(addr + " is a " + info.Role + ", not a master")
+    }
+    return nil
+}
+
+// follows the sentinels until Close, moving on to the next one when a
+// connection fails
+func (self *Sentinel) watch() {
+    self.lock.Lock()
+    i := self.current
+    self.lock.Unlock()
+
+    for delay := int64(1e8); ; i++ {
+        if self.follow(self.sentinels[i%len(self.sentinels)]) {
+            delay = 1e8
+        }
+
+        select {
+        case <-self.closing:
+            return
+        case <-time.After(delay):
+        }
+        if delay < 10e9 {
+            delay *= 2
+        }
+    }
+}
+
+// subscribes to a sentinel's failover notices and looks up the master
+// whenever it moves. Returns whether the subscription succeeded, once the
+// connection fails.
+func (self *Sentinel) follow(sentinel string) bool {
+    conn, err := net.Dial("tcp", sentinel)
+    if err != nil {
+        return false
+    }
+    defer conn.Close()
+
+    self.lock.Lock()
+    if self.closed {
+        self.lock.Unlock()
+        return false
+    }
+    self.conn = conn
+    self.lock.Unlock()
+
+    reader := bufio.NewReader(conn)
+    err = writeRequest(conn, "SUBSCRIBE", "+switch-master")
+    if err == nil {
+        _, err = readResponse(reader)
+    }
+    if err != nil {
+        return false
+    }
+
+    // the master may have moved while no sentinel was followed
+    self.Resolve()
+
+    done := make(chan bool)
+    defer close(done)
+    go self.keepalive(conn, done)
+
+    for err == nil {
+        conn.SetReadTimeout(2 * self.interval)
+        var res interface{}
+        res, err = readResponse(reader)
+
+        // [message, +switch-master, "name old-ip old-port new-ip new-port"]
+        data, ok := res.([][]byte)
+        if !ok || len(data) != 3 || string(data[0]) != "message" {
+            continue
+        }
+        fields := strings.Fields(string(data[2]))
+        if len(fields) != 5 || fields[0] != self.master {
+            continue
+        }
+        if _, err := self.Resolve(); err != nil {
+            // trust the notice over a sentinel that's behind
+            self.client.setAddr(net.JoinHostPort(fields[3], fields[4]))
+        }
+    }
+    return true
+}
+
+// pings the sentinel until done, so that follow notices when it dies
+// silently
+func (self *Sentinel) keepalive(conn net.Conn, done chan bool) {
+    ticker := time.NewTicker(self.interval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-done:
+            return
+        case <-ticker.C:
+        }
+
+        // a failed write shows up as a failed read as well
+        writeRequest(conn, "PING")
+    }
+}